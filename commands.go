@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	config "strongbox/configuration"
+	"strongbox/control"
+	"strongbox/securefs"
+)
+
+type command struct {
+	help string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":   {"write an encrypted backup of the vault", runBackup},
+	"fsck":     {"check the vault store and repair it", runFsck},
+	"init":     {"create a new vault", runInit},
+	"lock":     {"lock the mounted vault", runLock},
+	"passwd":   {"change the vault password", runPasswd},
+	"restore":  {"verify backups or rebuild the vault from them", runRestore},
+	"slot":     {"list, add or revoke key slots", runSlot},
+	"stats":    {"show how much storage the deduplication saves", runStats},
+	"totp":     {"enable or disable one-time codes", runTotp},
+	"trash":    {"list, restore or purge deleted files", runTrash},
+	"versions": {"list, diff or restore the versions of a file", runVersions},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s: [flags] [command]\n", os.Args[0])
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
+func runCommand(args []string) error {
+	c, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return c.run(args[1:])
+}
+
+// readNewPassword asks for a new password twice
+func readNewPassword() ([]byte, error) {
+	passwd, err := readPassword("Enter New Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passwd) == 0 {
+		return nil, errors.New("must set password")
+	}
+	confirm, err := readPassword("Confirm New Password: ")
+	if err != nil {
+		config.Wipe(passwd)
+		return nil, err
+	}
+	defer config.Wipe(confirm)
+	if !bytes.Equal(passwd, confirm) {
+		config.Wipe(passwd)
+		return nil, errors.New("passwords do not match")
+	}
+	return passwd, nil
+}
+
+func runInit(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	cipher := flags.String("cipher", config.Cfg.Vault.Cipher, "vault cipher [aes-128, aes-192, aes-256], default aes-256.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if config.Cfg.Backup.Memory {
+		return errors.New("backup.memory is set, the vault is created on mount")
+	}
+	if securefs.VaultExists() {
+		return fmt.Errorf("vault %s already exists", config.Cfg.Backup.Path)
+	}
+	if _, err := securefs.CipherKeyLen(*cipher); err != nil {
+		return err
+	}
+	config.Cfg.Vault.Cipher = *cipher
+
+	src, err := currentCredentialSource()
+	if err != nil {
+		return err
+	}
+	switch {
+	case src.kind == sourceKeyfile:
+		data, err := readOrCreateKeyfile(src.arg)
+		if err != nil {
+			return err
+		}
+		config.Cfg.SetKeyfile(data)
+		config.Wipe(data)
+	case src.interactive():
+		passwd, err := src.readNewPassword()
+		if err != nil {
+			return err
+		}
+		config.Cfg.SetPasswd(passwd)
+		config.Wipe(passwd)
+	default:
+		err = src.load()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = securefs.Unlock(securefs.CurrentCredentials())
+	if err != nil {
+		return err
+	}
+	fmt.Println("created vault", securefs.VaultHeaderPath())
+	return nil
+}
+
+func runLock(args []string) error {
+	err := control.SendCommand("lock")
+	if err != nil {
+		return err
+	}
+	fmt.Println("vault locked")
+	return nil
+}
+
+// runStats asks the mounted vault, or opens the store when it is not mounted
+func runStats(args []string) error {
+	reply, err := control.Query("stats")
+	if err == nil {
+		fmt.Println(reply)
+		return nil
+	}
+	if !errors.Is(err, control.ErrNotMounted) || config.Cfg.Backup.Memory {
+		return err
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	s, err := securefs.ReadStats(db.Sealed())
+	if err != nil {
+		return err
+	}
+	fmt.Println(s)
+	return nil
+}
+
+// openStore unlocks the vault and opens its store, for the commands that
+// work on a vault that is not mounted
+func openStore() (securefs.DB, error) {
+	creds, err := unlockCredentials()
+	if err != nil {
+		return nil, err
+	}
+	err = unlockThrottled(creds)
+	if err != nil {
+		return nil, err
+	}
+	db := securefs.GetDBInstance()
+	err = db.InitDB()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// runFsck checks the store of a vault that is not mounted
+func runFsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "delete the broken records, move the lost files to the trash and rewrite the counts.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.Cfg.Backup.Memory {
+		return errors.New("backup.memory is set, there is no store to check")
+	}
+	if _, err := control.Query("stats"); !errors.Is(err, control.ErrNotMounted) {
+		return errors.New("the vault is mounted, lock it before fsck")
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	report, err := securefs.Fsck(db, *repair)
+	if report != nil {
+		fmt.Println(report)
+	}
+	if err != nil {
+		return err
+	}
+	if left := len(report.Problems) - report.Repaired(); left != 0 {
+		return fmt.Errorf("%d problems left", left)
+	}
+	return nil
+}
+
+// runVersions asks the mounted vault, or opens the file system on the store
+// when it is not mounted
+func runVersions(args []string) error {
+	return runOnVault("versions", args, func(root *securefs.BoxInode) (string, error) {
+		return control.VersionCommand(root, args)
+	})
+}
+
+// runTrash works on the trash like runVersions
+func runTrash(args []string) error {
+	return runOnVault("trash", args, func(root *securefs.BoxInode) (string, error) {
+		return control.TrashCommand(root, args)
+	})
+}
+
+// runOnVault sends cmd to the mounted vault, or runs local on the file system
+// of the store when it is not mounted, and prints the reply
+func runOnVault(cmd string, args []string, local func(root *securefs.BoxInode) (string, error)) error {
+	reply, err := control.Query(cmd, args...)
+	if errors.Is(err, control.ErrNotMounted) && !config.Cfg.Backup.Memory {
+		reply, err = onStore(local)
+	}
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		fmt.Println(reply)
+	}
+	return nil
+}
+
+func onStore(fn func(root *securefs.BoxInode) (string, error)) (string, error) {
+	db, err := openStore()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	root, err := securefs.NewRootBoxInode(db.Sealed())
+	if err != nil {
+		return "", err
+	}
+	reply, err := fn(root)
+	if cerr := root.Close(); err == nil {
+		err = cerr
+	}
+	return reply, err
+}
+
+// runBackup asks the mounted vault for a backup, or opens the store when it
+// is not mounted
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := flags.String("out", "", "archive to write, it must not exist.")
+	parent := flags.String("incremental", "", "archive the backup follows, only what changed since it is written.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() != 0 {
+		return errors.New("usage: backup -out FILE [-incremental PREVIOUS]")
+	}
+	if config.Cfg.Backup.Memory {
+		return errors.New("backup.memory is set, there is no vault to back up")
+	}
+	// the mounted strongbox may run in another directory
+	for _, path := range []*string{out, parent} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return err
+		}
+		*path = abs
+	}
+
+	reply, err := control.Query("backup", *out, *parent)
+	if errors.Is(err, control.ErrNotMounted) {
+		reply, err = backupStore(*out, *parent)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(reply)
+	return nil
+}
+
+func backupStore(out string, parent string) (string, error) {
+	db, err := openStore()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	a, err := securefs.BackupFile(db, out, parent)
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
+// runRestore rebuilds the vault at backup.path from a full backup and the
+// incremental ones that follow it, in order
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "only check the archives, nothing is written.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: restore [-verify] FULL [INCREMENTAL...]")
+	}
+	// the vault header is the one of the archives, there is no vault yet
+	src, err := currentCredentialSource()
+	if err != nil {
+		return err
+	}
+	if err := src.loadFor(securefs.ArchiveTOTPEnabled(flags.Args())); err != nil {
+		return err
+	}
+	creds := securefs.CurrentCredentials()
+
+	var archives []*securefs.Archive
+	if *verify {
+		archives, _, _, err = securefs.VerifyArchives(flags.Args(), creds)
+	} else {
+		archives, err = securefs.RestoreArchives(flags.Args(), creds)
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range archives {
+		fmt.Println(a)
+	}
+	if *verify {
+		fmt.Println("archives are intact")
+	} else {
+		fmt.Println("restored vault", config.Cfg.Backup.Path)
+	}
+	return nil
+}
+
+func runPasswd(args []string) error {
+	src, err := currentCredentialSource()
+	if err != nil {
+		return err
+	}
+	if src.kind == sourceKeyfile {
+		return errors.New("passwd changes a password slot, see slot add")
+	}
+	oldPasswd, err := src.readPassword()
+	if err != nil {
+		return err
+	}
+	defer config.Wipe(oldPasswd)
+	if securefs.TOTPEnabled() {
+		code, err := src.readOTP()
+		if err != nil {
+			return err
+		}
+		config.Cfg.SetOTP(code)
+	}
+	newPasswd, err := src.readNewPassword()
+	if err != nil {
+		return err
+	}
+	defer config.Wipe(newPasswd)
+
+	err = securefs.ChangeVaultPasswd(oldPasswd, newPasswd)
+	if err != nil {
+		return err
+	}
+	fmt.Println("password changed")
+	return nil
+}
+
+func runSlot(args []string) error {
+	const slotUsage = "usage: slot list | slot add password|recovery [name] | slot add keyfile <path> [name] | slot revoke <id>"
+	if len(args) == 0 {
+		return errors.New(slotUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		slots, err := securefs.ListVaultKeySlots()
+		if err != nil {
+			return err
+		}
+		fmt.Println("ID\tTYPE\tNAME\tCREATED")
+		for _, s := range slots {
+			fmt.Println(s.String())
+		}
+		return nil
+
+	case "add":
+		if len(args) < 2 {
+			return errors.New(slotUsage)
+		}
+		slotType, rest := args[1], args[2:]
+		src, err := currentCredentialSource()
+		if err != nil {
+			return err
+		}
+		c, err := unlockCredentials()
+		if err != nil {
+			return err
+		}
+
+		var raw []byte
+		recovery := ""
+		switch slotType {
+		case securefs.SlotPassword:
+			passwd, err := src.readNewPassword()
+			if err != nil {
+				return err
+			}
+			raw = passwd
+		case securefs.SlotKeyfile:
+			if len(rest) == 0 {
+				return errors.New(slotUsage)
+			}
+			data, err := readOrCreateKeyfile(rest[0])
+			if err != nil {
+				return err
+			}
+			raw, rest = data, rest[1:]
+		case securefs.SlotRecovery:
+			key, err := securefs.NewRecoveryKey()
+			if err != nil {
+				return err
+			}
+			raw, recovery = []byte(key), key
+		default:
+			return errors.New(slotUsage)
+		}
+		name := ""
+		if len(rest) > 0 {
+			name = rest[0]
+		}
+
+		slot, err := securefs.AddVaultKeySlot(c, slotType, name, raw)
+		config.Wipe(raw)
+		if err != nil {
+			return err
+		}
+		fmt.Println("added key slot", slot.ID)
+		if recovery != "" {
+			fmt.Println("recovery key, write it down and keep it safe:")
+			fmt.Println(recovery)
+		}
+		return nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(slotUsage)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		c, err := unlockCredentials()
+		if err != nil {
+			return err
+		}
+		err = securefs.RevokeVaultKeySlot(c, id)
+		if err != nil {
+			return err
+		}
+		fmt.Println("revoked key slot", id)
+		return nil
+	}
+	return errors.New(slotUsage)
+}
+
+func runTotp(args []string) error {
+	const totpUsage = "usage: totp enable [account] | totp disable"
+	if len(args) == 0 {
+		return errors.New(totpUsage)
+	}
+
+	switch args[0] {
+	case "enable":
+		account := "vault"
+		if len(args) > 1 {
+			account = args[1]
+		}
+		c, err := unlockCredentials()
+		if err != nil {
+			return err
+		}
+		secret, err := securefs.NewTOTPSecret()
+		if err != nil {
+			return err
+		}
+		defer config.Wipe(secret)
+		fmt.Println("one-time codes are checked by strongbox when the vault is unlocked, the data is not")
+		fmt.Println("encrypted with them: with a copy of the vault files the password alone is enough.")
+		fmt.Println("add this key to the authenticator app:")
+		fmt.Println(securefs.TOTPURI(secret, account))
+		code, err := readPassword("Enter One-time Code: ")
+		if err != nil {
+			return err
+		}
+		err = securefs.EnableVaultTOTP(c, secret, string(code))
+		if err != nil {
+			return err
+		}
+		fmt.Println("one-time codes enabled")
+		return nil
+
+	case "disable":
+		c, err := unlockCredentials()
+		if err != nil {
+			return err
+		}
+		err = securefs.DisableVaultTOTP(c)
+		if err != nil {
+			return err
+		}
+		fmt.Println("one-time codes disabled")
+		return nil
+	}
+	return errors.New(totpUsage)
+}
+
+// readOrCreateKeyfile generates a random keyfile if path does not exist
+func readOrCreateKeyfile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	data = make([]byte, 64)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, data, 0400)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("generated keyfile", path)
+	return data, nil
+}
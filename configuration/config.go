@@ -1,7 +1,6 @@
 package configuration
 
 import (
-	"crypto/sha1"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -15,15 +14,24 @@ var Cfg Configuration
 
 var innerCfg innerConfiguration
 
+// Audit records security events such as unlock attempts
+var Audit = log.StandardLogger()
+
 type innerConfiguration struct {
 	ConfigFile string
-	SecretKey  []byte
+	Passwd     *Secret
+	Keyfile    *Secret
+	SecretKey  *Secret
+	// one-time code of the second factor, only valid once
+	OTP string
 }
 
 type LoggerConfig struct {
 	Filename string `yaml:"filename,omitempty"`
 	// [debug, info, warn, error]
 	Level string `yaml:"level,omitempty"`
+	// security events, the default log if empty
+	AuditFilename string `yaml:"auditFilename,omitempty"`
 }
 
 type PermissionConfig struct {
@@ -38,6 +46,48 @@ type PermissionConfig struct {
 type BackupConfig struct {
 	Path   string `yaml:"path,omitempty"`
 	Memory bool   `yaml:"memory,omitempty"`
+	// [badger, blobdir], badger if empty
+	Backend string `yaml:"backend,omitempty"`
+	// MiB of written data kept in memory before the writers wait for it to be
+	// stored, 64 if 0
+	DirtyLimit int `yaml:"dirtyLimit,omitempty"`
+	// seconds written data may stay in memory before it is stored, 5 if 0
+	Writeback int `yaml:"writeback,omitempty"`
+	// compression of new file content [zstd, snappy], none if empty
+	Compression string `yaml:"compression,omitempty"`
+	// versions kept of each file when it is closed after writing, 0 none
+	// unless versionDays is set
+	Versions int `yaml:"versions,omitempty"`
+	// days versions are kept, 0 no limit
+	VersionDays int `yaml:"versionDays,omitempty"`
+	// days deleted files and directories are kept in the trash, 0 deletes
+	// them at once
+	TrashDays int `yaml:"trashDays,omitempty"`
+}
+
+// VaultConfig holds the key derivation cost used when a new vault is created,
+// an existing vault always uses the parameters recorded in its header.
+// Zero means the built-in default.
+type VaultConfig struct {
+	// cipher of a new vault [aes-128, aes-192, aes-256]
+	Cipher string `yaml:"cipher,omitempty"`
+	// argon2id passes
+	KdfTime uint32 `yaml:"kdfTime,omitempty"`
+	// argon2id memory, KiB
+	KdfMemory uint32 `yaml:"kdfMemory,omitempty"`
+	// argon2id parallelism
+	KdfThreads uint8 `yaml:"kdfThreads,omitempty"`
+	// password prompts before the command line gives up
+	UnlockRetries int `yaml:"unlockRetries,omitempty"`
+	// destroy the key slots after this many failed unlocks in a row, 0 never
+	DestroyAfter int `yaml:"destroyAfter,omitempty"`
+	// lock the vault after this many minutes without access, 0 never
+	IdleLock int `yaml:"idleLock,omitempty"`
+	// unix socket of the lock command, next to the backup path if empty
+	ControlSocket string `yaml:"controlSocket,omitempty"`
+	// where the command line reads the password: tty, pinentry[:PROGRAM], fd:N, env[:NAME],
+	// keyfile:PATH or systemd[:NAME]
+	Credential string `yaml:"credential,omitempty"`
 }
 
 type Configuration struct {
@@ -46,6 +96,7 @@ type Configuration struct {
 	Permission PermissionConfig `yaml:"permission,omitempty"`
 	Logger     LoggerConfig     `yaml:"logger,omitempty"`
 	Backup     BackupConfig     `yaml:"backup,omitempty"`
+	Vault      VaultConfig      `yaml:"vault,omitempty"`
 }
 
 func (c *Configuration) initLogger() {
@@ -74,6 +125,20 @@ func (c *Configuration) initLogger() {
 		TimestampFormat: "2006-01-02 15:04:05",
 		HideKeys:        true,
 	})
+
+	if len(c.Logger.AuditFilename) > 0 {
+		Audit = log.New()
+		Audit.SetOutput(&lumberjack.Logger{
+			Filename:   c.Logger.AuditFilename,
+			MaxSize:    10, // MB
+			MaxBackups: 10,
+			MaxAge:     365, //days
+		})
+		Audit.SetFormatter(&nested.Formatter{
+			TimestampFormat: "2006-01-02 15:04:05",
+			NoColors:        true,
+		})
+	}
 }
 
 func (c *Configuration) Load(file string) error {
@@ -117,13 +182,52 @@ func (c *Configuration) Save() error {
 	return nil
 }
 
-func (c *Configuration) SetPasswd(passwd string) {
-	h := sha1.New()
-	s := h.Sum([]byte(passwd))
+// SetPasswd copies passwd into locked memory, the caller should Wipe passwd
+func (c *Configuration) SetPasswd(passwd []byte) {
+	innerCfg.Passwd.Wipe()
+	innerCfg.Passwd = NewSecret(passwd)
+}
 
-	innerCfg.SecretKey = s[0:16]
+func (c *Configuration) GetPasswd() []byte {
+	return innerCfg.Passwd.Bytes()
+}
+
+// SetKeyfile keeps the content of the keyfile used to unlock the vault
+func (c *Configuration) SetKeyfile(data []byte) {
+	innerCfg.Keyfile.Wipe()
+	innerCfg.Keyfile = NewSecret(data)
+}
+
+func (c *Configuration) GetKeyfile() []byte {
+	return innerCfg.Keyfile.Bytes()
+}
+
+// SetOTP keeps the one-time code given with the password
+func (c *Configuration) SetOTP(code string) {
+	innerCfg.OTP = code
+}
+
+func (c *Configuration) GetOTP() string {
+	return innerCfg.OTP
+}
+
+// SetCryptKey keeps the master key of the unlocked vault, see securefs.Unlock
+func (c *Configuration) SetCryptKey(key []byte) {
+	innerCfg.SecretKey.Wipe()
+	innerCfg.SecretKey = NewSecret(key)
 }
 
 func (c *Configuration) GetCryptKey() []byte {
-	return innerCfg.SecretKey
+	return innerCfg.SecretKey.Bytes()
+}
+
+// WipeSecrets zeroes the credentials and the key on unmount and exit
+func (c *Configuration) WipeSecrets() {
+	innerCfg.Passwd.Wipe()
+	innerCfg.Keyfile.Wipe()
+	innerCfg.SecretKey.Wipe()
+	innerCfg.Passwd = nil
+	innerCfg.Keyfile = nil
+	innerCfg.SecretKey = nil
+	innerCfg.OTP = ""
 }
@@ -0,0 +1,48 @@
+package configuration
+
+// Secret holds key material outside of the garbage collected heap, locked in
+// memory where the platform allows it so it is never swapped out. Wipe
+// zeroes and releases it, a nil Secret is empty.
+type Secret struct {
+	data   []byte
+	mem    []byte
+	mapped bool
+}
+
+// NewSecret copies data into locked memory, the caller should Wipe its copy
+func NewSecret(data []byte) *Secret {
+	if len(data) == 0 {
+		return nil
+	}
+	s := &Secret{}
+	s.mem, s.mapped = allocLocked(len(data))
+	s.data = s.mem[:len(data)]
+	copy(s.data, data)
+	return s
+}
+
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.data
+}
+
+func (s *Secret) Wipe() {
+	if s == nil || s.mem == nil {
+		return
+	}
+	Wipe(s.mem)
+	if s.mapped {
+		freeLocked(s.mem)
+	}
+	s.data = nil
+	s.mem = nil
+}
+
+// Wipe zeroes a temporary copy of key material
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
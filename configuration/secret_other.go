@@ -0,0 +1,10 @@
+//go:build !unix
+
+package configuration
+
+func allocLocked(n int) ([]byte, bool) {
+	return make([]byte, n), false
+}
+
+func freeLocked(mem []byte) {
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package configuration
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// allocLocked maps the secret outside of the heap, falls back to the heap if
+// that fails
+func allocLocked(n int) ([]byte, bool) {
+	page := os.Getpagesize()
+	size := (n + page - 1) / page * page
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		log.Warn("secret: mmap failed, using heap memory:", err)
+		return make([]byte, n), false
+	}
+	if err := unix.Mlock(mem); err != nil {
+		log.Warn("secret: mlock failed, memory may be swapped:", err)
+	}
+	return mem, true
+}
+
+func freeLocked(mem []byte) {
+	unix.Munlock(mem)
+	unix.Munmap(mem)
+}
@@ -2,6 +2,7 @@ package control
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	config "strongbox/configuration"
@@ -15,11 +16,21 @@ import (
 
 type Control struct {
 	server  *fuse.Server
+	root    *securefs.BoxInode
 	running bool
+	// set when the last unmount came from Lock
+	locked bool
+
+	mu       sync.Mutex
+	stopIdle chan struct{}
+	socket   *socketServer
+	onLock   []func()
 }
 
 var controlInstance *Control
 
+var ErrNotMounted = errors.New("not mounted")
+
 func GetControl() *Control {
 	if controlInstance == nil {
 		controlInstance = &Control{}
@@ -28,6 +39,8 @@ func GetControl() *Control {
 }
 
 func (c *Control) Mount() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.running {
 		return errors.New("already mounted")
 	}
@@ -43,7 +56,7 @@ func (c *Control) Mount() error {
 		return errors.New("mount point must set")
 	}
 
-	boxfsRoot, err := securefs.NewRootBoxInode()
+	boxfsRoot, err := securefs.NewRootBoxInode(securefs.GetDBInstance().Sealed())
 	if err != nil {
 		log.Errorf("NewRootBoxInode: %v", err)
 		return err
@@ -69,7 +82,18 @@ func (c *Control) Mount() error {
 	}
 	log.Info("Mounted: ", mountPoint)
 
+	c.root = boxfsRoot
+	c.root.EnableNotify()
+	c.root.StartWriteback()
 	c.running = true
+	c.locked = false
+	securefs.Touch()
+	c.startIdleLock()
+	c.socket, err = listenSocket(c)
+	if err != nil {
+		// the vault is usable without it, only the lock command fails
+		log.Error("control socket: ", err)
+	}
 	return nil
 }
 
@@ -82,12 +106,137 @@ func (c *Control) Running() bool {
 	return c.running
 }
 
+// Locked reports whether the vault was locked, not unmounted on exit
+func (c *Control) Locked() bool {
+	return c.locked
+}
+
+// OnLock registers fn to be called after the vault is locked, from any
+// goroutine
+func (c *Control) OnLock(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onLock = append(c.onLock, fn)
+}
+
 func (c *Control) Unmount() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer config.Cfg.WipeSecrets()
 	if !c.running {
 		return
 	}
 	log.Info("Unmount: ", config.Cfg.MountPoint)
 	c.server.Unmount()
+	c.close()
+}
+
+// Lock unmounts the vault and wipes the key, the next Mount asks for the
+// credentials again. Nothing is wiped if the mount point is busy.
+func (c *Control) Lock() error {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return ErrNotMounted
+	}
+	log.Info("Lock: ", config.Cfg.MountPoint)
+	err := c.server.Unmount()
+	if err != nil {
+		c.mu.Unlock()
+		log.Error("lock: unmount failed: ", err)
+		return err
+	}
+	c.close()
+	config.Cfg.WipeSecrets()
+	c.locked = true
+	handlers := c.onLock
+	c.mu.Unlock()
+
+	config.Audit.WithField("vault", config.Cfg.Backup.Path).Info("vault locked")
+	for _, fn := range handlers {
+		fn()
+	}
+	return nil
+}
+
+// Stats counts the chunks of the mounted vault
+func (c *Control) Stats() (securefs.Stats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return securefs.Stats{}, ErrNotMounted
+	}
+	return securefs.ReadStats(securefs.GetDBInstance().Sealed())
+}
+
+// Backup writes a backup of the mounted vault to out, an incremental one
+// following the archive parent when it is set
+func (c *Control) Backup(out string, parent string) (*securefs.Archive, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return nil, ErrNotMounted
+	}
+	// the archive holds what was written up to now
+	if err := c.root.Sync(); err != nil {
+		return nil, err
+	}
+	return securefs.BackupFile(securefs.GetDBInstance(), out, parent)
+}
+
+// close releases what Mount opened once the file system is unmounted
+func (c *Control) close() {
+	if c.stopIdle != nil {
+		close(c.stopIdle)
+		c.stopIdle = nil
+	}
+	if c.socket != nil {
+		c.socket.Close()
+		c.socket = nil
+	}
+	if c.root != nil {
+		if err := c.root.Close(); err != nil {
+			log.Error("writeback on close: ", err)
+		}
+		c.root = nil
+	}
 	securefs.GetDBInstance().Close()
 	c.running = false
 }
+
+// startIdleLock locks the vault once it was not accessed for
+// vault.idleLock minutes
+func (c *Control) startIdleLock() {
+	timeout := time.Duration(config.Cfg.Vault.IdleLock) * time.Minute
+	if timeout <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	c.stopIdle = stop
+
+	go func() {
+		check := timeout / 10
+		if check > time.Minute {
+			check = time.Minute
+		}
+		ticker := time.NewTicker(check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if securefs.IdleTime() < timeout {
+					continue
+				}
+				log.Info("vault idle for ", timeout, ", lock")
+				err := c.Lock()
+				if err == nil || err == ErrNotMounted {
+					return
+				}
+				// busy, try again after the next access
+				securefs.Touch()
+			}
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	config "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SocketPath is the unix socket a mounted strongbox listens on for commands
+// such as lock, vault.controlSocket or next to the backup path
+func SocketPath() string {
+	if config.Cfg.Vault.ControlSocket != "" {
+		return config.Cfg.Vault.ControlSocket
+	}
+	if config.Cfg.Backup.Memory || config.Cfg.Backup.Path == "" {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("strongbox-%d.sock", os.Getuid()))
+	}
+	return config.Cfg.Backup.Path + ".sock"
+}
+
+// ErrContentOnSocket refuses the commands that return file content on the
+// socket, they run in the GUI or on the store of a locked vault
+var ErrContentOnSocket = errors.New("the mounted vault does not show file content on the control socket, use the File Versions window or lock the vault")
+
+// ErrChangeOnSocket refuses the commands that change files on the socket, any
+// process of the user reaches it without the process checks of the file
+// system, they run in the GUI or on the store of a locked vault
+var ErrChangeOnSocket = errors.New("the mounted vault does not change files on the control socket, use the GUI or lock the vault")
+
+// socketServer answers one line commands, the command and its arguments
+// separated by tabs, with "error: <message>" or "ok" followed by the lines
+// of the reply
+type socketServer struct {
+	listener net.Listener
+	handlers map[string]func(args []string) (string, error)
+}
+
+func listenSocket(c *Control) (*socketServer, error) {
+	path := SocketPath()
+	// left behind by a process that did not exit cleanly
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is used by another strongbox", path)
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only the user running strongbox can send commands
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &socketServer{
+		listener: l,
+		handlers: map[string]func(args []string) (string, error){
+			"lock": func(args []string) (string, error) {
+				return "", c.Lock()
+			},
+			"stats": func(args []string) (string, error) {
+				s, err := c.Stats()
+				return s.String(), err
+			},
+			"versions": func(args []string) (string, error) {
+				// any process of the user reaches the socket, none of the
+				// content of the vault goes through it
+				if len(args) > 0 && args[0] == "diff" {
+					return "", ErrContentOnSocket
+				}
+				if len(args) > 0 && args[0] != "list" {
+					return "", ErrChangeOnSocket
+				}
+				return VersionCommand(c, args)
+			},
+			"trash": func(args []string) (string, error) {
+				if len(args) > 0 && args[0] != "list" {
+					return "", ErrChangeOnSocket
+				}
+				return TrashCommand(c, args)
+			},
+			"backup": func(args []string) (string, error) {
+				if len(args) != 2 {
+					return "", errors.New("usage: backup OUT PARENT")
+				}
+				a, err := c.Backup(args[0], args[1])
+				if err != nil {
+					return "", err
+				}
+				return a.String(), nil
+			},
+		},
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *socketServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("control socket: ", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socketServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	args := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	cmd := strings.TrimSpace(args[0])
+
+	handler, ok := s.handlers[cmd]
+	if !ok {
+		fmt.Fprintf(conn, "error: unknown command %q\n", cmd)
+		return
+	}
+	log.Info("control socket: ", cmd)
+	reply, err := handler(args[1:])
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+	if reply != "" {
+		fmt.Fprintln(conn, reply)
+	}
+}
+
+func (s *socketServer) Close() {
+	s.listener.Close()
+}
+
+// SendCommand sends cmd to the strongbox mounted with the current
+// configuration
+func SendCommand(cmd string) error {
+	_, err := Query(cmd)
+	return err
+}
+
+// Query sends cmd and its arguments like SendCommand and returns the reply,
+// ErrNotMounted if no strongbox listens
+func Query(cmd string, args ...string) (string, error) {
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\t\n") {
+			return "", fmt.Errorf("argument %q has a tab or a newline", arg)
+		}
+	}
+	conn, err := net.Dial("unix", SocketPath())
+	if err != nil {
+		return "", fmt.Errorf("vault %w: %v", ErrNotMounted, err)
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, strings.Join(append([]string{cmd}, args...), "\t"))
+	if err != nil {
+		return "", err
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	status = strings.TrimSpace(status)
+	if status != "ok" {
+		return "", errors.New(strings.TrimPrefix(status, "error: "))
+	}
+	reply, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(reply), "\n"), nil
+}
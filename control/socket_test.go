@@ -0,0 +1,51 @@
+package control
+
+import (
+	"path/filepath"
+	"testing"
+
+	config "strongbox/configuration"
+)
+
+func testSocket(t *testing.T) {
+	config.Cfg.Vault.ControlSocket = filepath.Join(t.TempDir(), "control.sock")
+	t.Cleanup(func() { config.Cfg.Vault.ControlSocket = "" })
+	s, err := listenSocket(&Control{})
+	if err != nil {
+		t.Fatal("listenSocket:", err)
+	}
+	t.Cleanup(s.Close)
+}
+
+func TestSocketTrash(t *testing.T) {
+	testSocket(t)
+
+	for _, args := range [][]string{{"restore", "42"}, {"restore", "42", "/a"}, {"purge", "42"}, {"purge"}} {
+		_, err := Query("trash", args...)
+		if err == nil || err.Error() != ErrChangeOnSocket.Error() {
+			t.Fatal("trash", args, "on the socket:", err)
+		}
+	}
+	// list reaches the vault, which is not mounted
+	if _, err := Query("trash", "list"); err == nil || err.Error() != ErrNotMounted.Error() {
+		t.Fatal("trash list on the socket:", err)
+	}
+}
+
+func TestSocketVersions(t *testing.T) {
+	testSocket(t)
+
+	refused := map[error][]string{
+		ErrContentOnSocket: {"diff", "/a", "1"},
+		ErrChangeOnSocket:  {"restore", "/a", "1"},
+	}
+	for want, args := range refused {
+		_, err := Query("versions", args...)
+		if err == nil || err.Error() != want.Error() {
+			t.Fatal("versions", args, "on the socket:", err)
+		}
+	}
+	if _, err := Query("versions", "list", "/a"); err == nil || err.Error() != ErrNotMounted.Error() {
+		t.Fatal("versions list on the socket:", err)
+	}
+}
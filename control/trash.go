@@ -0,0 +1,134 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"strongbox/securefs"
+)
+
+// Trashed is a file system with a trash, the mounted vault or a root opened
+// on the store
+type Trashed interface {
+	Trash() ([]securefs.TrashEntry, error)
+	RestoreTrash(ino uint64, to string) error
+	PurgeTrash(ino uint64) error
+	EmptyTrash(before time.Time) (int, error)
+}
+
+// Trash lists the trash of the mounted vault
+func (c *Control) Trash() ([]securefs.TrashEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return nil, ErrNotMounted
+	}
+	return c.root.Trash()
+}
+
+// RestoreTrash puts an entry of the trash of the mounted vault back at to,
+// where it was deleted if to is empty
+func (c *Control) RestoreTrash(ino uint64, to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return ErrNotMounted
+	}
+	return c.root.RestoreTrash(ino, to)
+}
+
+// PurgeTrash deletes an entry of the trash of the mounted vault for good
+func (c *Control) PurgeTrash(ino uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return ErrNotMounted
+	}
+	return c.root.PurgeTrash(ino)
+}
+
+// EmptyTrash purges the entries of the mounted vault deleted before the time
+// before, all of them for the zero time
+func (c *Control) EmptyTrash(before time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return 0, ErrNotMounted
+	}
+	return c.root.EmptyTrash(before)
+}
+
+const trashUsage = "trash list | restore ID [PATH] | purge [ID]"
+
+// TrashCommand runs the trash command of the socket and of the command line
+// on t, entries are named by the ID list shows:
+//
+//	list               the deleted entries
+//	restore ID [PATH]  an entry back where it was deleted, or at PATH
+//	purge [ID]         an entry, or the whole trash, for good
+func TrashCommand(t Trashed, args []string) (string, error) {
+	usage := errors.New("usage: " + trashUsage)
+	if len(args) == 0 {
+		return "", usage
+	}
+	var ino uint64
+	if len(args) > 1 {
+		var err error
+		ino, err = strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad trash id %q", args[1])
+		}
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		entries, err := t.Trash()
+		if err != nil {
+			return "", err
+		}
+		return FormatTrash(entries), nil
+
+	case args[0] == "restore" && (len(args) == 2 || len(args) == 3):
+		to := ""
+		if len(args) == 3 {
+			to = args[2]
+		}
+		return "", t.RestoreTrash(ino, to)
+
+	case args[0] == "purge" && len(args) == 2:
+		return "", t.PurgeTrash(ino)
+
+	case args[0] == "purge" && len(args) == 1:
+		n, err := t.EmptyTrash(time.Time{})
+		return fmt.Sprintf("purged %d entries", n), err
+	}
+	return "", usage
+}
+
+// FormatTrash is the table of trash entries the command line prints
+func FormatTrash(entries []securefs.TrashEntry) string {
+	if len(entries) == 0 {
+		return "trash is empty"
+	}
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDELETED\tSIZE\tUID\tPROCESS\tPATH")
+	for _, e := range entries {
+		process := e.Process
+		if process == "" {
+			process = "-"
+		}
+		path := e.Path
+		if e.Dir {
+			path += "/"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\n", e.Ino, e.Time.Local().Format("2006-01-02 15:04:05"), e.Size, e.Uid, process, path)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,70 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"strongbox/securefs"
+)
+
+// fakeTrash records the calls TrashCommand makes
+type fakeTrash struct {
+	calls []string
+}
+
+func (f *fakeTrash) Trash() ([]securefs.TrashEntry, error) {
+	f.calls = append(f.calls, "list")
+	return []securefs.TrashEntry{{Ino: 42, Path: "/a", Size: 3, Time: time.Now()}}, nil
+}
+
+func (f *fakeTrash) RestoreTrash(ino uint64, to string) error {
+	f.calls = append(f.calls, fmt.Sprintf("restore %d %q", ino, to))
+	return nil
+}
+
+func (f *fakeTrash) PurgeTrash(ino uint64) error {
+	f.calls = append(f.calls, fmt.Sprint("purge ", ino))
+	return nil
+}
+
+func (f *fakeTrash) EmptyTrash(before time.Time) (int, error) {
+	f.calls = append(f.calls, fmt.Sprint("empty ", before.IsZero()))
+	return 2, nil
+}
+
+func TestTrashCommand(t *testing.T) {
+	calls := map[string][]string{
+		"list":            {"list"},
+		`restore 42 ""`:   {"restore", "42"},
+		`restore 42 "/b"`: {"restore", "42", "/b"},
+		"purge 42":        {"purge", "42"},
+		"empty true":      {"purge"},
+	}
+	for call, args := range calls {
+		f := &fakeTrash{}
+		reply, err := TrashCommand(f, args)
+		if err != nil {
+			t.Fatal(args, ":", err)
+		}
+		if len(f.calls) != 1 || f.calls[0] != call {
+			t.Fatal(args, "called", f.calls)
+		}
+		if args[0] == "purge" && len(args) == 1 && reply != "purged 2 entries" {
+			t.Fatal("purge reply:", reply)
+		}
+	}
+
+	reply, _ := TrashCommand(&fakeTrash{}, []string{"list"})
+	if lines := strings.Split(reply, "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "42 ") || !strings.HasSuffix(lines[1], " /a") {
+		t.Fatal("list reply:", reply)
+	}
+
+	for _, args := range [][]string{nil, {"list", "42"}, {"restore"}, {"restore", "x"}, {"restore", "42", "/b", "c"}, {"purge", "-1"}, {"purge", "1", "2"}, {"empty"}} {
+		f := &fakeTrash{}
+		if _, err := TrashCommand(f, args); err == nil || len(f.calls) != 0 {
+			t.Fatal(args, "accepted:", f.calls)
+		}
+	}
+}
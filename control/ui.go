@@ -1,7 +1,13 @@
 package control
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,6 +20,7 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/driver/desktop"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/widget"
 
 	cfg "strongbox/configuration"
@@ -29,32 +36,511 @@ func ShowQuicDialog(a fyne.App, msg string, win fyne.Window) {
 }
 
 func ShowPasswordDialog(a fyne.App, win fyne.Window) {
+	showPasswordDialog(a, win, "")
+}
+
+// showPasswordDialog asks for the credentials until the vault accepts them,
+// a new vault asks for the password twice
+func showPasswordDialog(a fyne.App, win fyne.Window, msg string) {
 	const leastPasswdLen = 3
+	create := !securefs.VaultExists()
 	passwd := ""
+	var keyfile []byte
 	passwdEntry := widget.NewPasswordEntry()
 	passwdEntry.Validator = func(input string) error {
-		if len(input) < leastPasswdLen {
+		if len(input) < leastPasswdLen && keyfile == nil {
 			return fmt.Errorf("must input least %d char", leastPasswdLen)
 		}
 		passwd = input
 		return nil
 	}
 	passwdItem := &widget.FormItem{
-		Text:   "Password",
-		Widget: passwdEntry,
+		Text:     "Password",
+		Widget:   passwdEntry,
+		HintText: "password or recovery key",
 	}
 	// passwdItem.Widget.Resize(fyne.NewSize(450, 300))
 
-	items := []*widget.FormItem{passwdItem}
-	d := dialog.NewForm("Input Password", "Submit", "Cancel", items, func(confirm bool) {
-		if confirm {
-			cfg.Cfg.SetPasswd(passwd)
+	otpEntry := widget.NewEntry()
+
+	keyfileLabel := widget.NewLabel("")
+	keyfileSelect := widget.NewButton("...", func() {
+		dlg := dialog.NewFileOpen(func(r fyne.URIReadCloser, err error) {
+			if err != nil || r == nil {
+				return
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil {
+				log.Error("read keyfile failed:", err)
+				return
+			}
+			keyfile = data
+			keyfileLabel.SetText(r.URI().Name())
+			passwdEntry.Validate()
+		}, win)
+		dlg.Show()
+	})
+	keyfileItem := &widget.FormItem{
+		Text:   "Keyfile",
+		Widget: container.NewBorder(nil, nil, nil, keyfileSelect, keyfileLabel),
+	}
+
+	title := "Input Password"
+	items := []*widget.FormItem{}
+	if msg != "" {
+		items = append(items, &widget.FormItem{Text: "", Widget: widget.NewLabel(msg)})
+	}
+	if create {
+		title = "Create Vault Password"
+		passwdItem.HintText = ""
+		confirmEntry := widget.NewPasswordEntry()
+		confirmEntry.Validator = func(input string) error {
+			if input != passwdEntry.Text {
+				return fmt.Errorf("passwords do not match")
+			}
+			return nil
+		}
+		cipherSelect := widget.NewSelect([]string{securefs.CipherAES128, securefs.CipherAES192, securefs.CipherAES256}, func(value string) {
+			cfg.Cfg.Vault.Cipher = value
+		})
+		if cfg.Cfg.Vault.Cipher != "" {
+			cipherSelect.SetSelected(cfg.Cfg.Vault.Cipher)
 		} else {
+			cipherSelect.SetSelected(securefs.CipherAES256)
+		}
+		items = append(items, passwdItem, &widget.FormItem{Text: "Confirm", Widget: confirmEntry},
+			&widget.FormItem{Text: "Cipher", Widget: cipherSelect})
+	} else {
+		items = append(items, passwdItem, keyfileItem)
+		if securefs.TOTPEnabled() {
+			items = append(items, &widget.FormItem{Text: "Code", Widget: otpEntry, HintText: "one-time code"})
+		}
+	}
+
+	d := dialog.NewForm(title, "Submit", "Cancel", items, func(confirm bool) {
+		if !confirm {
 			a.Quit()
+			return
+		}
+		cfg.Cfg.SetPasswd([]byte(passwd))
+		cfg.Cfg.SetKeyfile(keyfile)
+		cfg.Cfg.SetOTP(otpEntry.Text)
+		cfg.Wipe(keyfile)
+		passwdEntry.SetText("")
+		err := securefs.Unlock(securefs.CurrentCredentials())
+		if errors.Is(err, securefs.ErrWrongPassword) {
+			msg := "Wrong password, try again."
+			if securefs.TOTPEnabled() {
+				msg = "Wrong password or one-time code, try again."
+			}
+			showPasswordDialog(a, win, msg)
+			return
+		}
+		if err != nil {
+			showPasswordDialog(a, win, err.Error())
+			return
 		}
 	}, win)
 
-	d.Resize(fyne.NewSize(300, 180))
+	d.Resize(fyne.NewSize(300, 240))
+	d.Show()
+}
+
+func ShowChangePasswordDialog(a fyne.App, win fyne.Window) {
+	const leastPasswdLen = 3
+	oldEntry := widget.NewPasswordEntry()
+	newEntry := widget.NewPasswordEntry()
+	newEntry.Validator = func(input string) error {
+		if len(input) < leastPasswdLen {
+			return fmt.Errorf("must input least %d char", leastPasswdLen)
+		}
+		return nil
+	}
+	confirmEntry := widget.NewPasswordEntry()
+	confirmEntry.Validator = func(input string) error {
+		if input != newEntry.Text {
+			return fmt.Errorf("passwords do not match")
+		}
+		return nil
+	}
+
+	otpEntry := widget.NewEntry()
+
+	items := []*widget.FormItem{
+		{Text: "Current Password", Widget: oldEntry},
+		{Text: "New Password", Widget: newEntry},
+		{Text: "Confirm Password", Widget: confirmEntry},
+	}
+	if securefs.TOTPEnabled() {
+		items = append(items, &widget.FormItem{Text: "Code", Widget: otpEntry, HintText: "one-time code"})
+	}
+	d := dialog.NewForm("Change Password", "Submit", "Cancel", items, func(confirm bool) {
+		if !confirm {
+			return
+		}
+		cfg.Cfg.SetOTP(otpEntry.Text)
+		err := securefs.ChangeVaultPasswd([]byte(oldEntry.Text), []byte(newEntry.Text))
+		if err != nil {
+			info := dialog.NewInformation("Change Password Failed", err.Error(), win)
+			info.Resize(fyne.NewSize(310, 180))
+			info.Show()
+			return
+		}
+		cfg.Cfg.SetPasswd([]byte(newEntry.Text))
+		oldEntry.SetText("")
+		newEntry.SetText("")
+		confirmEntry.SetText("")
+		info := dialog.NewInformation("Tips", "password changed", win)
+		info.Resize(fyne.NewSize(310, 180))
+		info.Show()
+	}, win)
+
+	d.Resize(fyne.NewSize(360, 260))
+	d.Show()
+}
+
+func ShowKeySlotsDialog(a fyne.App, win fyne.Window) {
+	d := a.NewWindow("Key Slots")
+
+	showError := func(err error) {
+		info := dialog.NewInformation("Error", err.Error(), d)
+		info.Resize(fyne.NewSize(310, 180))
+		info.Show()
+	}
+
+	// each change of the header needs the credentials, wiped when the vault
+	// was locked, and a fresh one-time code
+	withCredentials := func(fn func(c securefs.Credentials)) {
+		c := securefs.CurrentCredentials()
+		items := []*widget.FormItem{}
+		passwdEntry := widget.NewPasswordEntry()
+		if len(c.Passwd) == 0 && len(c.Keyfile) == 0 {
+			items = append(items, &widget.FormItem{Text: "Password", Widget: passwdEntry, HintText: "password or recovery key"})
+		}
+		otpEntry := widget.NewEntry()
+		if securefs.TOTPEnabled() {
+			items = append(items, &widget.FormItem{Text: "Code", Widget: otpEntry, HintText: "one-time code"})
+		}
+		if len(items) == 0 {
+			fn(c)
+			return
+		}
+		dialog.ShowForm("Unlock Key Slots", "OK", "Cancel", items, func(ok bool) {
+			if !ok {
+				return
+			}
+			if passwdEntry.Text != "" {
+				c.Passwd = []byte(passwdEntry.Text)
+				defer cfg.Wipe(c.Passwd)
+				passwdEntry.SetText("")
+			}
+			c.OTP = otpEntry.Text
+			fn(c)
+		}, d)
+	}
+
+	slots, err := securefs.ListVaultKeySlots()
+	if err != nil {
+		showError(err)
+	}
+	var list *widget.List
+	list = widget.NewList(
+		func() int {
+			return len(slots)
+		},
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Revoke", nil), widget.NewLabel(""))
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			slot := slots[i]
+			c := o.(*fyne.Container)
+			c.Objects[0].(*widget.Label).SetText(strings.ReplaceAll(slot.String(), "\t", "    "))
+			c.Objects[1].(*widget.Button).OnTapped = func() {
+				dialog.ShowConfirm("Revoke", fmt.Sprintf("revoke key slot %d?", slot.ID), func(ok bool) {
+					if !ok {
+						return
+					}
+					withCredentials(func(c securefs.Credentials) {
+						err := securefs.RevokeVaultKeySlot(c, slot.ID)
+						if err != nil {
+							showError(err)
+							return
+						}
+						slots, _ = securefs.ListVaultKeySlots()
+						list.Refresh()
+					})
+				}, d)
+			}
+		})
+	refresh := func() {
+		slots, _ = securefs.ListVaultKeySlots()
+		list.Refresh()
+	}
+
+	addPasswd := widget.NewButton("Add Password", func() {
+		entry := widget.NewPasswordEntry()
+		dialog.ShowForm("Add Password", "Add", "Cancel", []*widget.FormItem{{Text: "Password", Widget: entry}}, func(ok bool) {
+			if !ok || entry.Text == "" {
+				return
+			}
+			withCredentials(func(c securefs.Credentials) {
+				_, err := securefs.AddVaultKeySlot(c, securefs.SlotPassword, "", []byte(entry.Text))
+				if err != nil {
+					showError(err)
+					return
+				}
+				refresh()
+			})
+		}, d)
+	})
+	addKeyfile := widget.NewButton("Add Keyfile", func() {
+		dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+			if err != nil || r == nil {
+				return
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil {
+				showError(err)
+				return
+			}
+			name := r.URI().Name()
+			withCredentials(func(c securefs.Credentials) {
+				_, err := securefs.AddVaultKeySlot(c, securefs.SlotKeyfile, name, data)
+				if err != nil {
+					showError(err)
+					return
+				}
+				refresh()
+			})
+		}, d)
+	})
+	addRecovery := widget.NewButton("Add Recovery Key", func() {
+		key, err := securefs.NewRecoveryKey()
+		if err != nil {
+			showError(err)
+			return
+		}
+		withCredentials(func(c securefs.Credentials) {
+			_, err := securefs.AddVaultKeySlot(c, securefs.SlotRecovery, "", []byte(key))
+			if err != nil {
+				showError(err)
+				return
+			}
+			refresh()
+			keyEntry := widget.NewEntry()
+			keyEntry.SetText(key)
+			dialog.ShowCustom("Recovery Key", "I have written it down",
+				container.NewVBox(widget.NewLabel("write the recovery key down and keep it safe:"), keyEntry), d)
+		})
+	})
+	cancel := widget.NewButton("Close", func() {
+		d.Close()
+	})
+
+	bottom := container.NewVBox(addPasswd, addKeyfile, addRecovery, cancel)
+	d.SetContent(container.NewBorder(nil, bottom, nil, nil, list))
+	d.Resize(fyne.NewSize(650, 480))
+	d.Show()
+}
+
+// ShowVersionsDialog lists the versions of a file of the mounted vault, shows
+// what changed since one and restores it in place or as a copy
+func ShowVersionsDialog(a fyne.App, win fyne.Window) {
+	d := a.NewWindow("File Versions")
+
+	showError := func(err error) {
+		info := dialog.NewInformation("Error", err.Error(), d)
+		info.Resize(fyne.NewSize(310, 180))
+		info.Show()
+	}
+
+	pathInput := widget.NewEntry()
+	pathInput.SetPlaceHolder("path in the vault, e.g. /notes/todo.txt")
+	var versions []securefs.Version
+	var list *widget.List
+	load := func() {
+		var err error
+		versions, err = GetControl().Versions(pathInput.Text)
+		if err != nil {
+			versions = nil
+			showError(err)
+		}
+		list.Refresh()
+	}
+	pathSelect := widget.NewButton("...", func() {
+		dlg := dialog.NewFileOpen(func(r fyne.URIReadCloser, err error) {
+			if err != nil || r == nil {
+				return
+			}
+			r.Close()
+			path := strings.TrimPrefix(r.URI().Path(), strings.TrimSuffix(cfg.Cfg.MountPoint, "/"))
+			pathInput.SetText(path)
+			load()
+		}, d)
+		if dir, err := storage.ListerForURI(storage.NewFileURI(cfg.Cfg.MountPoint)); err == nil {
+			dlg.SetLocation(dir)
+		}
+		dlg.Show()
+	})
+	loadButton := widget.NewButton("Load", load)
+	top := container.NewBorder(nil, nil, nil, container.NewHBox(pathSelect, loadButton), pathInput)
+
+	list = widget.NewList(
+		func() int {
+			return len(versions)
+		},
+		func() fyne.CanvasObject {
+			buttons := container.NewHBox(widget.NewButton("Diff", nil), widget.NewButton("Restore", nil), widget.NewButton("Copy", nil))
+			return container.NewBorder(nil, nil, nil, buttons, widget.NewLabel(""))
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			v := versions[i]
+			path := pathInput.Text
+			process := v.Process
+			if process == "" {
+				process = "-"
+			}
+			c := o.(*fyne.Container)
+			c.Objects[0].(*widget.Label).SetText(fmt.Sprintf("%d    %s    %d bytes    %s",
+				v.Seq, v.Time.Local().Format("2006-01-02 15:04:05"), v.Size, process))
+			buttons := c.Objects[1].(*fyne.Container).Objects
+			buttons[0].(*widget.Button).OnTapped = func() {
+				diff, err := VersionCommand(GetControl(), []string{"diff", path, fmt.Sprint(v.Seq)})
+				if err != nil {
+					showError(err)
+					return
+				}
+				text := widget.NewMultiLineEntry()
+				text.SetText(diff)
+				text.TextStyle = fyne.TextStyle{Monospace: true}
+				scroll := container.NewScroll(text)
+				scroll.SetMinSize(fyne.NewSize(600, 360))
+				dialog.ShowCustom(fmt.Sprintf("Changes since version %d", v.Seq), "Close", scroll, d)
+			}
+			buttons[1].(*widget.Button).OnTapped = func() {
+				dialog.ShowConfirm("Restore", fmt.Sprintf("replace %s with version %d?", path, v.Seq), func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := GetControl().RestoreVersion(path, v.Seq, ""); err != nil {
+						showError(err)
+						return
+					}
+					load()
+				}, d)
+			}
+			buttons[2].(*widget.Button).OnTapped = func() {
+				entry := widget.NewEntry()
+				entry.SetText(fmt.Sprintf("%s.v%d", filepath.Base(path), v.Seq))
+				dialog.ShowForm("Restore As Copy", "Restore", "Cancel", []*widget.FormItem{{Text: "Name", Widget: entry}}, func(ok bool) {
+					if !ok || entry.Text == "" {
+						return
+					}
+					if err := GetControl().RestoreVersion(path, v.Seq, entry.Text); err != nil {
+						showError(err)
+					}
+				}, d)
+			}
+		})
+
+	cancel := widget.NewButton("Close", func() {
+		d.Close()
+	})
+	d.SetContent(container.NewBorder(top, cancel, nil, nil, list))
+	d.Resize(fyne.NewSize(650, 480))
+	d.Show()
+}
+
+// ShowTrashDialog lists the deleted entries of the mounted vault, restores
+// them where they were or purges them
+func ShowTrashDialog(a fyne.App, win fyne.Window) {
+	d := a.NewWindow("Trash")
+
+	showError := func(err error) {
+		info := dialog.NewInformation("Error", err.Error(), d)
+		info.Resize(fyne.NewSize(310, 180))
+		info.Show()
+	}
+
+	entries, err := GetControl().Trash()
+	if err != nil {
+		showError(err)
+	}
+	var list *widget.List
+	refresh := func() {
+		entries, err = GetControl().Trash()
+		if err != nil {
+			showError(err)
+		}
+		list.Refresh()
+	}
+	list = widget.NewList(
+		func() int {
+			return len(entries)
+		},
+		func() fyne.CanvasObject {
+			buttons := container.NewHBox(widget.NewButton("Restore", nil), widget.NewButton("Purge", nil))
+			return container.NewBorder(nil, nil, nil, buttons, widget.NewLabel(""))
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			e := entries[i]
+			c := o.(*fyne.Container)
+			c.Objects[0].(*widget.Label).SetText(fmt.Sprintf("%s    %s    %d bytes",
+				e.Path, e.Time.Local().Format("2006-01-02 15:04:05"), e.Size))
+			buttons := c.Objects[1].(*fyne.Container).Objects
+			buttons[0].(*widget.Button).OnTapped = func() {
+				err := GetControl().RestoreTrash(e.Ino, "")
+				if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) {
+					// the place it was deleted from is gone or taken
+					entry := widget.NewEntry()
+					entry.SetText(e.Path)
+					dialog.ShowForm("Restore To", "Restore", "Cancel", []*widget.FormItem{{Text: "Path", Widget: entry}}, func(ok bool) {
+						if !ok {
+							return
+						}
+						if err := GetControl().RestoreTrash(e.Ino, entry.Text); err != nil {
+							showError(err)
+						}
+						refresh()
+					}, d)
+					return
+				}
+				if err != nil {
+					showError(err)
+				}
+				refresh()
+			}
+			buttons[1].(*widget.Button).OnTapped = func() {
+				dialog.ShowConfirm("Purge", fmt.Sprintf("delete %s for good?", e.Path), func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := GetControl().PurgeTrash(e.Ino); err != nil {
+						showError(err)
+					}
+					refresh()
+				}, d)
+			}
+		})
+
+	empty := widget.NewButton("Empty Trash", func() {
+		dialog.ShowConfirm("Empty Trash", "delete every entry of the trash for good?", func(ok bool) {
+			if !ok {
+				return
+			}
+			if _, err := GetControl().EmptyTrash(time.Time{}); err != nil {
+				showError(err)
+			}
+			refresh()
+		}, d)
+	})
+	cancel := widget.NewButton("Close", func() {
+		d.Close()
+	})
+	d.SetContent(container.NewBorder(nil, container.NewVBox(empty, cancel), nil, nil, list))
+	d.Resize(fyne.NewSize(650, 480))
 	d.Show()
 }
 
@@ -189,6 +675,21 @@ func RunStrongBoxApp() {
 		m := fyne.NewMenu("StrongBoxTray",
 			fyne.NewMenuItem("Show", func() {
 				win.Show()
+			}),
+			fyne.NewMenuItem("File Versions", func() {
+				ShowVersionsDialog(a, win)
+			}),
+			fyne.NewMenuItem("Trash", func() {
+				ShowTrashDialog(a, win)
+			}),
+			fyne.NewMenuItem("Lock", func() {
+				err := GetControl().Lock()
+				if err != nil && err != ErrNotMounted {
+					win.Show()
+					d := dialog.NewInformation("Lock Failed", err.Error(), win)
+					d.Resize(fyne.NewSize(310, 180))
+					d.Show()
+				}
 			}))
 		desk.SetSystemTrayMenu(m)
 	}
@@ -250,6 +751,21 @@ func RunStrongBoxApp() {
 		ShowListDialog(a, win, 3)
 	})
 
+	passwdButton := widget.NewButton("Change Password", func() {
+		ShowChangePasswordDialog(a, win)
+	})
+	slotsButton := widget.NewButton("Key Slots", func() {
+		ShowKeySlotsDialog(a, win)
+	})
+	passwdRow := container.New(layout.NewGridLayout(2), passwdButton, slotsButton)
+	versionsButton := widget.NewButton("File Versions", func() {
+		ShowVersionsDialog(a, win)
+	})
+	trashButton := widget.NewButton("Trash", func() {
+		ShowTrashDialog(a, win)
+	})
+	recoverRow := container.New(layout.NewGridLayout(2), versionsButton, trashButton)
+
 	// action
 	saveButton := widget.NewButton("Save Config", func() {
 		cfg.Cfg.Save()
@@ -258,6 +774,15 @@ func RunStrongBoxApp() {
 	mountButton.OnTapped = func() {
 		if !GetControl().Running() {
 			err := GetControl().Mount()
+			if errors.Is(err, securefs.ErrWrongPassword) {
+				showPasswordDialog(a, win, "Wrong password, try again.")
+				return
+			}
+			if errors.Is(err, securefs.ErrNoCredentials) {
+				// wiped on the last unmount
+				showPasswordDialog(a, win, "")
+				return
+			}
 			if err != nil {
 				d := dialog.NewInformation("Mount Failed", err.Error(), win)
 				d.Resize(fyne.NewSize(310, 180))
@@ -272,6 +797,11 @@ func RunStrongBoxApp() {
 			mountButton.SetText("Mount")
 		}
 	}
+	// locked from the tray, the lock command or after idle time
+	GetControl().OnLock(func() {
+		mountButton.SetText("Mount")
+		win.Show()
+	})
 	submitRow := container.New(layout.NewGridLayout(2), saveButton, mountButton)
 
 	form := &widget.Form{
@@ -282,6 +812,8 @@ func RunStrongBoxApp() {
 			{Text: "Whitelist", Widget: allowlist},
 			{Text: "Blacklist", Widget: denylist},
 			{Text: "Blockedlist", Widget: blockedlist},
+			{Text: "Password", Widget: passwdRow},
+			{Text: "Recover", Widget: recoverRow},
 			{Text: "", Widget: submitRow},
 		},
 	}
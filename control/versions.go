@@ -0,0 +1,253 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"strongbox/securefs"
+)
+
+// Versioned is a file system whose file versions can be listed, read and
+// restored, the mounted vault or a root opened on the store
+type Versioned interface {
+	Versions(path string) ([]securefs.Version, error)
+	ReadVersion(path string, seq uint64) ([]byte, error)
+	RestoreVersion(path string, seq uint64, name string) error
+}
+
+// Versions lists the versions of the file at path of the mounted vault
+func (c *Control) Versions(path string) ([]securefs.Version, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return nil, ErrNotMounted
+	}
+	return c.root.Versions(path)
+}
+
+// ReadVersion returns the content of a version of the mounted vault, the
+// current content for seq 0
+func (c *Control) ReadVersion(path string, seq uint64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return nil, ErrNotMounted
+	}
+	return c.root.ReadVersion(path, seq)
+}
+
+// RestoreVersion restores a version of the mounted vault in place, or as
+// the file name next to it
+func (c *Control) RestoreVersion(path string, seq uint64, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return ErrNotMounted
+	}
+	return c.root.RestoreVersion(path, seq, name)
+}
+
+const versionsUsage = "versions list PATH | diff PATH SEQ [SEQ] | restore PATH SEQ [COPY]"
+
+// VersionCommand runs the versions command of the socket and of the command
+// line on v, paths are relative to the vault root:
+//
+//	list PATH               the versions of a file
+//	diff PATH SEQ [SEQ]     changes from a version to another or to the file
+//	restore PATH SEQ [COPY] the version in place, or as the file COPY next to it
+func VersionCommand(v Versioned, args []string) (string, error) {
+	usage := errors.New("usage: " + versionsUsage)
+	if len(args) < 2 {
+		return "", usage
+	}
+	path := args[1]
+	seqs := []uint64{}
+	for _, arg := range args[2:] {
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			break
+		}
+		seqs = append(seqs, seq)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) != 2 {
+			return "", usage
+		}
+		versions, err := v.Versions(path)
+		if err != nil {
+			return "", err
+		}
+		return FormatVersions(versions), nil
+
+	case "diff":
+		if len(seqs) == 0 || len(seqs) > 2 || len(seqs) != len(args)-2 {
+			return "", usage
+		}
+		from, err := v.ReadVersion(path, seqs[0])
+		if err != nil {
+			return "", err
+		}
+		// the current content without a second version
+		to := uint64(0)
+		if len(seqs) == 2 {
+			to = seqs[1]
+		}
+		data, err := v.ReadVersion(path, to)
+		if err != nil {
+			return "", err
+		}
+		return Diff(from, data), nil
+
+	case "restore":
+		if len(seqs) == 0 || len(args) > 4 {
+			return "", usage
+		}
+		name := ""
+		if len(args) == 4 {
+			name = args[3]
+		}
+		return "", v.RestoreVersion(path, seqs[0], name)
+	}
+	return "", usage
+}
+
+// FormatVersions is the table of versions the command line prints
+func FormatVersions(versions []securefs.Version) string {
+	if len(versions) == 0 {
+		return "no versions"
+	}
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tSIZE\tUID\tPROCESS")
+	for _, v := range versions {
+		process := v.Process
+		if process == "" {
+			process = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\n", v.Seq, v.Time.Local().Format("2006-01-02 15:04:05"), v.Size, v.Uid, process)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// lines of context around the changes of Diff
+const diffContext = 3
+
+// the longest common subsequence is found in a table of this many cells
+const maxDiffCells = 16 << 20
+
+// Diff shows the lines changed from old to new, prefixed with "-" and "+",
+// in hunks with a few lines of context
+func Diff(old, new []byte) string {
+	if bytes.Equal(old, new) {
+		return "no changes"
+	}
+	if bytes.IndexByte(old, 0) >= 0 || bytes.IndexByte(new, 0) >= 0 {
+		return fmt.Sprintf("binary content differs (%d -> %d bytes)", len(old), len(new))
+	}
+	a, b := splitLines(old), splitLines(new)
+	// the common head and tail need no table
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	if head == len(a) && head == len(b) {
+		// the same lines, one of them ends with a newline
+		return "only the newline at the end differs"
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	ma, mb := a[head:len(a)-tail], b[head:len(b)-tail]
+	if (len(ma)+1)*(len(mb)+1) > maxDiffCells {
+		return fmt.Sprintf("too many changed lines to compare (%d -> %d lines)", len(a), len(b))
+	}
+
+	// lcs[i][j] is the longest common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int32, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	ops := []line{}
+	for _, l := range a[:head] {
+		ops = append(ops, line{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, line{' ', ma[i]})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, line{'-', ma[i]})
+			i++
+		default:
+			ops = append(ops, line{'+', mb[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-tail:] {
+		ops = append(ops, line{' ', l})
+	}
+
+	// only the lines near a change are shown
+	show := make([]bool, len(ops))
+	for k, op := range ops {
+		if op.op == ' ' {
+			continue
+		}
+		for c := k - diffContext; c <= k+diffContext; c++ {
+			if c >= 0 && c < len(ops) {
+				show[c] = true
+			}
+		}
+	}
+	out := &strings.Builder{}
+	oldLine, newLine := 1, 1
+	for k, op := range ops {
+		if show[k] {
+			if k == 0 || !show[k-1] {
+				fmt.Fprintf(out, "@@ -%d +%d @@\n", oldLine, newLine)
+			}
+			fmt.Fprintf(out, "%c%s\n", op.op, op.text)
+		}
+		if op.op != '+' {
+			oldLine++
+		}
+		if op.op != '-' {
+			newLine++
+		}
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
@@ -0,0 +1,145 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"strongbox/securefs"
+)
+
+// fakeVersions records the calls VersionCommand makes, content holds the
+// versions by seq, the current content at 0
+type fakeVersions struct {
+	calls   []string
+	content map[uint64]string
+}
+
+func (f *fakeVersions) Versions(path string) ([]securefs.Version, error) {
+	f.calls = append(f.calls, "list "+path)
+	return []securefs.Version{{Seq: 1, Size: 3, Time: time.Now(), Process: "/usr/bin/vi"}}, nil
+}
+
+func (f *fakeVersions) ReadVersion(path string, seq uint64) ([]byte, error) {
+	f.calls = append(f.calls, fmt.Sprint("read ", path, " ", seq))
+	data, ok := f.content[seq]
+	if !ok {
+		return nil, errors.New("no such version")
+	}
+	return []byte(data), nil
+}
+
+func (f *fakeVersions) RestoreVersion(path string, seq uint64, name string) error {
+	f.calls = append(f.calls, fmt.Sprintf("restore %s %d %q", path, seq, name))
+	return nil
+}
+
+func TestVersionCommand(t *testing.T) {
+	calls := map[string][]string{
+		"list /a":                  {"list", "/a"},
+		"read /a 1,read /a 0":      {"diff", "/a", "1"},
+		"read /a 1,read /a 2":      {"diff", "/a", "1", "2"},
+		`restore /a 1 ""`:          {"restore", "/a", "1"},
+		`restore /a 1 "a.old"`:     {"restore", "/a", "1", "a.old"},
+		`restore /a 2 "1"`:         {"restore", "/a", "2", "1"},
+		"read /a b 2,read /a b 0":  {"diff", "/a b", "2"},
+		`restore /a b 2 "a b.old"`: {"restore", "/a b", "2", "a b.old"},
+	}
+	for call, args := range calls {
+		f := &fakeVersions{content: map[uint64]string{0: "a\nc\n", 1: "a\nb\n", 2: "a\n"}}
+		reply, err := VersionCommand(f, args)
+		if err != nil {
+			t.Fatal(args, ":", err)
+		}
+		if strings.Join(f.calls, ",") != call {
+			t.Fatal(args, "called", f.calls)
+		}
+		if args[0] == "diff" && len(args) == 3 && args[2] == "1" && reply != "@@ -1 +1 @@\n a\n-b\n+c" {
+			t.Fatal("diff reply:", reply)
+		}
+	}
+
+	reply, _ := VersionCommand(&fakeVersions{}, []string{"list", "/a"})
+	if lines := strings.Split(reply, "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "1 ") || !strings.HasSuffix(lines[1], " /usr/bin/vi") {
+		t.Fatal("list reply:", reply)
+	}
+
+	usage := "usage: " + versionsUsage
+	for _, args := range [][]string{
+		nil, {"list"}, {"list", "/a", "1"}, {"show", "/a"},
+		{"diff", "/a"}, {"diff", "/a", "x"}, {"diff", "/a", "1", "x"}, {"diff", "/a", "1", "2", "3"},
+		{"restore", "/a"}, {"restore", "/a", "x"}, {"restore", "/a", "-1"}, {"restore", "/a", "1", "b", "c"},
+	} {
+		f := &fakeVersions{}
+		if _, err := VersionCommand(f, args); err == nil || err.Error() != usage || len(f.calls) != 0 {
+			t.Fatal(args, "accepted:", err, f.calls)
+		}
+	}
+
+	// the errors of the file system come back as they are
+	f := &fakeVersions{content: map[uint64]string{0: "a\n"}}
+	if _, err := VersionCommand(f, []string{"diff", "/a", "9"}); err == nil || err.Error() != "no such version" {
+		t.Fatal("diff of a missing version:", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	numbered := func(n int, change map[int]string) string {
+		b := &strings.Builder{}
+		for i := 1; i <= n; i++ {
+			line, ok := change[i]
+			if !ok {
+				line = fmt.Sprint(i)
+			}
+			fmt.Fprintln(b, line)
+		}
+		return b.String()
+	}
+	diffs := []struct {
+		old, new, want string
+	}{
+		{"a\nb\n", "a\nb\n", "no changes"},
+		{"", "", "no changes"},
+		{"a\x00", "a\x00b", "binary content differs (2 -> 3 bytes)"},
+		{"a\nb\nc\n", "a\nB\nc\n", "@@ -1 +1 @@\n a\n-b\n+B\n c"},
+		{"a\n", "a\nb\n", "@@ -1 +1 @@\n a\n+b"},
+		{"a\nb\n", "b\n", "@@ -1 +1 @@\n-a\n b"},
+		{"", "a\n", "@@ -1 +1 @@\n+a"},
+		{"a\n", "", "@@ -1 +1 @@\n-a"},
+		// the newline at the end
+		{"a\nb", "a\nb\n", "only the newline at the end differs"},
+		{"a\nb\n", "a\nb", "only the newline at the end differs"},
+		{"a\nb", "a\nc\n", "@@ -1 +1 @@\n a\n-b\n+c"},
+		{"a\n", "a\n\n", "@@ -1 +1 @@\n a\n+"},
+		// three lines of context, hunks apart when they do not meet
+		{numbered(10, nil), numbered(10, map[int]string{6: "six"}), "@@ -3 +3 @@\n 3\n 4\n 5\n-6\n+six\n 7\n 8\n 9"},
+		{numbered(20, nil), numbered(20, map[int]string{2: "two", 18: "eighteen"}),
+			"@@ -1 +1 @@\n 1\n-2\n+two\n 3\n 4\n 5\n@@ -15 +15 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20"},
+		{numbered(10, nil), numbered(10, map[int]string{2: "two", 8: "eight"}),
+			"@@ -1 +1 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10"},
+	}
+	for _, d := range diffs {
+		if got := Diff([]byte(d.old), []byte(d.new)); got != d.want {
+			t.Fatalf("Diff(%q, %q):\n%s\nwant:\n%s", d.old, d.new, got, d.want)
+		}
+	}
+
+	// lines inserted move the line numbers of the next hunk
+	old := numbered(20, nil)
+	new := "0\n" + numbered(20, map[int]string{18: "eighteen"})
+	if got := Diff([]byte(old), []byte(new)); !strings.Contains(got, "@@ -15 +16 @@\n") {
+		t.Fatal("hunk after an insert:", got)
+	}
+
+	// the table of a large change is not built
+	a, b := &strings.Builder{}, &strings.Builder{}
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintln(a, "a", i)
+		fmt.Fprintln(b, "b", i)
+	}
+	if got := Diff([]byte(a.String()), []byte(b.String())); got != "too many changed lines to compare (5000 -> 5000 lines)" {
+		t.Fatal("large diff:", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	config "strongbox/configuration"
+	"strongbox/pinentry"
+	"strongbox/securefs"
+)
+
+const (
+	sourceTty      = "tty"
+	sourceFd       = "fd"
+	sourceEnv      = "env"
+	sourceKeyfile  = "keyfile"
+	sourceSystemd  = "systemd"
+	sourcePinentry = "pinentry"
+)
+
+const (
+	defaultPasswordEnv = "STRONGBOX_PASSWORD"
+	defaultSystemdName = "strongbox"
+	defaultPinentry    = "pinentry"
+)
+
+var credential = flag.String("credential", "", "where the password comes from: tty, pinentry[:PROGRAM], fd:N, env[:NAME], keyfile:PATH or systemd[:NAME], default vault.credential of the config or tty.")
+
+// credentialSource tells where the password or keyfile is read from, written
+// as kind[:arg] in the -credential flag and vault.credential
+type credentialSource struct {
+	kind string
+	arg  string
+	// shown by the next prompt after a wrong password
+	failure string
+}
+
+func parseCredentialSource(spec string) (credentialSource, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	s := credentialSource{kind: kind, arg: arg}
+	switch kind {
+	case "", sourceTty:
+		s.kind = sourceTty
+	case sourceFd:
+		if _, err := strconv.Atoi(arg); err != nil {
+			return s, fmt.Errorf("credential %q: invalid file descriptor", spec)
+		}
+	case sourceEnv:
+		if arg == "" {
+			s.arg = defaultPasswordEnv
+		}
+	case sourceKeyfile:
+		if arg == "" {
+			return s, fmt.Errorf("credential %q: missing keyfile path", spec)
+		}
+	case sourceSystemd:
+		if arg == "" {
+			s.arg = defaultSystemdName
+		}
+	case sourcePinentry:
+		if arg == "" {
+			s.arg = defaultPinentry
+		}
+	default:
+		return s, fmt.Errorf("unknown credential source %q", kind)
+	}
+	return s, nil
+}
+
+// currentCredentialSource returns the source given by -keyfile, -credential
+// or the config, in this order
+func currentCredentialSource() (credentialSource, error) {
+	if *keyfile != "" {
+		return credentialSource{kind: sourceKeyfile, arg: *keyfile}, nil
+	}
+	if *credential != "" {
+		return parseCredentialSource(*credential)
+	}
+	return parseCredentialSource(config.Cfg.Vault.Credential)
+}
+
+// interactive sources can be asked again after a wrong password
+func (s credentialSource) interactive() bool {
+	return s.kind == sourceTty || s.kind == sourcePinentry
+}
+
+func (s credentialSource) String() string {
+	if s.arg == "" {
+		return s.kind
+	}
+	return s.kind + ":" + s.arg
+}
+
+// load reads the credential and hands it to the configuration like a typed
+// password, the tty source prompts once. The one-time code of a vault with
+// a second factor is asked after it.
+func (s credentialSource) load() error {
+	return s.loadFor(securefs.TOTPEnabled())
+}
+
+// loadFor is load for a vault header that is not the one of the vault, otp
+// tells whether it asks for a one-time code
+func (s credentialSource) loadFor(otp bool) error {
+	if s.kind == sourceKeyfile {
+		data, err := os.ReadFile(s.arg)
+		if err != nil {
+			return err
+		}
+		config.Cfg.SetKeyfile(data)
+		config.Wipe(data)
+	} else {
+		passwd, err := s.readPassword()
+		if err != nil {
+			return err
+		}
+		defer config.Wipe(passwd)
+		if len(passwd) == 0 {
+			return fmt.Errorf("credential %s: must set password", s)
+		}
+		config.Cfg.SetPasswd(passwd)
+	}
+
+	if otp {
+		code, err := s.readOTP()
+		if err != nil {
+			return err
+		}
+		config.Cfg.SetOTP(code)
+	}
+	return nil
+}
+
+// readOTP asks for the one-time code, on the terminal unless the source is
+// pinentry: it changes every time and can not be stored
+func (s credentialSource) readOTP() (string, error) {
+	var code []byte
+	var err error
+	if s.kind == sourcePinentry {
+		code, err = pinentry.GetPin(s.arg, pinentry.Request{
+			Title:       "strongbox",
+			Description: "Enter the one-time code of the vault " + config.Cfg.Backup.Path,
+			Prompt:      "Code:",
+		})
+	} else {
+		code, err = readPassword("Enter One-time Code: ")
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(code)), nil
+}
+
+func (s credentialSource) readPassword() ([]byte, error) {
+	switch s.kind {
+	case sourceFd:
+		fd, _ := strconv.Atoi(s.arg)
+		f := os.NewFile(uintptr(fd), "credential-fd")
+		if f == nil {
+			return nil, fmt.Errorf("credential %s: bad file descriptor", s)
+		}
+		defer f.Close()
+		return readTrimmed(f)
+	case sourceEnv:
+		passwd := []byte(strings.TrimSpace(os.Getenv(s.arg)))
+		// do not leak it to the processes started from the mount point
+		os.Unsetenv(s.arg)
+		return passwd, nil
+	case sourceSystemd:
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, fmt.Errorf("credential %s: CREDENTIALS_DIRECTORY is not set", s)
+		}
+		f, err := os.Open(filepath.Join(dir, s.arg))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readTrimmed(f)
+	case sourcePinentry:
+		return pinentry.GetPin(s.arg, pinentry.Request{
+			Title:       "strongbox",
+			Description: "Enter the password or recovery key of the vault " + config.Cfg.Backup.Path,
+			Prompt:      "Password:",
+			Error:       s.failure,
+		})
+	}
+	if s.failure != "" {
+		fmt.Println(s.failure)
+	}
+	return readPassword("Enter Password: ")
+}
+
+// readNewPassword asks for the password of a new vault or key slot twice
+func (s credentialSource) readNewPassword() ([]byte, error) {
+	if s.kind != sourcePinentry {
+		return readNewPassword()
+	}
+	passwd, err := pinentry.GetPin(s.arg, pinentry.Request{
+		Title:       "strongbox",
+		Description: "Enter a new password for the vault " + config.Cfg.Backup.Path,
+		Prompt:      "Password:",
+		Repeat:      "Confirm:",
+		RepeatError: "passwords do not match",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(passwd) == 0 {
+		return nil, errors.New("must set password")
+	}
+	return passwd, nil
+}
+
+// readTrimmed reads a password the way a terminal line is read
+func readTrimmed(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	passwd := append([]byte{}, bytes.TrimSpace(data)...)
+	config.Wipe(data)
+	return passwd, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	config "strongbox/configuration"
+)
+
+func TestParseCredentialSource(t *testing.T) {
+	specs := map[string]string{
+		"":                    "tty",
+		"tty":                 "tty",
+		"fd:3":                "fd:3",
+		"env":                 "env:STRONGBOX_PASSWORD",
+		"env:VAULT_PW":        "env:VAULT_PW",
+		"keyfile:/k/key":      "keyfile:/k/key",
+		"keyfile:/k/a:b":      "keyfile:/k/a:b",
+		"systemd":             "systemd:strongbox",
+		"systemd:vault":       "systemd:vault",
+		"pinentry":            "pinentry:pinentry",
+		"pinentry:/bin/pin-x": "pinentry:/bin/pin-x",
+	}
+	for spec, want := range specs {
+		s, err := parseCredentialSource(spec)
+		if err != nil || s.String() != want {
+			t.Fatalf("parseCredentialSource(%q) = %s, %v, want %s", spec, s, err, want)
+		}
+	}
+
+	for _, spec := range []string{"fd", "fd:", "fd:x", "fd:3x", "keyfile", "keyfile:", "password", "FD:3", "tty2"} {
+		if s, err := parseCredentialSource(spec); err == nil {
+			t.Fatalf("parseCredentialSource(%q) accepted as %s", spec, s)
+		}
+	}
+}
+
+func TestReadTrimmed(t *testing.T) {
+	reads := map[string]string{
+		"secret":                         "secret",
+		"secret\n":                       "secret",
+		" secret \r\n":                   "secret",
+		"\tse cret\n\n":                  "se cret",
+		"pass\nword\n":                   "pass\nword",
+		"":                               "",
+		"\n":                             "",
+		strings.Repeat("x", 4096) + "\n": strings.Repeat("x", 4096),
+	}
+	for in, want := range reads {
+		got, err := readTrimmed(strings.NewReader(in))
+		if err != nil || string(got) != want {
+			t.Fatalf("readTrimmed(%q) = %q, %v", in, got, err)
+		}
+	}
+}
+
+// fdWith returns a file descriptor to read data from, the source closes it
+func fdWith(t *testing.T, data string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(data)
+	w.Close()
+	fd, err := syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strconv.Itoa(fd)
+}
+
+func TestCredentialSources(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "strongbox"), []byte(" secret\r\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "other"), []byte("other\n"), 0600)
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	t.Setenv("STRONGBOX_PASSWORD", "secret\n")
+	t.Setenv("VAULT_PW", "\tsecret ")
+
+	sources := []struct {
+		spec string
+		want string
+	}{
+		{"fd:" + fdWith(t, "secret\n"), "secret"},
+		{"fd:" + fdWith(t, "  secret"), "secret"},
+		{"env", "secret"},
+		{"env:VAULT_PW", "secret"},
+		{"systemd", "secret"},
+		{"systemd:other", "other"},
+	}
+	for _, source := range sources {
+		s, err := parseCredentialSource(source.spec)
+		if err != nil {
+			t.Fatal(source.spec, ":", err)
+		}
+		passwd, err := s.readPassword()
+		if err != nil || string(passwd) != source.want {
+			t.Fatalf("%s read %q, %v", source.spec, passwd, err)
+		}
+	}
+
+	// the processes started from the mount point do not get the password
+	for _, name := range []string{"STRONGBOX_PASSWORD", "VAULT_PW"} {
+		if v, ok := os.LookupEnv(name); ok {
+			t.Fatal(name, "left in the environment:", v)
+		}
+	}
+
+	bad := []string{"fd:999", "systemd:missing", "keyfile:" + filepath.Join(dir, "missing")}
+	for _, spec := range bad {
+		s, _ := parseCredentialSource(spec)
+		if err := s.loadFor(false); err == nil {
+			t.Fatal(spec, "loaded")
+		}
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if _, err := (credentialSource{kind: sourceSystemd, arg: "strongbox"}).readPassword(); err == nil {
+		t.Fatal("systemd read without CREDENTIALS_DIRECTORY")
+	}
+}
+
+func TestCredentialLoad(t *testing.T) {
+	defer config.Cfg.WipeSecrets()
+	dir := t.TempDir()
+
+	// a keyfile is used whole, it is not a password typed on a line
+	key := filepath.Join(dir, "key")
+	os.WriteFile(key, []byte("key data\n"), 0600)
+	s, _ := parseCredentialSource("keyfile:" + key)
+	if err := s.loadFor(false); err != nil {
+		t.Fatal("keyfile:", err)
+	}
+	if got := string(config.Cfg.GetKeyfile()); got != "key data\n" {
+		t.Fatalf("keyfile loaded as %q", got)
+	}
+
+	t.Setenv("STRONGBOX_PASSWORD", " secret\n")
+	s, _ = parseCredentialSource("env")
+	if err := s.loadFor(false); err != nil {
+		t.Fatal("env:", err)
+	}
+	if got := string(config.Cfg.GetPasswd()); got != "secret" {
+		t.Fatalf("password loaded as %q", got)
+	}
+
+	// read and cleared the first time, empty the next
+	if err := s.loadFor(false); err == nil || !strings.Contains(err.Error(), "must set password") {
+		t.Fatal("empty password loaded:", err)
+	}
+	t.Setenv("STRONGBOX_PASSWORD", " \n")
+	if err := s.loadFor(false); err == nil {
+		t.Fatal("blank password loaded")
+	}
+}
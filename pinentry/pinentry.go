@@ -0,0 +1,176 @@
+// Package pinentry asks for a password with a pinentry program, talking the
+// Assuan protocol on its stdin and stdout like gpg-agent does.
+package pinentry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// assuan error code of GPG_ERR_CANCELED, the user closed the dialog
+const errCodeCanceled = 83886179
+
+var ErrCanceled = errors.New("pinentry: operation canceled")
+
+// Request is the text of one password dialog, empty fields are not sent
+type Request struct {
+	Title       string
+	Description string
+	Prompt      string
+	// shown above the entry, e.g. after a wrong password
+	Error string
+	// when set the password is asked twice, labelled with Repeat
+	Repeat string
+	// shown when the repeated password does not match
+	RepeatError string
+}
+
+type Client struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// Start runs the pinentry program path and reads its greeting
+func Start(path string, args ...string) (*Client, error) {
+	cmd := exec.Command(path, args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{cmd: cmd, in: in, out: bufio.NewReader(out)}
+	if _, err := c.response(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// curses pinentries need to know the terminal, ignored by the others
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		c.option("ttyname", tty)
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		c.option("ttytype", term)
+	}
+	return c, nil
+}
+
+func (c *Client) option(name, value string) {
+	// an unknown option is not an error for the caller
+	_ = c.command("OPTION " + name + "=" + value)
+}
+
+// command sends one line and waits for OK
+func (c *Client) command(line string) error {
+	_, err := c.call(line)
+	return err
+}
+
+func (c *Client) call(line string) ([]byte, error) {
+	_, err := io.WriteString(c.in, line+"\n")
+	if err != nil {
+		return nil, err
+	}
+	return c.response()
+}
+
+// response reads up to the OK or ERR line, returning the D lines
+func (c *Client) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("pinentry: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "D "):
+			data = append(data, unescape(line[2:])...)
+		case strings.HasPrefix(line, "ERR "):
+			code, _, _ := strings.Cut(line[4:], " ")
+			if code == strconv.Itoa(errCodeCanceled) {
+				return nil, ErrCanceled
+			}
+			return nil, fmt.Errorf("pinentry: %s", line[4:])
+		}
+		// S status and # comment lines are ignored
+	}
+}
+
+func (c *Client) set(command string, value string) error {
+	if value == "" {
+		return nil
+	}
+	return c.command(command + " " + escape(value))
+}
+
+// GetPin shows the dialog of r and returns the password
+func (c *Client) GetPin(r Request) ([]byte, error) {
+	for _, s := range []struct{ command, value string }{
+		{"SETTITLE", r.Title},
+		{"SETDESC", r.Description},
+		{"SETPROMPT", r.Prompt},
+		{"SETERROR", r.Error},
+		{"SETREPEAT", r.Repeat},
+		{"SETREPEATERROR", r.RepeatError},
+	} {
+		if err := c.set(s.command, s.value); err != nil {
+			return nil, err
+		}
+	}
+	return c.call("GETPIN")
+}
+
+// Close says goodbye and waits for the program to exit
+func (c *Client) Close() error {
+	io.WriteString(c.in, "BYE\n")
+	c.in.Close()
+	return c.cmd.Wait()
+}
+
+// GetPin runs the pinentry program path for a single password
+func GetPin(path string, r Request) ([]byte, error) {
+	c, err := Start(path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.GetPin(r)
+}
+
+// escape percent-encodes what cannot be sent on an Assuan line
+func escape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func unescape(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package pinentry
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakePinentry answers GETPIN with pin, or cancels if pin is empty, and
+// records the commands it received in a log file
+const fakePinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r line; do
+	echo "$line" >> "$LOG"
+	case "$line" in
+	GETPIN)
+		if [ -z "$PIN" ]; then
+			echo "ERR 83886179 Operation cancelled <Pinentry>"
+		else
+			echo "# comment"
+			echo "D $PIN"
+			echo "OK"
+		fi ;;
+	OPTION*)
+		echo "ERR 83886254 Unknown option <Pinentry>" ;;
+	BYE)
+		echo "OK closing connection"
+		exit 0 ;;
+	*)
+		echo "OK" ;;
+	esac
+done
+`
+
+func fakeProgram(t *testing.T, pin string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pinentry")
+	log := filepath.Join(dir, "log")
+	err := os.WriteFile(path, []byte(fakePinentry), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PIN", pin)
+	t.Setenv("LOG", log)
+	t.Setenv("GPG_TTY", "/dev/pts/1")
+	return path, log
+}
+
+func TestGetPin(t *testing.T) {
+	path, log := fakeProgram(t, "pass%25word 1")
+
+	pin, err := GetPin(path, Request{Description: "Unlock vault /tmp/i.db\n100%", Prompt: "Password:"})
+	if err != nil {
+		t.Fatal("GetPin:", err)
+	}
+	if string(pin) != "pass%word 1" {
+		t.Fatalf("pin %q", pin)
+	}
+
+	data, _ := os.ReadFile(log)
+	commands := string(data)
+	for _, want := range []string{
+		"OPTION ttyname=/dev/pts/1\n",
+		"SETDESC Unlock vault /tmp/i.db%0A100%25\n",
+		"SETPROMPT Password:\n",
+		"GETPIN\n",
+		"BYE\n",
+	} {
+		if !strings.Contains(commands, want) {
+			t.Fatalf("command %q not sent:\n%s", want, commands)
+		}
+	}
+	if strings.Contains(commands, "SETERROR") {
+		t.Fatal("empty field sent")
+	}
+}
+
+func TestGetPinCanceled(t *testing.T) {
+	path, _ := fakeProgram(t, "")
+
+	_, err := GetPin(path, Request{Error: "Wrong password"})
+	if err != ErrCanceled {
+		t.Fatal("cancel:", err)
+	}
+}
+
+func TestStartMissingProgram(t *testing.T) {
+	_, err := Start(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Fatal("missing program started")
+	}
+}
@@ -0,0 +1,630 @@
+package securefs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// A backup archive holds the raw store of a vault, keys and sealed values,
+// in frames sealed again with a key derived from the master key:
+//
+//	"STRONGBOX-BACKUP\n"
+//	len | ArchiveInfo      plain, it carries the vault header to unlock with
+//	len | sealed frame     frameData | data, the frames are numbered in the seal
+//	...
+//	len | sealed frame     frameEnd | ArchiveTrailer
+//
+// The trailer holds a sha256 of the info and of the data, a truncated or
+// spliced archive is refused. A badger vault is saved with its Backup, an
+// incremental archive holds the versions written after the archive it
+// follows. A blobdir vault is saved whole, key by key.
+
+const archiveMagic = "STRONGBOX-BACKUP\n"
+
+const archiveVersion = 1
+
+// data of a frame, the last one may be shorter
+const frameSize = 1 << 20
+
+const (
+	frameData = 'd'
+	frameEnd  = 'e'
+)
+
+var backupKeyLabel = []byte("strongbox backup")
+
+// ErrBadArchive is returned for an archive that is truncated, damaged or
+// was tampered with
+var ErrBadArchive = errors.New("backup archive is damaged or was tampered with")
+
+type ArchiveInfo struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	// archive this one follows, empty for a full backup
+	Parent string `json:"parent,omitempty"`
+	// backend of the vault, it tells the format of the data
+	Backend string    `json:"backend"`
+	Created time.Time `json:"created"`
+	// first badger version of an incremental backup
+	Since  uint64          `json:"since,omitempty"`
+	Header json.RawMessage `json:"header"`
+}
+
+type ArchiveTrailer struct {
+	Frames int   `json:"frames"`
+	Bytes  int64 `json:"bytes"`
+	// last badger version in the archive, the next incremental starts after it
+	Until uint64 `json:"until,omitempty"`
+	Sum   []byte `json:"sum"`
+}
+
+type Archive struct {
+	Info    ArchiveInfo
+	Trailer ArchiveTrailer
+}
+
+func (a *Archive) String() string {
+	kind := "full"
+	if a.Info.Parent != "" {
+		kind = "incremental"
+	}
+	return fmt.Sprintf("%s %s backup %s of %s, %d bytes", kind, a.Info.Backend, a.Info.ID,
+		a.Info.Created.Local().Format("2006-01-02 15:04:05"), a.Trailer.Bytes)
+}
+
+func archiveSealer(master []byte) *sealer {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(backupKeyLabel)
+	return newSealer(mac.Sum(nil))
+}
+
+func frameID(archive string, idx int) []byte {
+	return []byte(archive + "/" + strconv.Itoa(idx))
+}
+
+func writeBlock(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBlock(r io.Reader, max int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, ErrBadArchive
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(max) {
+		return nil, ErrBadArchive
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrBadArchive
+	}
+	return data, nil
+}
+
+// frameWriter seals what is written to it in frames
+type frameWriter struct {
+	w     io.Writer
+	seal  *sealer
+	id    string
+	idx   int
+	buf   []byte
+	sum   hash.Hash
+	bytes int64
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := frameSize - len(f.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		f.buf = append(f.buf, p[:room]...)
+		p = p[room:]
+		if len(f.buf) == frameSize {
+			if err := f.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (f *frameWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	f.sum.Write(f.buf)
+	f.bytes += int64(len(f.buf))
+	err := f.frame(frameData, f.buf)
+	f.buf = f.buf[:0]
+	return err
+}
+
+func (f *frameWriter) frame(kind byte, data []byte) error {
+	sealed, err := f.seal.Seal(frameID(f.id, f.idx), append([]byte{kind}, data...))
+	if err != nil {
+		return err
+	}
+	f.idx++
+	return writeBlock(f.w, sealed)
+}
+
+// close writes the trailer, the last frame
+func (f *frameWriter) close(until uint64) (ArchiveTrailer, error) {
+	if err := f.flush(); err != nil {
+		return ArchiveTrailer{}, err
+	}
+	t := ArchiveTrailer{Frames: f.idx, Bytes: f.bytes, Until: until, Sum: f.sum.Sum(nil)}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+	return t, f.frame(frameEnd, data)
+}
+
+// frameReader reads the data of the frames up to the trailer
+type frameReader struct {
+	r       io.Reader
+	seal    *sealer
+	id      string
+	idx     int
+	buf     []byte
+	sum     hash.Hash
+	bytes   int64
+	trailer *ArchiveTrailer
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.trailer != nil {
+			return 0, io.EOF
+		}
+		sealed, err := readBlock(f.r, frameSize+64)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := f.seal.Open(frameID(f.id, f.idx), sealed)
+		if err != nil || len(plain) == 0 {
+			return 0, ErrBadArchive
+		}
+		f.idx++
+		switch plain[0] {
+		case frameData:
+			f.buf = plain[1:]
+			f.sum.Write(f.buf)
+			f.bytes += int64(len(f.buf))
+		case frameEnd:
+			t := &ArchiveTrailer{}
+			if err := json.Unmarshal(plain[1:], t); err != nil {
+				return 0, ErrBadArchive
+			}
+			f.trailer = t
+		default:
+			return 0, ErrBadArchive
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// ReadArchiveInfo reads the plain info at the start of an archive
+func ReadArchiveInfo(r io.Reader) (ArchiveInfo, error) {
+	info, _, err := readArchiveInfo(r)
+	return info, err
+}
+
+// readArchiveInfo also returns the info as written, the trailer sums it
+func readArchiveInfo(r io.Reader) (ArchiveInfo, []byte, error) {
+	info := ArchiveInfo{}
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != archiveMagic {
+		return info, nil, errors.New("not a strongbox backup archive")
+	}
+	data, err := readBlock(r, 1<<20)
+	if err != nil {
+		return info, nil, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, nil, ErrBadArchive
+	}
+	if info.Version > archiveVersion {
+		return info, nil, fmt.Errorf("backup archive version %d not supported", info.Version)
+	}
+	return info, data, nil
+}
+
+// ReadArchive checks the archive of r with the master key of its vault, load
+// gets the data as it is read, it is only trusted once ReadArchive returns
+// without error
+func ReadArchive(r io.Reader, master []byte, load func(data io.Reader) error) (*Archive, error) {
+	r = bufio.NewReader(r)
+	info, infoData, err := readArchiveInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	fr := &frameReader{r: r, seal: archiveSealer(master), id: info.ID, sum: sha256.New()}
+	fr.sum.Write(infoData)
+
+	if load != nil {
+		if err := load(fr); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.Copy(io.Discard, fr); err != nil {
+		return nil, err
+	}
+	t := fr.trailer
+	if t == nil || t.Frames != fr.idx-1 || t.Bytes != fr.bytes || !bytes.Equal(t.Sum, fr.sum.Sum(nil)) {
+		return nil, ErrBadArchive
+	}
+	// nothing may follow the trailer
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, ErrBadArchive
+	}
+	return &Archive{Info: info, Trailer: *t}, nil
+}
+
+// WriteArchive writes a backup of db to w, with parent only the changes made
+// since parent was written. The backup of a badger vault is consistent, a
+// blobdir vault is not written to while it is saved.
+func WriteArchive(db DB, w io.Writer, parent *Archive) (*Archive, error) {
+	master, err := unlockedKey()
+	if err != nil {
+		return nil, err
+	}
+	h, err := LoadVaultHeader()
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	info := ArchiveInfo{Version: archiveVersion, ID: hex.EncodeToString(id), Created: time.Now(), Header: header}
+	switch db.(type) {
+	case *BadgerDB:
+		info.Backend = BackendBadger
+	case *BlobDir:
+		info.Backend = BackendBlobDir
+	default:
+		return nil, errors.New("backup of this store is not supported")
+	}
+	if parent != nil {
+		if info.Backend != BackendBadger || parent.Info.Backend != BackendBadger {
+			return nil, errors.New("incremental backups need the badger backend")
+		}
+		info.Parent = parent.Info.ID
+		info.Since = parent.Trailer.Until + 1
+	}
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, archiveMagic); err != nil {
+		return nil, err
+	}
+	if err := writeBlock(w, infoData); err != nil {
+		return nil, err
+	}
+
+	fw := &frameWriter{w: w, seal: archiveSealer(master), id: info.ID, sum: sha256.New()}
+	fw.sum.Write(infoData)
+	var until uint64
+	switch db := db.(type) {
+	case *BadgerDB:
+		// the iterator of the stream skips the versions up to SinceTs while
+		// Backup keeps the version since, the first one after the parent
+		stream := db.badger.NewStream()
+		stream.LogPrefix = "strongbox.Backup"
+		if info.Since > 0 {
+			stream.SinceTs = info.Since - 1
+		}
+		until, err = stream.Backup(fw, info.Since)
+		// nothing changed since the parent
+		if parent != nil && until < info.Since {
+			until = parent.Trailer.Until
+		}
+	case *BlobDir:
+		err = db.snapshot(func(key []byte, value []byte) error {
+			return writeRecord(fw, key, value)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := fw.close(until)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{Info: info, Trailer: t}, nil
+}
+
+// BackupFile writes the backup of db to the new file out, an incremental one
+// after the archive parent unless it is empty
+func BackupFile(db DB, out string, parent string) (*Archive, error) {
+	var prev *Archive
+	if parent != "" {
+		master, err := unlockedKey()
+		if err != nil {
+			return nil, err
+		}
+		prev, err = readArchiveFile(parent, master, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", parent, err)
+		}
+	}
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	a, err := WriteArchive(db, w, prev)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	log.Info("backup: ", a, " written to ", out)
+	return a, nil
+}
+
+func readArchiveFile(path string, master []byte, load func(data io.Reader) error) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadArchive(f, master, load)
+}
+
+// writeRecord writes a key and its value to the data of a blobdir archive
+func writeRecord(w io.Writer, key []byte, value []byte) error {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(key)+len(value))
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	buf = append(buf, value...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRecordBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, ErrBadArchive
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// loadRecords sets the records of data in s, a batch at a time
+func loadRecords(s Storage, data io.Reader) error {
+	r := bufio.NewReader(data)
+	for done := false; !done; {
+		keys, values, size := [][]byte{}, [][]byte{}, 0
+		for size < 16<<20 {
+			key, err := readRecordBytes(r)
+			if err == io.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			value, err := readRecordBytes(r)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			values = append(values, value)
+			size += len(key) + len(value)
+		}
+		err := s.Batch(func(b Batch) error {
+			for i := range keys {
+				if err := b.Set(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyArchives checks that paths are a full backup followed by its
+// incrementals, unlocks the vault header of the last one with c and
+// verifies every archive. It returns the header and the master key.
+func VerifyArchives(paths []string, c Credentials) ([]*Archive, *VaultHeader, []byte, error) {
+	if len(paths) == 0 {
+		return nil, nil, nil, errors.New("no backup archive given")
+	}
+	infos := []ArchiveInfo{}
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		info, err := ReadArchiveInfo(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if i == 0 && info.Parent != "" {
+			return nil, nil, nil, fmt.Errorf("%s is an incremental backup, start with a full one", path)
+		}
+		if i > 0 && info.Parent != infos[i-1].ID {
+			return nil, nil, nil, fmt.Errorf("%s does not follow %s", path, paths[i-1])
+		}
+		infos = append(infos, info)
+	}
+
+	h := &VaultHeader{}
+	if err := json.Unmarshal(infos[len(infos)-1].Header, h); err != nil {
+		return nil, nil, nil, ErrBadArchive
+	}
+	if h.Version > vaultHeaderVersion {
+		return nil, nil, nil, fmt.Errorf("vault header version %d not supported", h.Version)
+	}
+	master, _, err := h.Unlock(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	archives := []*Archive{}
+	for i, path := range paths {
+		a, err := readArchiveFile(path, master, nil)
+		if err != nil {
+			cfg.Wipe(master)
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if i > 0 && a.Info.Since != archives[i-1].Trailer.Until+1 {
+			cfg.Wipe(master)
+			return nil, nil, nil, fmt.Errorf("%s does not start where %s ends", path, paths[i-1])
+		}
+		archives = append(archives, a)
+	}
+	return archives, h, master, nil
+}
+
+// ArchiveTOTPEnabled reports whether the vault header of the last of paths,
+// the one a restore unlocks, asks for a one-time code
+func ArchiveTOTPEnabled(paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	f, err := os.Open(paths[len(paths)-1])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := ReadArchiveInfo(bufio.NewReader(f))
+	if err != nil {
+		return false
+	}
+	h := &VaultHeader{}
+	return json.Unmarshal(info.Header, h) == nil && h.TOTP != nil
+}
+
+// RestoreArchives rebuilds the vault of the configuration, which must not
+// exist, from a full backup and its incrementals. Every archive is verified
+// before anything is written, the vault header is the one of the last
+// archive, so c are the credentials valid when it was written.
+func RestoreArchives(paths []string, c Credentials) ([]*Archive, error) {
+	path := cfg.Cfg.Backup.Path
+	if cfg.Cfg.Backup.Memory || path == "" {
+		return nil, errors.New("restore needs backup.path")
+	}
+	if VaultExists() {
+		return nil, fmt.Errorf("vault %s already exists", path)
+	}
+	if entries, err := os.ReadDir(path); err == nil && len(entries) != 0 {
+		return nil, fmt.Errorf("%s is not empty", path)
+	}
+
+	archives, h, master, err := VerifyArchives(paths, c)
+	if err != nil {
+		return nil, err
+	}
+	defer cfg.Wipe(master)
+	backend := cfg.Cfg.Backup.Backend
+	if backend == "" {
+		backend = BackendBadger
+	}
+	if archives[0].Info.Backend != backend {
+		return nil, fmt.Errorf("backup of a %s vault, backup.backend is %s", archives[0].Info.Backend, backend)
+	}
+
+	err = restoreStore(paths, h, master, backend)
+	if err != nil {
+		// nothing is left half restored
+		os.RemoveAll(path)
+		os.Remove(VaultHeaderPath())
+		return nil, err
+	}
+	log.Info("restore: vault ", path, " rebuilt from ", len(paths), " archives")
+	return archives, nil
+}
+
+func restoreStore(paths []string, h *VaultHeader, master []byte, backend string) error {
+	h.FailedAttempts = 0
+	if err := h.Save(); err != nil {
+		return err
+	}
+
+	if backend == BackendBlobDir {
+		b, err := OpenBlobDir(cfg.Cfg.Backup.Path, master)
+		if err != nil {
+			return err
+		}
+		defer b.Close()
+		_, err = readArchiveFile(paths[0], master, func(data io.Reader) error {
+			return loadRecords(b, data)
+		})
+		return err
+	}
+
+	opt := badgerOptions(master)
+	defer cfg.Wipe(opt.EncryptionKey)
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, path := range paths {
+		_, err := readArchiveFile(path, master, func(data io.Reader) error {
+			return db.Load(data, 256)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package securefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestBackupRestore(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Backup.Backend = BackendBadger
+	dir := t.TempDir()
+	ctx := testContext()
+
+	db := &BadgerDB{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB:", err)
+	}
+	root, _ := NewRootBoxInode(db.Sealed())
+	fs.NewNodeFS(root, &fs.Options{})
+	write := func(name string, data string) {
+		_, fh, _, _ := root.Create(ctx, name, 0, 0644, &fuse.EntryOut{})
+		fh.(*BoxFile).Write(ctx, []byte(data), 0)
+		fh.(*BoxFile).Release(ctx)
+	}
+
+	write("a", "first file")
+	full := filepath.Join(dir, "full.sbk")
+	if _, err := BackupFile(db, full, ""); err != nil {
+		t.Fatal("BackupFile:", err)
+	}
+	write("b", "second file")
+	inc := filepath.Join(dir, "inc1.sbk")
+	if _, err := BackupFile(db, inc, full); err != nil {
+		t.Fatal("BackupFile incremental:", err)
+	}
+	root.Unlink(ctx, "a")
+	inc2 := filepath.Join(dir, "inc2.sbk")
+	if _, err := BackupFile(db, inc2, inc); err != nil {
+		t.Fatal("BackupFile incremental:", err)
+	}
+	db.Close()
+
+	creds := Credentials{Passwd: []byte("test")}
+	if _, err := RestoreArchives([]string{full, inc2}, creds); err == nil {
+		t.Fatal("restored a broken chain")
+	}
+	if _, err := RestoreArchives([]string{full, inc, inc2}, creds); err == nil {
+		t.Fatal("restored over the vault")
+	}
+
+	// a flipped byte or a missing end is found before anything is written
+	data, _ := os.ReadFile(inc)
+	for name, damaged := range map[string][]byte{
+		"tampered":  append(append(append([]byte{}, data[:len(data)-40]...), data[len(data)-40]^1), data[len(data)-39:]...),
+		"truncated": data[:len(data)-10],
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, damaged, 0600)
+		if _, _, _, err := VerifyArchives([]string{full, path}, creds); err == nil {
+			t.Fatal("verified a ", name, " archive")
+		}
+	}
+
+	cfg.Cfg.Backup.Path = filepath.Join(t.TempDir(), "restored.db")
+	if _, err := RestoreArchives([]string{full, inc, inc2}, Credentials{Passwd: []byte("wrong")}); err != ErrWrongPassword {
+		t.Fatal("restore with a wrong password:", err)
+	}
+	if _, err := os.Stat(VaultHeaderPath()); err == nil {
+		t.Fatal("header left by a failed restore")
+	}
+	archives, err := RestoreArchives([]string{full, inc, inc2}, creds)
+	if err != nil || len(archives) != 3 {
+		t.Fatal("RestoreArchives:", err)
+	}
+
+	db = &BadgerDB{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB restored:", err)
+	}
+	defer db.Close()
+	root, _ = NewRootBoxInode(db.Sealed())
+	if _, err := root.GetChildNode("a"); err == nil {
+		t.Fatal("deleted file restored")
+	}
+	b, err := root.GetChildNode("b")
+	if err != nil || fileContent(db.Sealed(), b) != "second file" {
+		t.Fatal("restored file:", err)
+	}
+}
+
+func TestBackupBlobDir(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Backup.Backend = BackendBlobDir
+	cfg.Cfg.Backup.Path = t.TempDir()
+	dir := t.TempDir()
+
+	db := &BlobDir{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB:", err)
+	}
+	root, _ := NewRootBoxInode(db.Sealed())
+	fs.NewNodeFS(root, &fs.Options{})
+	root.Mkdir(testContext(), "dir", 0755, &fuse.EntryOut{})
+	full := filepath.Join(dir, "full.sbk")
+	if _, err := BackupFile(db, full, ""); err != nil {
+		t.Fatal("BackupFile:", err)
+	}
+	if _, err := BackupFile(db, filepath.Join(dir, "inc.sbk"), full); err == nil {
+		t.Fatal("incremental backup of a blobdir")
+	}
+	db.Close()
+
+	cfg.Cfg.Backup.Path = filepath.Join(t.TempDir(), "restored")
+	if _, err := RestoreArchives([]string{full}, Credentials{Passwd: []byte("test")}); err != nil {
+		t.Fatal("RestoreArchives:", err)
+	}
+	db = &BlobDir{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB restored:", err)
+	}
+	defer db.Close()
+	root, _ = NewRootBoxInode(db.Sealed())
+	if _, err := root.GetChildNode("dir"); err != nil {
+		t.Fatal("restored tree:", err)
+	}
+}
+
+func TestRestoreTOTP(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Backup.Backend = BackendBadger
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	c := Credentials{Passwd: []byte("test")}
+	if err := Unlock(c); err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	secret, _ := NewTOTPSecret()
+	code := func() string { return totpCode(secret, totpCounter(now, totpPeriod), totpDigits) }
+	if err := EnableVaultTOTP(c, secret, code()); err != nil {
+		t.Fatal("EnableVaultTOTP:", err)
+	}
+	db := &BadgerDB{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB:", err)
+	}
+	full := filepath.Join(t.TempDir(), "full.sbk")
+	if _, err := BackupFile(db, full, ""); err != nil {
+		t.Fatal("BackupFile:", err)
+	}
+	db.Close()
+
+	// the second factor is the one of the archive, there is no vault to ask
+	cfg.Cfg.Backup.Path = filepath.Join(t.TempDir(), "restored.db")
+	if TOTPEnabled() || !ArchiveTOTPEnabled([]string{full}) {
+		t.Fatal("one-time code of the archive not found")
+	}
+	now = now.Add(time.Hour)
+	if _, err := RestoreArchives([]string{full}, c); err != ErrWrongPassword {
+		t.Fatal("restored without code:", err)
+	}
+	if _, _, _, err := VerifyArchives([]string{full}, Credentials{Passwd: c.Passwd, OTP: code()}); err != nil {
+		t.Fatal("VerifyArchives with code:", err)
+	}
+	if _, err := RestoreArchives([]string{full}, Credentials{Passwd: c.Passwd, OTP: code()}); err != nil {
+		t.Fatal("RestoreArchives with code:", err)
+	}
+
+	// the restored vault keeps the second factor and the used code
+	if !TOTPEnabled() {
+		t.Fatal("restored vault without one-time codes")
+	}
+	if err := Unlock(Credentials{Passwd: c.Passwd, OTP: code()}); err != ErrWrongPassword {
+		t.Fatal("code of the restore replayed:", err)
+	}
+	now = now.Add(time.Hour)
+	if err := Unlock(Credentials{Passwd: c.Passwd, OTP: code()}); err != nil {
+		t.Fatal("Unlock restored:", err)
+	}
+}
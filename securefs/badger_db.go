@@ -1,23 +1,21 @@
 package securefs
 
 import (
+	"errors"
+
 	cfg "strongbox/configuration"
 
 	badger "github.com/dgraph-io/badger/v3"
 	log "github.com/sirupsen/logrus"
 )
 
-var badgerInstance *BadgerDB
-
+// BadgerDB is the Storage of a vault, the values are sealed by the Storage
+// returned from Sealed
 type BadgerDB struct {
 	badger *badger.DB
-}
-
-func GetDBInstance() *BadgerDB {
-	if badgerInstance == nil {
-		badgerInstance = &BadgerDB{}
-	}
-	return badgerInstance
+	sealed Storage
+	// the copy of the key badger encrypts with
+	key []byte
 }
 
 func (db *BadgerDB) DebugKeys() {
@@ -47,10 +45,34 @@ func (db *BadgerDB) DebugKeys() {
 	log.Debugf("total length=%d", length)
 }
 
-func (db *BadgerDB) InitDB() error {
-	skey := cfg.Cfg.GetCryptKey()
+// Iterate calls fn for every key starting with prefix, key and value are
+// only valid during the call
+func (db *BadgerDB) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	txn := db.badger.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		err := item.Value(func(v []byte) error {
+			return fn(item.Key(), v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// badgerOptions opens the database of the configuration with a copy of key,
+// badger keeps it open, the caller wipes opt.EncryptionKey after Close
+func badgerOptions(key []byte) badger.Options {
 	opt := badger.DefaultOptions("")
-	opt.EncryptionKey = skey
+	opt.EncryptionKey = append([]byte{}, key...)
 	opt.BlockCacheSize = 100 << 10
 	opt.IndexCacheSize = 100 << 20
 	opt.ValueLogFileSize = 1024 * 1024 * 100
@@ -63,11 +85,43 @@ func (db *BadgerDB) InitDB() error {
 		opt.Dir = cfg.Cfg.Backup.Path
 		opt.ValueDir = cfg.Cfg.Backup.Path
 	}
+	return opt
+}
+
+func (db *BadgerDB) InitDB() error {
+	skey, err := unlockedKey()
+	if err != nil {
+		log.Error("unlock vault error:", err)
+		return err
+	}
 
-	var err error
+	opt := badgerOptions(skey)
 	db.badger, err = badger.Open(opt)
 	if err != nil {
+		cfg.Wipe(opt.EncryptionKey)
+	}
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		// only headers without verifier get here
 		log.Error("open db error:", err)
+		cfg.Cfg.SetCryptKey(nil)
+		return ErrWrongPassword
+	}
+	if err != nil {
+		log.Error("open db error:", err)
+		return err
+	}
+	db.key = opt.EncryptionKey
+
+	err = upgradeVaultHeader(skey, CurrentCredentials())
+	if err != nil {
+		log.Error("upgrade vault header error:", err)
+	}
+
+	db.sealed = NewSealedStorage(db, skey)
+	err = upgradeLayout(db, db.sealed)
+	if err != nil {
+		log.Error("upgrade store layout error:", err)
+		db.Close()
 		return err
 	}
 
@@ -77,42 +131,56 @@ func (db *BadgerDB) InitDB() error {
 	return nil
 }
 
+// Sealed is the storage of the file system, once InitDB succeeded
+func (db *BadgerDB) Sealed() Storage {
+	return db.sealed
+}
+
 func (db *BadgerDB) Set(key []byte, value []byte) error {
-	txn := db.badger.NewTransaction(true)
-	defer txn.Discard()
+	return db.Batch(func(b Batch) error {
+		return b.Set(key, value)
+	})
+}
 
-	err := txn.Set(key, value)
-	if err != nil {
-		log.Error("badger set error:", err)
-		return err
-	}
+func (db *BadgerDB) Del(key []byte) error {
+	return db.Batch(func(b Batch) error {
+		return b.Del(key)
+	})
+}
 
-	if err := txn.Commit(); err != nil {
-		log.Error("badger commit error:", err)
-	}
+type badgerBatch struct {
+	txn *badger.Txn
+}
 
-	return nil
+func (b badgerBatch) Set(key []byte, value []byte) error {
+	return b.txn.Set(key, value)
 }
 
-func (db *BadgerDB) Del(key []byte) error {
+func (b badgerBatch) Del(key []byte) error {
+	return b.txn.Delete(key)
+}
+
+// Batch runs fn in one badger transaction
+func (db *BadgerDB) Batch(fn func(b Batch) error) error {
 	txn := db.badger.NewTransaction(true)
 	defer txn.Discard()
 
-	err := txn.Delete(key)
+	err := fn(badgerBatch{txn})
 	if err != nil {
-		log.Error("badger set error:", err)
+		log.Error("badger write error:", err)
 		return err
 	}
 
 	if err := txn.Commit(); err != nil {
 		log.Error("badger commit error:", err)
+		return err
 	}
-
 	return nil
 }
 
 func (db *BadgerDB) Get(key []byte) ([]byte, error) {
 	txn := db.badger.NewTransaction(false)
+	defer txn.Discard()
 	item, err := txn.Get(key)
 	if err == badger.ErrKeyNotFound {
 		return []byte(""), nil
@@ -136,4 +204,6 @@ func (db *BadgerDB) Get(key []byte) ([]byte, error) {
 
 func (db *BadgerDB) Close() {
 	db.badger.Close()
+	wipeSealed(db.sealed)
+	cfg.Wipe(db.key)
 }
@@ -0,0 +1,482 @@
+package securefs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var blobNameLabel = []byte("strongbox blobdir names")
+
+var blobMetaLabel = []byte("strongbox blobdir objects")
+
+const journalName = "journal"
+
+// BlobDir keeps the store as plain files that file sync tools can mirror:
+//
+//	vault.header
+//	objects/ab/cdef...  one sealed object per key: the key and its blob
+//	blobs/12/3456...    the values, named by their sha256
+//
+// Object names are a keyed hash of the key, so the tree leaks no path. The
+// values are sealed by the storage above, see Sealed. Every file is written
+// to a temporary file and renamed, a batch writes the new blobs before the
+// objects that refer to them and removes old blobs last. A batch is first
+// written to the sealed journal file and replayed when the directory is
+// opened, so it is applied whole even after a crash, or before the next
+// batch when it failed to apply.
+type BlobDir struct {
+	dir    string
+	names  []byte
+	objs   *sealer
+	sealed Storage
+
+	mu sync.RWMutex
+	// key -> blob, loaded from the objects when opened
+	index map[string]string
+	refs  map[string]int
+	// the batch in the journal failed to apply
+	pending bool
+}
+
+type blobObject struct {
+	Key  []byte `json:"key"`
+	Blob string `json:"blob"`
+}
+
+type blobWrite struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Del   bool   `json:"del,omitempty"`
+}
+
+// OpenBlobDir loads the objects of dir, master must be the key of the vault
+func OpenBlobDir(dir string, master []byte) (*BlobDir, error) {
+	b := &BlobDir{dir: dir}
+	err := b.open(master)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BlobDir) open(master []byte) error {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(blobNameLabel)
+	b.names = mac.Sum(nil)
+	mac = hmac.New(sha256.New, master)
+	mac.Write(blobMetaLabel)
+	b.objs = newSealer(mac.Sum(nil))
+	b.index = make(map[string]string)
+	b.refs = make(map[string]int)
+
+	for _, sub := range []string{"objects", "blobs"} {
+		if err := os.MkdirAll(filepath.Join(b.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	err := filepath.WalkDir(filepath.Join(b.dir, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if _, err := hex.DecodeString(d.Name()); err != nil || len(d.Name()) != 2*sha256.Size-2 {
+			// temporary files, conflict copies of the sync tool
+			log.Warn("blobdir: ignore ", path)
+			return nil
+		}
+		name := filepath.Base(filepath.Dir(path)) + d.Name()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plain, err := b.objs.Open([]byte(name), data)
+		if err != nil {
+			log.Error("blobdir: object ", name, " tampered with")
+			return err
+		}
+		obj := blobObject{}
+		if err := json.Unmarshal(plain, &obj); err != nil {
+			return err
+		}
+		b.index[string(obj.Key)] = obj.Blob
+		b.refs[obj.Blob]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.replay()
+}
+
+// replay applies the batch left in the journal by a crash or by a failed
+// apply
+func (b *BlobDir) replay() error {
+	path := filepath.Join(b.dir, journalName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := b.objs.Open([]byte(journalName), data)
+	if err != nil {
+		log.Error("blobdir: journal tampered with")
+		return err
+	}
+	writes := []blobWrite{}
+	if err := json.Unmarshal(plain, &writes); err != nil {
+		return err
+	}
+	log.Warn("blobdir: replay ", len(writes), " writes of an interrupted batch")
+	if err := b.apply(writes); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (b *BlobDir) InitDB() error {
+	skey, err := unlockedKey()
+	if err != nil {
+		log.Error("unlock vault error:", err)
+		return err
+	}
+	b.dir = cfg.Cfg.Backup.Path
+	err = b.open(skey)
+	if err != nil {
+		log.Error("open blobdir error:", err)
+		return err
+	}
+
+	b.sealed = NewSealedStorage(b, skey)
+	err = upgradeLayout(b, b.sealed)
+	if err != nil {
+		log.Error("upgrade store layout error:", err)
+		return err
+	}
+	return nil
+}
+
+func (b *BlobDir) Sealed() Storage {
+	return b.sealed
+}
+
+func (b *BlobDir) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.index = nil
+	b.refs = nil
+	cfg.Wipe(b.names)
+	if b.objs != nil {
+		b.objs.wipe()
+	}
+	wipeSealed(b.sealed)
+}
+
+// objectName is where the object of key is stored, the first two characters
+// are the directory
+func (b *BlobDir) objectName(key []byte) string {
+	mac := hmac.New(sha256.New, b.names)
+	mac.Write(key)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func blobName(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *BlobDir) path(sub string, name string) string {
+	return filepath.Join(b.dir, sub, name[:2], name[2:])
+}
+
+func (b *BlobDir) Get(key []byte) ([]byte, error) {
+	b.mu.RLock()
+	blob, ok := b.index[string(key)]
+	b.mu.RUnlock()
+	if !ok {
+		return []byte(""), nil
+	}
+	return b.readBlob(blob)
+}
+
+func (b *BlobDir) readBlob(blob string) ([]byte, error) {
+	data, err := os.ReadFile(b.path("blobs", blob))
+	if err != nil {
+		log.Error("blobdir: read blob error:", err)
+		return nil, err
+	}
+	if blobName(data) != blob {
+		log.Error("blobdir: blob ", blob, " does not match its name")
+		return nil, ErrTampered
+	}
+	return data, nil
+}
+
+func (b *BlobDir) Set(key []byte, value []byte) error {
+	return b.Batch(func(w Batch) error {
+		return w.Set(key, value)
+	})
+}
+
+func (b *BlobDir) Del(key []byte) error {
+	return b.Batch(func(w Batch) error {
+		return w.Del(key)
+	})
+}
+
+type blobBatch struct {
+	writes []blobWrite
+}
+
+func (w *blobBatch) Set(key []byte, value []byte) error {
+	w.writes = append(w.writes, blobWrite{Key: append([]byte{}, key...), Value: append([]byte{}, value...)})
+	return nil
+}
+
+func (w *blobBatch) Del(key []byte) error {
+	w.writes = append(w.writes, blobWrite{Key: append([]byte{}, key...), Del: true})
+	return nil
+}
+
+func (b *BlobDir) Batch(fn func(w Batch) error) error {
+	w := &blobBatch{}
+	if err := fn(w); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.index == nil {
+		return errors.New("blobdir closed")
+	}
+	// a batch that failed half way is applied before the next one takes its
+	// journal
+	if b.pending {
+		if err := b.replay(); err != nil {
+			return err
+		}
+		b.pending = false
+	}
+
+	journal := filepath.Join(b.dir, journalName)
+	plain, err := json.Marshal(w.writes)
+	if err != nil {
+		return err
+	}
+	data, err := b.objs.Seal([]byte(journalName), plain)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(journal, data); err != nil {
+		log.Error("blobdir: write journal error:", err)
+		return err
+	}
+	if err := b.apply(w.writes); err != nil {
+		b.pending = true
+		return err
+	}
+	return os.Remove(journal)
+}
+
+// apply writes the blobs and objects of writes, b.mu must be held
+func (b *BlobDir) apply(writes []blobWrite) error {
+	// the values first, an object never refers to a missing blob
+	for _, wr := range writes {
+		if wr.Del {
+			continue
+		}
+		blob := blobName(wr.Value)
+		if b.refs[blob] > 0 {
+			continue
+		}
+		if err := writeFileAtomic(b.path("blobs", blob), wr.Value); err != nil {
+			log.Error("blobdir: write blob error:", err)
+			return err
+		}
+	}
+
+	// the index and the counts change once every object is written, a batch
+	// that fails half way leaves readers the store as it was before it
+	index := map[string]string{} // the blob of a key written, "" if deleted
+	delta := map[string]int{}
+	for _, wr := range writes {
+		key := string(wr.Key)
+		name := b.objectName(wr.Key)
+		old, had := b.index[key]
+		if blob, ok := index[key]; ok {
+			old, had = blob, blob != ""
+		}
+		if wr.Del {
+			if !had {
+				continue
+			}
+			err := os.Remove(b.path("objects", name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			index[key] = ""
+		} else {
+			blob := blobName(wr.Value)
+			plain, err := json.Marshal(blobObject{Key: wr.Key, Blob: blob})
+			if err != nil {
+				return err
+			}
+			data, err := b.objs.Seal([]byte(name), plain)
+			if err != nil {
+				return err
+			}
+			if err := writeFileAtomic(b.path("objects", name), data); err != nil {
+				log.Error("blobdir: write object error:", err)
+				return err
+			}
+			index[key] = blob
+			delta[blob]++
+		}
+		if had {
+			delta[old]--
+		}
+	}
+
+	for key, blob := range index {
+		if blob == "" {
+			delete(b.index, key)
+		} else {
+			b.index[key] = blob
+		}
+	}
+	for blob, d := range delta {
+		b.refs[blob] += d
+		if b.refs[blob] > 0 {
+			continue
+		}
+		delete(b.refs, blob)
+		if err := os.Remove(b.path("blobs", blob)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("blobdir: remove blob error:", err)
+		}
+	}
+	return nil
+}
+
+func (b *BlobDir) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	b.mu.RLock()
+	keys := []string{}
+	for k := range b.index {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.mu.RLock()
+		blob, ok := b.index[k]
+		b.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		value, err := b.readBlob(blob)
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(k), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot calls fn for every key and value, no batch is applied meanwhile
+func (b *BlobDir) snapshot(fn func(key []byte, value []byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0, len(b.index))
+	for k := range b.index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value, err := b.readBlob(b.index[k])
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(k), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn for every key and its value like snapshot, a blob that is
+// missing or damaged is passed as the error of its key instead of stopping
+func (b *BlobDir) scan(fn func(key []byte, value []byte, err error) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0, len(b.index))
+	for k := range b.index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value, err := b.readBlob(b.index[k])
+		if err := fn([]byte(k), value, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leakedBlobs returns the blobs no object refers to, left by a batch that
+// was interrupted before it removed them
+func (b *BlobDir) leakedBlobs() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	leaked := []string{}
+	err := filepath.WalkDir(filepath.Join(b.dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := filepath.Base(filepath.Dir(path)) + d.Name()
+		if _, err := hex.DecodeString(name); err != nil || len(name) != 2*sha256.Size {
+			return nil
+		}
+		if b.refs[name] <= 0 {
+			leaked = append(leaked, name)
+		}
+		return nil
+	})
+	return leaked, err
+}
+
+// removeBlob deletes the blob unless an object refers to it
+func (b *BlobDir) removeBlob(blob string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.refs[blob] > 0 {
+		return nil
+	}
+	err := os.Remove(b.path("blobs", blob))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
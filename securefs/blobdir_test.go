@@ -0,0 +1,184 @@
+package securefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	cfg "strongbox/configuration"
+)
+
+func TestBlobDirStorage(t *testing.T) {
+	dir := t.TempDir()
+	master := bytes.Repeat([]byte{1}, 32)
+	b, err := OpenBlobDir(dir, master)
+	if err != nil {
+		t.Fatal("OpenBlobDir:", err)
+	}
+	testStorage(t, b)
+
+	b.Set([]byte("/a.txt"), []byte("content"))
+	b.Set([]byte("/b.txt"), []byte("content"))
+	b.Set([]byte("/c.txt"), []byte("old"))
+	b.Set([]byte("/c.txt"), []byte("new"))
+	b.Close()
+
+	// left behind by a sync tool
+	objects, _ := filepath.Glob(filepath.Join(dir, "objects", "*", "*"))
+	os.WriteFile(objects[0]+".sync-conflict-20231001", []byte("junk"), 0600)
+
+	b, err = OpenBlobDir(dir, master)
+	if err != nil {
+		t.Fatal("reopen:", err)
+	}
+	for key, want := range map[string]string{"/a.txt": "content", "/b.txt": "content", "/c.txt": "new"} {
+		if v, err := b.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatal("Get after reopen:", key, err, string(v))
+		}
+	}
+	blobs, _ := filepath.Glob(filepath.Join(dir, "blobs", "*", "*"))
+	if len(blobs) != 2 {
+		t.Fatal("blobs shared or left behind:", len(blobs))
+	}
+	for _, f := range append(objects, blobs...) {
+		data, _ := os.ReadFile(f)
+		if bytes.Contains(data, []byte(".txt")) {
+			t.Fatal("key readable in ", f)
+		}
+	}
+
+	b.Del([]byte("/a.txt"))
+	if v, _ := b.Get([]byte("/b.txt")); string(v) != "content" {
+		t.Fatal("shared blob removed")
+	}
+
+	if _, err := OpenBlobDir(dir, bytes.Repeat([]byte{2}, 32)); err == nil {
+		t.Fatal("opened with another key")
+	}
+}
+
+func TestBlobDirVault(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Backup.Backend = BackendBlobDir
+	cfg.Cfg.Backup.Path = t.TempDir()
+
+	db := &BlobDir{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB:", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Cfg.Backup.Path, "vault.header")); err != nil {
+		t.Fatal("header not in the directory:", err)
+	}
+	root, err := NewRootBoxInode(db.Sealed())
+	if err != nil {
+		t.Fatal("NewRootBoxInode:", err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	if _, errno := root.Mkdir(testContext(), "a.txt", 0755, &fuse.EntryOut{}); errno != fs.OK {
+		t.Fatal("Mkdir:", errno)
+	}
+	db.Close()
+
+	db = &BlobDir{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB again:", err)
+	}
+	root, _ = NewRootBoxInode(db.Sealed())
+	if _, err := root.GetChildNode("a.txt"); err != nil {
+		t.Fatal("tree not kept:", err)
+	}
+}
+
+func TestBlobDirJournal(t *testing.T) {
+	dir := t.TempDir()
+	master := bytes.Repeat([]byte{1}, 32)
+	b, _ := OpenBlobDir(dir, master)
+	b.Set([]byte("a"), []byte("old"))
+	b.Set([]byte("b"), []byte("gone"))
+
+	// a batch interrupted after its journal was written
+	plain, _ := json.Marshal([]blobWrite{{Key: []byte("a"), Value: []byte("new")}, {Key: []byte("b"), Del: true}})
+	data, _ := b.objs.Seal([]byte(journalName), plain)
+	writeFileAtomic(filepath.Join(dir, journalName), data)
+	b.Close()
+
+	b, err := OpenBlobDir(dir, master)
+	if err != nil {
+		t.Fatal("reopen:", err)
+	}
+	if v, _ := b.Get([]byte("a")); string(v) != "new" {
+		t.Fatal("journal not replayed:", string(v))
+	}
+	if v, _ := b.Get([]byte("b")); len(v) != 0 {
+		t.Fatal("delete not replayed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalName)); !os.IsNotExist(err) {
+		t.Fatal("journal left:", err)
+	}
+
+	os.WriteFile(filepath.Join(dir, journalName), []byte("junk"), 0600)
+	if _, err := OpenBlobDir(dir, master); err == nil {
+		t.Fatal("tampered journal replayed")
+	}
+}
+
+func TestBlobDirFailedBatch(t *testing.T) {
+	dir := t.TempDir()
+	b, _ := OpenBlobDir(dir, bytes.Repeat([]byte{1}, 32))
+	defer b.Close()
+
+	// the object of "b" can not be written, "a" is written before it
+	keys := []string{"a"}
+	for i := 0; len(keys) == 1; i++ {
+		key := fmt.Sprint("b", i)
+		if b.objectName([]byte(key))[:2] != b.objectName([]byte("a"))[:2] {
+			keys = append(keys, key)
+		}
+	}
+	b.Set([]byte(keys[0]), []byte("zero"))
+	blocked := filepath.Join(dir, "objects", b.objectName([]byte(keys[1]))[:2])
+	os.WriteFile(blocked, []byte("not a directory"), 0600)
+	err := b.Batch(func(w Batch) error {
+		w.Set([]byte(keys[0]), []byte("first"))
+		return w.Set([]byte(keys[1]), []byte("second"))
+	})
+	if err == nil {
+		t.Fatal("batch applied with a blocked object")
+	}
+
+	// readers see none of the failed batch until it is applied
+	if v, err := b.Get([]byte(keys[0])); err != nil || string(v) != "zero" {
+		t.Fatal("Get after the failed batch:", string(v), err)
+	}
+	seen := map[string]string{}
+	err = b.Iterate(nil, func(key []byte, value []byte) error {
+		seen[string(key)] = string(value)
+		return nil
+	})
+	if err != nil || len(seen) != 1 || seen[keys[0]] != "zero" {
+		t.Fatal("Iterate after the failed batch:", seen, err)
+	}
+
+	// the next batch does not take the journal of the failed one
+	if err := b.Set([]byte("c"), []byte("third")); err == nil {
+		t.Fatal("batch accepted before the failed one was applied")
+	}
+	os.Remove(blocked)
+	if err := b.Set([]byte("c"), []byte("third")); err != nil {
+		t.Fatal("Set after the failed batch:", err)
+	}
+	for key, want := range map[string]string{keys[0]: "first", keys[1]: "second", "c": "third"} {
+		if v, _ := b.Get([]byte(key)); string(v) != want {
+			t.Fatal("after the failed batch: ", key, " ", string(v))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalName)); !os.IsNotExist(err) {
+		t.Fatal("journal left:", err)
+	}
+}
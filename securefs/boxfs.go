@@ -1,11 +1,12 @@
 package securefs
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,10 +18,19 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func NewRootBoxInode() (*BoxInode, error) {
-	n := &BoxInode{}
+// NewRootBoxInode loads the file system kept in store, or starts an empty
+// one
+func NewRootBoxInode(store Storage) (*BoxInode, error) {
+	n := &BoxInode{storage: store, cache: newWriteback()}
 
-	err := LoadRootDirFromDB(n)
+	hashKey, err := chunkHashKey(store)
+	if err != nil {
+		return nil, err
+	}
+	n.hashKey = hashKey
+	n.gear = newGearTable(hashKey)
+
+	err = LoadRootDirFromDB(n)
 	if err == os.ErrNotExist {
 		var out fuse.EntryOut
 
@@ -37,7 +47,13 @@ func NewRootBoxInode() (*BoxInode, error) {
 
 		n.Name = ""
 		n.root = n
+		n.loaded = true
 		n.Attr.SetFromFuse(&out.Attr)
+		n.Attr.Ino = rootIno
+		n.nextIno = rootIno + 1
+		if err := n.UpdateToDB(); err != nil {
+			return nil, err
+		}
 		return n, nil
 	}
 	if err != nil {
@@ -71,7 +87,6 @@ func (a *BoxAttr) GetToFuse(out *fuse.Attr) {
 	out.Gid = a.Gid
 }
 func (a *BoxAttr) SetFromFuse(out *fuse.Attr) {
-	out.Ino = a.Ino
 	a.Size = out.Size
 	a.Atime = time.Unix(int64(out.Atime), int64(out.Atimensec))
 	a.Mtime = time.Unix(int64(out.Mtime), int64(out.Mtimensec))
@@ -107,12 +122,36 @@ func (a *BoxAttr) SetFromAttrIn(in *fuse.SetAttrIn) {
 type BoxInode struct {
 	fs.Inode
 
-	Name         string               `json:"name"`
-	Attr         BoxAttr              `json:"attr"`
+	Name string  `json:"name"`
+	Attr BoxAttr `json:"attr"`
+	// the loaded entries of a directory, the whole tree in the "-" key of
+	// layouts before 3
 	ChildrenNode map[string]*BoxInode `json:"children"`
 
 	parent *BoxInode
 	root   *BoxInode
+	// ChildrenNode holds every entry of the store, see loadChildren
+	childMu sync.Mutex
+	loaded  bool
+	// set on the root only, see store, allocIno, writeback and contentBatch
+	storage Storage
+	inoMu   sync.Mutex
+	nextIno uint64
+	cache   *writeback
+	refMu   sync.Mutex
+	hashKey []byte
+	gear    *gearTable
+	notify  bool
+
+	// written chunks not stored yet, see flush
+	cacheMu sync.Mutex
+	dirty   map[uint64][]byte
+	// deleted from the store, the dirty data is dropped
+	removed bool
+}
+
+func (n *BoxInode) store() Storage {
+	return n.root.storage
 }
 
 func (n *BoxInode) AddChildNode(name string) *BoxInode {
@@ -125,6 +164,8 @@ func (n *BoxInode) AddChildNode(name string) *BoxInode {
 		c.Name = name
 		c.parent = n
 		c.root = n.root
+		// a new node has no entries in the store
+		c.loaded = true
 		n.ChildrenNode[name] = c
 	}
 
@@ -147,6 +188,9 @@ func (n *BoxInode) DelChildNode(name string) {
 }
 
 func (n *BoxInode) GetChildNode(name string) (*BoxInode, error) {
+	if err := n.loadChildren(); err != nil {
+		return nil, err
+	}
 	if n.ChildrenNode == nil {
 		return nil, os.ErrNotExist
 	}
@@ -157,54 +201,40 @@ func (n *BoxInode) GetChildNode(name string) (*BoxInode, error) {
 	return c, nil
 }
 
+// UpdateToDB saves the attributes of n, the entries are written by the
+// operations that change them
 func (n *BoxInode) UpdateToDB() error {
-	data, err := json.Marshal(n.root)
-
-	// log.Println("TEST_UP:", string(data))
-	err = GetDBInstance().Set([]byte("-"), data)
+	err := n.saveAttr(n.store())
 	if err != nil {
-		log.Error("root dir set error:", err)
+		log.Error("inode ", n.Attr.Ino, " set error:", err)
 		return err
 	}
 
 	return nil
 }
 
-func setParentNode(b *BoxInode, parent *BoxInode, root *BoxInode) {
-	b.root = root
-	b.parent = parent
-
-	if b.ChildrenNode != nil {
-		for _, v := range b.ChildrenNode {
-			setParentNode(v, b, root)
-		}
-	}
-}
-
+// LoadRootDirFromDB loads the root b from its storage, the directories are
+// loaded when they are looked up
 func LoadRootDirFromDB(b *BoxInode) error {
-	data, err := GetDBInstance().Get([]byte("-"))
+	data, err := b.storage.Get(inodeKey(rootIno))
 	if err != nil {
-		log.Error("root dir set error:", err)
+		log.Error("root dir get error:", err)
 		return err
 	}
 	if len(data) == 0 {
 		return os.ErrNotExist
 	}
 
-	// log.Println("LOAD_DB:", string(data))
-	err = json.Unmarshal(data, b)
+	err = json.Unmarshal(data, &b.Attr)
 	if err != nil {
 		return err
 	}
 
-	// log.Println("LOAD_DB: children=", len(b.ChildrenNode))
-
+	b.Name = ""
 	b.root = b
-	if b.ChildrenNode != nil {
-		for _, v := range b.ChildrenNode {
-			// log.Println("LOAD_DB_ITEM:", v)
-			setParentNode(v, b, b)
-		}
+	err = b.loadNextIno()
+	if err != nil {
+		return err
 	}
 
 	log.Println("Load: root dir load success")
@@ -246,29 +276,43 @@ func (n *BoxInode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAtt
 		return fs.ToErrno(os.ErrPermission)
 	}
 
-	n.Attr.SetFromAttrIn(in)
+	sz, truncate := in.GetSize()
+	truncate = truncate && !n.isDir()
+	// the content truncated away is kept when the file has no version yet
+	if truncate && sz < n.Attr.Size {
+		if err := n.recordVersion("", n.Attr.Uid, true); err != nil {
+			log.Error("Setattr: version error:", err)
+			return storeErrno(err)
+		}
+	}
 
-	if sz, ok := in.GetSize(); ok {
-		if fh, fok := f.(*BoxFile); fok {
+	n.cacheMu.Lock()
+	defer n.cacheMu.Unlock()
+	prev := n.Attr
+	n.Attr.SetFromAttrIn(in)
+	err := n.contentBatch(func(b Batch, refs *chunkRefs) error {
+		if truncate {
 			log.Warn("Truncate:", n.Path(), "|", sz)
-			if sz <= uint64(len(fh.data)) {
-				fh.data = fh.data[0:sz]
-			} else {
-				pading := bytes.Repeat([]byte{byte(0)}, int(sz)-len(fh.data))
-				fh.data = append(fh.data, pading...)
-			}
-			fserr := fh.Fsync(ctx, 0)
-			if fserr != fs.OK {
-				return fserr
+			if err := truncateChunks(n.store(), b, refs, n.Attr.Ino, prev.Size, sz); err != nil {
+				return err
 			}
 		}
+		return n.saveAttr(b)
+	})
+	if err != nil {
+		log.Error("Setattr: save error:", err)
+		n.Attr = prev
+		return storeErrno(err)
+	}
+	if truncate {
+		n.truncateDirty(sz)
+		if err := n.reclaimChunks((sz+chunkSize-1)/chunkSize, prev.Size); err != nil {
+			log.Error("Setattr: reclaim error:", err)
+			return storeErrno(err)
+		}
 	}
 
 	n.Attr.GetToFuse(&out.Attr)
-	err := n.UpdateToDB()
-	if err != nil {
-		return fs.ToErrno(os.ErrInvalid)
-	}
 	return fs.OK
 }
 
@@ -285,8 +329,18 @@ func (n *BoxInode) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 		return nil, fs.ToErrno(os.ErrInvalid)
 	}
 
+	if _, err := n.GetChildNode(name); err == nil {
+		return nil, syscall.EEXIST
+	}
+	ino, err := n.allocIno()
+	if err != nil {
+		log.Error("Mkdir: alloc inode error:", err)
+		return nil, storeErrno(err)
+	}
+
 	box := n.AddChildNode(name)
 	box.Name = name
+	box.Attr.Ino = ino
 	box.Attr.Atime = time.Now()
 	box.Attr.Ctime = time.Now()
 	box.Attr.Mtime = time.Now()
@@ -301,9 +355,11 @@ func (n *BoxInode) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 
 	box.Attr.GetToFuse(&out.Attr)
 
-	err := n.UpdateToDB()
+	err = n.store().Batch(box.saveEntry)
 	if err != nil {
-		return nil, fs.ToErrno(os.ErrInvalid)
+		log.Error("Mkdir: save error:", err)
+		n.DelChildNode(name)
+		return nil, storeErrno(err)
 	}
 	return b, fs.OK
 }
@@ -315,12 +371,35 @@ func (n *BoxInode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return fs.ToErrno(os.ErrPermission)
 	}
 
-	n.DelChildNode(name)
+	node, err := n.GetChildNode(name)
+	if err == os.ErrNotExist {
+		return fs.ToErrno(err)
+	}
+	if err != nil {
+		return syscall.EIO
+	}
+	if err := node.loadChildren(); err != nil {
+		return syscall.EIO
+	}
+	if len(node.ChildrenNode) != 0 {
+		return syscall.ENOTEMPTY
+	}
 
-	err := n.UpdateToDB()
+	if trashEnabled() {
+		err = n.trash(node, callerExe(ctx), callerUid(ctx))
+	} else {
+		err = n.store().Batch(func(b Batch) error {
+			if err := b.Del(direntKey(n.Attr.Ino, name)); err != nil {
+				return err
+			}
+			return b.Del(inodeKey(node.Attr.Ino))
+		})
+	}
 	if err != nil {
-		return fs.ToErrno(os.ErrInvalid)
+		log.Error("Rmdir: delete error:", err)
+		return storeErrno(err)
 	}
+	n.DelChildNode(name)
 	return fs.OK
 }
 func (n *BoxInode) Unlink(ctx context.Context, name string) syscall.Errno {
@@ -330,19 +409,22 @@ func (n *BoxInode) Unlink(ctx context.Context, name string) syscall.Errno {
 		return fs.ToErrno(os.ErrPermission)
 	}
 
-	// TODO:Transaction
 	node, err := n.GetChildNode(name)
 	if err != nil {
 		return fs.ToErrno(os.ErrNotExist)
 	}
-	n.DelChildNode(name)
-	err = n.UpdateToDB()
-	if err != nil {
-		return fs.ToErrno(os.ErrInvalid)
+	if trashEnabled() {
+		err = n.trash(node, callerExe(ctx), callerUid(ctx))
+	} else {
+		err = node.remove(func(b Batch, refs *chunkRefs) error {
+			return b.Del(direntKey(n.Attr.Ino, name))
+		})
 	}
-	if !node.IsDir() {
-		GetDBInstance().Del([]byte(node.Path()))
+	if err != nil {
+		log.Error("Unlink: delete error:", err)
+		return storeErrno(err)
 	}
+	n.DelChildNode(name)
 	return fs.OK
 }
 
@@ -358,45 +440,72 @@ func (n *BoxInode) Rename(ctx context.Context, name string, newParent fs.InodeEm
 		log.Error("Rename: src not exist ", err)
 		return fs.ToErrno(err)
 	}
-	oldPath := c.Path()
-
-	n.DelChildNode(name)
-	c.Name = newName
 	node, ok := newParent.(*BoxInode)
 	if !ok {
 		log.Error("Rename: InodeEmbedder error")
 		return fs.ToErrno(os.ErrInvalid)
 	}
-	node.AddExistChildNode(newName, c)
-	newPath := c.Path()
+	replaced, err := node.GetChildNode(newName)
+	if err != nil && err != os.ErrNotExist {
+		return syscall.EIO
+	}
+	if replaced == c {
+		return fs.OK
+	}
+	if replaced != nil && replaced.isDir() {
+		if err := replaced.loadChildren(); err != nil {
+			return syscall.EIO
+		}
+		if len(replaced.ChildrenNode) != 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	oldPath := c.Path()
 
-	if !c.IsDir() {
-		log.Debug("RenameFile:", oldPath, "->", newPath)
-		data, err := GetDBInstance().Get([]byte(oldPath))
-		if err != nil {
-			log.Error("rename file not exist:", err)
-			return fs.ToErrno(err)
+	// the content and the children are keyed by inode, only the entries change
+	move := func(b Batch) error {
+		if err := b.Del(direntKey(n.Attr.Ino, name)); err != nil {
+			return err
 		}
-		err = GetDBInstance().Del([]byte(oldPath))
-		if err != nil {
-			log.Error("rename del file failed:", err)
-			return fs.ToErrno(err)
+		return b.Set(direntKey(node.Attr.Ino, newName), []byte(strconv.FormatUint(c.Attr.Ino, 10)))
+	}
+	replace := func(b Batch, refs *chunkRefs) error {
+		if err := move(b); err != nil {
+			return err
 		}
-		err = GetDBInstance().Set([]byte(newPath), data)
-		if err != nil {
-			log.Error("rename set file failed:", err)
-			return fs.ToErrno(err)
+		if replaced.isDir() || c.isDir() {
+			return nil
 		}
-	} else {
-		log.Debug("RenameDir:", oldPath, "->", newPath)
+		return c.adoptVersions(b, refs, replaced)
+	}
+	switch {
+	case replaced != nil && trashEnabled():
+		// the replaced entry goes to the trash like a deleted one, its
+		// entry is dropped before the moved one takes its name
+		if err = replaced.flush(); err == nil {
+			err = n.contentBatch(func(b Batch, refs *chunkRefs) error {
+				if err := node.trashIn(b, replaced, callerExe(ctx), callerUid(ctx)); err != nil {
+					return err
+				}
+				return replace(b, refs)
+			})
+		}
+	case replaced != nil:
+		err = replaced.remove(replace)
+	default:
+		err = n.store().Batch(move)
 	}
-
-	err = n.UpdateToDB()
 	if err != nil {
-		return fs.ToErrno(os.ErrInvalid)
+		log.Error("Rename: save error:", err)
+		return storeErrno(err)
 	}
 
-	return fs.ToErrno(err)
+	n.DelChildNode(name)
+	c.Name = newName
+	node.AddExistChildNode(newName, c)
+	log.Debug("Rename:", oldPath, "->", c.Path())
+
+	return fs.OK
 }
 
 func (n *BoxInode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
@@ -406,35 +515,35 @@ func (n *BoxInode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 		return nil, fs.ToErrno(os.ErrPermission)
 	}
 
-	if n.ChildrenNode == nil {
-		log.Warn("Lookup: children not exist ", n.Path(), "/", name)
-		return nil, fs.ToErrno(os.ErrNotExist)
+	v, err := n.GetChildNode(name)
+	if err == os.ErrNotExist {
+		log.Warn("Lookup: children not found ", n.Path(), "/", name)
+		return nil, fs.ToErrno(err)
 	}
-
-	for k, v := range n.ChildrenNode {
-		if k == name {
-			sa := fs.StableAttr{}
-			sa.Mode = v.Attr.Mode
-			sa.Ino = v.Attr.Ino
-			v.Attr.GetToFuse(&out.Attr)
-
-			// log.Debug("Lookup Attr()", v.Path(), ",", out.Attr.Mode, "|", v.Attr.Mode)
-			b := n.Inode.NewInode(ctx, v, sa)
-			return b, fs.OK
-		}
+	if err != nil {
+		return nil, syscall.EIO
 	}
 
-	log.Warn("Lookup: children not found ", n.Path(), "/", name)
-	return nil, fs.ToErrno(os.ErrNotExist)
+	sa := fs.StableAttr{}
+	sa.Mode = v.Attr.Mode
+	sa.Ino = v.Attr.Ino
+	v.Attr.GetToFuse(&out.Attr)
+
+	b := n.Inode.NewInode(ctx, v, sa)
+	return b, fs.OK
 }
 
 func (n *BoxInode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	log.Debug("Readdir:", n.Path(), "|", len(n.ChildrenNode))
+	log.Debug("Readdir:", n.Path())
 
 	if !CheckAllowProcess("Readdir", ctx) {
 		return &DirEntryReader{}, fs.OK
 	}
 
+	if err := n.loadChildren(); err != nil {
+		return nil, syscall.EIO
+	}
+
 	r := DirEntryReader{}
 	for _, v := range n.ChildrenNode {
 		dir := fuse.DirEntry{}
@@ -465,7 +574,20 @@ func (n *BoxInode) Create(ctx context.Context, name string, flags uint32, mode u
 		return nil, nil, 0, fs.ToErrno(os.ErrInvalid)
 	}
 
-	box := n.AddChildNode(name)
+	box, err := n.GetChildNode(name)
+	if err != nil && err != os.ErrNotExist {
+		return nil, nil, 0, syscall.EIO
+	}
+	created := err != nil
+	if created {
+		ino, err := n.allocIno()
+		if err != nil {
+			log.Error("Create: alloc inode error:", err)
+			return nil, nil, 0, storeErrno(err)
+		}
+		box = n.AddChildNode(name)
+		box.Attr.Ino = ino
+	}
 	box.Name = name
 	box.Attr.Atime = time.Now()
 	box.Attr.Ctime = time.Now()
@@ -483,11 +605,14 @@ func (n *BoxInode) Create(ctx context.Context, name string, flags uint32, mode u
 
 	bfile := &BoxFile{}
 	bfile.inode = box
-	bfile.data = []byte("")
 
-	err := n.UpdateToDB()
+	err = n.store().Batch(box.saveEntry)
 	if err != nil {
-		return nil, nil, 0, fs.ToErrno(os.ErrInvalid)
+		log.Error("Create: save error:", err)
+		if created {
+			n.DelChildNode(name)
+		}
+		return nil, nil, 0, storeErrno(err)
 	}
 	return b, bfile, 0, fs.OK
 }
@@ -500,22 +625,17 @@ func (n *BoxInode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fu
 		return 0, 0, fs.ToErrno(os.ErrPermission)
 	}
 
+	// the content is read chunk by chunk, see BoxFile.Read
 	bfile := &BoxFile{}
 	bfile.inode = n
 
-	data, err := GetDBInstance().Get([]byte(n.Path()))
-	if err != nil {
-		log.Error("Read DB failed:", err)
-		return 0, 0, fs.ToErrno(os.ErrInvalid)
-	}
-
-	bfile.data = data
-
 	return bfile, flags, fs.OK
 }
 
 func (n *BoxInode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
-	// TODO: Write cache, persist when sync
+	if err := n.flush(); err != nil {
+		return syscall.EIO
+	}
 	return fs.OK
 }
 
@@ -523,72 +643,151 @@ func (n *BoxInode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) sys
 
 type BoxFile struct {
 	inode *BoxInode
-	data  []byte
+
+	// set by the first write, a version is recorded on Release
+	mu      sync.Mutex
+	written bool
+	process string
+	uid     uint32
 }
 
 func (f *BoxFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	// TODO: read cache
-	log.Debug("Read:", f.inode.Path(), "|", off, "|", len(dest), "|", len(f.data))
+	n := f.inode
+	log.Debug("Read:", n.Path(), "|", off, "|", len(dest), "|", n.Attr.Size)
 
 	if !CheckAllowProcess("Read", ctx) {
 		return nil, fs.ToErrno(os.ErrPermission)
 	}
 
-	end := 0
-	data := []byte("")
-	if off < int64(len(f.data)) {
-		end = int(off) + len(dest)
-		if end > len(f.data) {
-			end = len(f.data)
-		}
-		data = f.data[off:end]
+	size := n.Attr.Size
+	if off < 0 || uint64(off) >= size {
+		return &readResult{[]byte("")}, fs.OK
+	}
+	end := uint64(off) + uint64(len(dest))
+	if end > size {
+		end = size
+	}
+	data := dest[:end-uint64(off)]
+
+	n.cacheMu.Lock()
+	err := readChunks(n.store(), n.dirty, n.Attr.Ino, uint64(off), data)
+	n.cacheMu.Unlock()
+	if err == ErrTampered {
+		log.Error("Read: content of ", n.Path(), " was tampered with")
+		return nil, syscall.EIO
+	}
+	if err != nil {
+		log.Error("Read DB failed:", err)
+		return nil, storeErrno(err)
 	}
 
-	// log.Debug("Read()", len(data))
 	res := &readResult{data}
 
 	return res, fs.OK
 }
 
+// Fsync stores the written data of the file, so do Flush on every close
+// and Release on the last one
 func (f *BoxFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
-	err := GetDBInstance().Set([]byte(f.inode.Path()), f.data)
-	if err != nil {
-		log.Error("Write DB failed:", err)
-		return fs.ToErrno(os.ErrInvalid)
+	if err := f.inode.flush(); err != nil {
+		return syscall.EIO
+	}
+	return fs.OK
+}
+
+func (f *BoxFile) Flush(ctx context.Context) syscall.Errno {
+	return f.Fsync(ctx, 0)
+}
+
+func (f *BoxFile) Release(ctx context.Context) syscall.Errno {
+	if errno := f.Fsync(ctx, 0); errno != fs.OK {
+		return errno
+	}
+	f.mu.Lock()
+	written := f.written
+	f.mu.Unlock()
+	if written {
+		if err := f.inode.recordVersion(f.process, f.uid, false); err != nil {
+			log.Error("Release: version of ", f.inode.Path(), " error:", err)
+		}
 	}
 	return fs.OK
 }
 
+// wrote notes the writer of the handle, the first time it keeps the content
+// written before versions were recorded, see recordVersion
+func (f *BoxFile) wrote(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.written || !versionsEnabled() {
+		return nil
+	}
+	n := f.inode
+	if err := n.recordVersion("", n.Attr.Uid, true); err != nil {
+		return err
+	}
+	f.written = true
+	f.process = callerExe(ctx)
+	f.uid = callerUid(ctx)
+	return nil
+}
+
+// Write keeps the chunks it touches in memory until they are flushed, see
+// writeback
 func (f *BoxFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	log.Debug("Write:", f.inode.Path(), "|", off, "|", len(data), "|", len(f.data))
+	n := f.inode
+	log.Debug("Write:", n.Path(), "|", off, "|", len(data), "|", n.Attr.Size)
 
 	if !CheckAllowProcess("Write", ctx) {
 		return 0, fs.ToErrno(os.ErrPermission)
 	}
 
-	if int64(len(f.data)) < off {
-		log.Errorf("Write: plain(%d) < off(%d)", len(f.data), off)
+	if off < 0 {
 		return 0, fs.ToErrno(os.ErrInvalid)
 	}
+	if len(data) == 0 {
+		return 0, fs.OK
+	}
+	if err := f.wrote(ctx); err != nil {
+		log.Error("Write: version of ", n.Path(), " error:", err)
+		return 0, storeErrno(err)
+	}
 
-	if off+int64(len(data)) > int64(len(f.data)) {
-		f.data = append(f.data[0:off], data...)
-	} else {
-		for i := 0; i < len(data); i++ {
-			f.data[off+int64(i)] = data[i]
+	n.cacheMu.Lock()
+	if n.dirty == nil {
+		n.dirty = make(map[uint64][]byte)
+	}
+	added, err := writeChunks(n.store(), n.dirty, n.Attr.Ino, uint64(off), data)
+	if err == nil {
+		n.root.cache.dirtied(n, added)
+		if end := uint64(off) + uint64(len(data)); end > n.Attr.Size {
+			n.Attr.Size = end
 		}
 	}
-
-	fserr := f.Fsync(ctx, 0)
-	if fserr != fs.OK {
-		return 0, fserr
+	dirty := len(n.dirty)
+	n.cacheMu.Unlock()
+	if err == ErrTampered {
+		log.Error("Write: content of ", n.Path(), " was tampered with")
+		return 0, syscall.EIO
 	}
-
-	// TODO:Transaction
-	f.inode.Attr.Size = uint64(len(f.data))
-	err := f.inode.UpdateToDB()
 	if err != nil {
-		return uint32(len(data)), fs.ToErrno(err)
+		log.Error("Read DB failed:", err)
+		return 0, storeErrno(err)
+	}
+
+	// a file stores its data once it fills a batch, the writer waits for
+	// the data past the limit to be stored
+	if dirty >= flushBatch {
+		if err := n.flush(); err != nil {
+			return 0, syscall.EIO
+		}
+	}
+	if n.root.cache.over() {
+		if err := n.root.cache.flushAll(); err != nil {
+			return 0, syscall.EIO
+		}
 	}
+
 	return uint32(len(data)), fs.OK
 }
@@ -0,0 +1,253 @@
+package securefs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDirtyLimit = 64
+	defaultWriteback  = 5
+)
+
+// writeback tracks the files of a root with written data that is not stored
+// yet. The data is stored on flush, fsync and close of the file, every
+// backup.writeback seconds, and by the writer that goes past
+// backup.dirtyLimit.
+type writeback struct {
+	mu    sync.Mutex
+	nodes map[*BoxInode]struct{}
+	// bytes of the dirty chunks
+	bytes int64
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newWriteback() *writeback {
+	return &writeback{nodes: make(map[*BoxInode]struct{})}
+}
+
+func dirtyLimit() int64 {
+	limit := int64(cfg.Cfg.Backup.DirtyLimit)
+	if limit <= 0 {
+		limit = defaultDirtyLimit
+	}
+	return limit << 20
+}
+
+func writebackInterval() time.Duration {
+	sec := cfg.Cfg.Backup.Writeback
+	if sec <= 0 {
+		sec = defaultWriteback
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// dirtied records that n has more chunks to store
+func (w *writeback) dirtied(n *BoxInode, chunks int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nodes[n] = struct{}{}
+	w.bytes += int64(chunks) * chunkSize
+}
+
+// cleaned records that chunks of n were stored or dropped, the cacheMu of n
+// must be held
+func (w *writeback) cleaned(n *BoxInode, chunks int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(n.dirty) == 0 {
+		delete(w.nodes, n)
+	}
+	w.bytes -= int64(chunks) * chunkSize
+}
+
+func (w *writeback) over() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytes > dirtyLimit()
+}
+
+// flushAll stores the data of every dirty file, it returns the first error
+func (w *writeback) flushAll() error {
+	w.mu.Lock()
+	nodes := make([]*BoxInode, 0, len(w.nodes))
+	for n := range w.nodes {
+		nodes = append(nodes, n)
+	}
+	w.mu.Unlock()
+
+	var first error
+	for _, n := range nodes {
+		if err := n.flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// StartWriteback stores the written data of the root r in the background
+// until Close, and purges the expired entries of the trash
+func (r *BoxInode) StartWriteback() {
+	w := r.cache
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(writebackInterval())
+		defer ticker.Stop()
+		// the trash is expired along, see expireTrash
+		r.expireTrash()
+		expiry := time.NewTicker(time.Hour)
+		defer expiry.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := w.flushAll(); err != nil {
+					log.Error("writeback error:", err)
+				}
+			case <-expiry.C:
+				r.expireTrash()
+			}
+		}
+	}(w.stop, w.done)
+}
+
+// Close stops the writeback of the root r and stores what is left
+func (r *BoxInode) Close() error {
+	w := r.cache
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return w.flushAll()
+}
+
+// Sync stores the data of every dirty file of the root r
+func (r *BoxInode) Sync() error {
+	return r.cache.flushAll()
+}
+
+// flushBatch is the number of dirty chunks a batch stores, with their pieces
+// and counts it stays well below the transaction size of badger
+var flushBatch = 64
+
+// flush stores the dirty chunks of n in batches of flushBatch chunks and
+// the attributes with the last one, a crash in between leaves chunks past
+// the stored size that fsck drops
+func (n *BoxInode) flush() error {
+	n.cacheMu.Lock()
+	defer n.cacheMu.Unlock()
+	if len(n.dirty) == 0 {
+		return nil
+	}
+	if n.removed {
+		n.dropDirty()
+		return nil
+	}
+
+	idxs := make([]uint64, 0, len(n.dirty))
+	for idx := range n.dirty {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	for len(idxs) > 0 {
+		batch := idxs
+		if len(batch) > flushBatch {
+			batch = idxs[:flushBatch]
+		}
+		last := len(batch) == len(idxs)
+		err := n.contentBatch(func(b Batch, refs *chunkRefs) error {
+			for _, idx := range batch {
+				if err := refs.set(b, n.Attr.Ino, idx, n.dirty[idx]); err != nil {
+					return err
+				}
+			}
+			if !last {
+				return nil
+			}
+			return n.saveAttr(b)
+		})
+		if err != nil {
+			log.Error("flush ", n.Path(), " error:", err)
+			return err
+		}
+		for _, idx := range batch {
+			delete(n.dirty, idx)
+		}
+		n.root.cache.cleaned(n, len(batch))
+		idxs = idxs[len(batch):]
+	}
+	return nil
+}
+
+// dropDirty forgets the dirty chunks of n, cacheMu must be held
+func (n *BoxInode) dropDirty() {
+	chunks := len(n.dirty)
+	n.dirty = nil
+	n.root.cache.cleaned(n, chunks)
+}
+
+// truncateDirty drops the dirty data of n after size, cacheMu must be held
+func (n *BoxInode) truncateDirty(size uint64) {
+	dropped := 0
+	for idx, chunk := range n.dirty {
+		start := idx * chunkSize
+		if start >= size {
+			delete(n.dirty, idx)
+			dropped++
+		} else if start+uint64(len(chunk)) > size {
+			n.dirty[idx] = chunk[:size-start]
+		}
+	}
+	if dropped != 0 {
+		n.root.cache.cleaned(n, dropped)
+	}
+}
+
+// remove deletes the inode record, the content and the versions of n along
+// with the writes of del, the dirty data of n is dropped and never stored
+func (n *BoxInode) remove(del func(b Batch, refs *chunkRefs) error) error {
+	n.cacheMu.Lock()
+	defer n.cacheMu.Unlock()
+
+	// the inode goes first, its content is reclaimed after it in batches
+	// that do not grow with the file, fsck drops what a crash leaves
+	err := n.contentBatch(func(b Batch, refs *chunkRefs) error {
+		if err := del(b, refs); err != nil {
+			return err
+		}
+		return b.Del(inodeKey(n.Attr.Ino))
+	})
+	if err != nil {
+		return err
+	}
+	n.removed = true
+	n.dropDirty()
+
+	if err := n.reclaimChunks(0, n.Attr.Size); err != nil {
+		log.Error("remove ", n.Attr.Ino, ": reclaim chunks error:", err)
+		return nil
+	}
+	if err := n.reclaimVersions(); err != nil {
+		log.Error("remove ", n.Attr.Ino, ": reclaim versions error:", err)
+	}
+	return nil
+}
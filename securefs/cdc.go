@@ -0,0 +1,88 @@
+package securefs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// A chunk is stored as pieces cut where its content says, FastCDC with a
+// gear hash: an insertion moves the cuts after it along with the content,
+// so the pieces that follow keep their hash and are stored once. The chunks
+// stay at fixed offsets for random access, content shifted across a chunk
+// boundary shares all but the first and the last piece of each chunk.
+const (
+	minPiece = 2 << 10
+	avgPiece = 8 << 10
+	maxPiece = 32 << 10
+)
+
+// masks of the normalized cut around avgPiece, a cut before it needs more
+// zero bits than one after it
+const (
+	maskHard = 0x0003590703530000
+	maskEasy = 0x0000d90003530000
+)
+
+var gearLabel = []byte("strongbox gear")
+
+// gearTable maps each byte to the value the rolling hash adds for it
+type gearTable [256]uint64
+
+// newGearTable derives the gear from the hash key of the store, the cuts
+// and the sizes of the pieces tell no more about the content than the
+// hashes do
+func newGearTable(key []byte) *gearTable {
+	g := &gearTable{}
+	for i := 0; i < len(g); i += sha256.Size / 8 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(gearLabel)
+		mac.Write([]byte{byte(i)})
+		sum := mac.Sum(nil)
+		for j := 0; j < sha256.Size/8; j++ {
+			g[i+j] = binary.BigEndian.Uint64(sum[8*j:])
+		}
+	}
+	return g
+}
+
+// cut returns the length of the first piece of data
+func (g *gearTable) cut(data []byte) int {
+	n := len(data)
+	if n <= minPiece {
+		return n
+	}
+	if n > maxPiece {
+		n = maxPiece
+	}
+	normal := avgPiece
+	if normal > n {
+		normal = n
+	}
+	fp := uint64(0)
+	i := minPiece
+	for ; i < normal; i++ {
+		fp = fp<<1 + g[data[i]]
+		if fp&maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + g[data[i]]
+		if fp&maskEasy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// split cuts chunk in pieces
+func (g *gearTable) split(chunk []byte) [][]byte {
+	pieces := [][]byte{}
+	for len(chunk) > 0 {
+		n := g.cut(chunk)
+		pieces = append(pieces, chunk[:n])
+		chunk = chunk[n:]
+	}
+	return pieces
+}
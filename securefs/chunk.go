@@ -0,0 +1,133 @@
+package securefs
+
+import (
+	"strconv"
+)
+
+// the content of a file is split in chunks of chunkSize bytes, stored once
+// per content, see dedup.go. A chunk may be shorter than chunkSize or
+// missing, the rest up to the size of the file reads as zeros.
+const chunkSize = 64 * 1024
+
+// chunkPrefix is the start of the chunks of the file ino
+func chunkPrefix(ino uint64) []byte {
+	return []byte("c/" + strconv.FormatUint(ino, 10) + "/")
+}
+
+func chunkKey(ino uint64, idx uint64) []byte {
+	return append(chunkPrefix(ino), strconv.FormatUint(idx, 10)...)
+}
+
+// readChunks fills dest with the content of the file ino from off, dest must
+// end before the end of the file. The chunks in dirty are newer than the
+// ones of store.
+func readChunks(store Storage, dirty map[uint64][]byte, ino uint64, off uint64, dest []byte) error {
+	for i := range dest {
+		dest[i] = 0
+	}
+	for pos := uint64(0); pos < uint64(len(dest)); {
+		idx := (off + pos) / chunkSize
+		start := (off + pos) % chunkSize
+		n := chunkSize - start
+		if n > uint64(len(dest))-pos {
+			n = uint64(len(dest)) - pos
+		}
+
+		chunk, ok := dirty[idx]
+		if !ok {
+			var err error
+			chunk, err = readChunk(store, ino, idx)
+			if err != nil {
+				return err
+			}
+		}
+		if start < uint64(len(chunk)) {
+			copy(dest[pos:pos+n], chunk[start:])
+		}
+		pos += n
+	}
+	return nil
+}
+
+// writeChunks writes data at off of the file ino into the chunks of dirty,
+// only the chunks data touches are read. It returns how many chunks were
+// added to dirty, dirty is left as it was on error.
+func writeChunks(store Storage, dirty map[uint64][]byte, ino uint64, off uint64, data []byte) (int, error) {
+	end := off + uint64(len(data))
+	chunks := map[uint64][]byte{}
+	for idx := off / chunkSize; idx*chunkSize < end; idx++ {
+		if chunk, ok := dirty[idx]; ok {
+			chunks[idx] = chunk
+			continue
+		}
+		// a chunk that is overwritten whole is not read
+		if idx*chunkSize >= off && (idx+1)*chunkSize <= end {
+			chunks[idx] = nil
+			continue
+		}
+		chunk, err := readChunk(store, ino, idx)
+		if err != nil {
+			return 0, err
+		}
+		chunks[idx] = chunk
+	}
+
+	added := 0
+	for idx, chunk := range chunks {
+		if _, ok := dirty[idx]; !ok {
+			added++
+		}
+		start := idx * chunkSize
+		from, to := off, end
+		if from < start {
+			from = start
+		}
+		if to > start+chunkSize {
+			to = start + chunkSize
+		}
+		if uint64(len(chunk)) < to-start {
+			chunk = append(chunk, make([]byte, to-start-uint64(len(chunk)))...)
+		}
+		copy(chunk[from-start:], data[from-off:to-off])
+		dirty[idx] = chunk
+	}
+	return added, nil
+}
+
+// truncateChunks cuts the chunk of the file ino the new size ends in, the
+// chunks after it are dropped by reclaimChunks
+func truncateChunks(store Storage, b Batch, refs *chunkRefs, ino uint64, old uint64, size uint64) error {
+	keep := size % chunkSize
+	if size >= old || keep == 0 {
+		return nil
+	}
+	chunk, err := readChunk(store, ino, size/chunkSize)
+	if err != nil || uint64(len(chunk)) <= keep {
+		return err
+	}
+	return refs.set(b, ino, size/chunkSize, chunk[:keep])
+}
+
+// reclaimBatch is the number of chunks reclaimChunks drops in one batch
+var reclaimBatch uint64 = 256
+
+// reclaimChunks drops the chunks of n from the chunk first to the end of
+// size bytes, reclaimBatch chunks per batch so a large file does not make a
+// batch too big for the store
+func (n *BoxInode) reclaimChunks(first uint64, size uint64) error {
+	for ; first*chunkSize < size; first += reclaimBatch {
+		last := first + reclaimBatch
+		err := n.contentBatch(func(b Batch, refs *chunkRefs) error {
+			for idx := first; idx < last && idx*chunkSize < size; idx++ {
+				if err := refs.del(b, n.Attr.Ino, idx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
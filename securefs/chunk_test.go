@@ -0,0 +1,272 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	cfg "strongbox/configuration"
+)
+
+// fileContent reads the whole content of the file n from store
+func fileContent(store Storage, n *BoxInode) string {
+	data := make([]byte, n.Attr.Size)
+	if err := readChunks(store, nil, n.Attr.Ino, 0, data); err != nil {
+		return "error: " + err.Error()
+	}
+	return string(data)
+}
+
+func TestChunks(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	_, fh, _, errno := root.Create(ctx, "big", 0, 0644, &fuse.EntryOut{})
+	if errno != fs.OK {
+		t.Fatal("Create:", errno)
+	}
+	f := fh.(*BoxFile)
+	node := f.inode
+
+	// a write across two chunks after a hole
+	data := bytes.Repeat([]byte("x"), 100)
+	off := int64(3*chunkSize - 50)
+	if _, errno := f.Write(ctx, data, off); errno != fs.OK {
+		t.Fatal("Write:", errno)
+	}
+	if errno := f.Flush(ctx); errno != fs.OK {
+		t.Fatal("Flush:", errno)
+	}
+	if node.Attr.Size != uint64(off)+100 {
+		t.Fatal("size:", node.Attr.Size)
+	}
+	for idx, want := range map[uint64]int{0: 0, 2: chunkSize, 3: 50} {
+		if chunk, _ := readChunk(store, node.Attr.Ino, idx); len(chunk) != want {
+			t.Fatal("chunk ", idx, " length ", len(chunk))
+		}
+	}
+
+	dest := make([]byte, 200)
+	res, errno := f.Read(ctx, dest, off-100)
+	if errno != fs.OK {
+		t.Fatal("Read:", errno)
+	}
+	got, _ := res.Bytes(nil)
+	want := append(make([]byte, 100), data...)
+	if !bytes.Equal(got, want) {
+		t.Fatal("read across the chunks:", len(got))
+	}
+
+	// truncate inside the last chunk then grow again, zeros come back
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = uint64(3*chunkSize + 10)
+	if errno := node.Setattr(ctx, f, in, &fuse.AttrOut{}); errno != fs.OK {
+		t.Fatal("Setattr:", errno)
+	}
+	in.Size = uint64(3*chunkSize - 10)
+	node.Setattr(ctx, f, in, &fuse.AttrOut{})
+	if chunk, _ := readChunk(store, node.Attr.Ino, 3); len(chunk) != 0 {
+		t.Fatal("chunk after the size kept")
+	}
+	in.Size = uint64(3*chunkSize + 10)
+	node.Setattr(ctx, f, in, &fuse.AttrOut{})
+	res, _ = f.Read(ctx, make([]byte, 20), 3*chunkSize-20)
+	got, _ = res.Bytes(nil)
+	if !bytes.Equal(got, append(bytes.Repeat([]byte("x"), 10), make([]byte, 10)...)) {
+		t.Fatal("read after truncate:", got)
+	}
+
+	if errno := root.Unlink(ctx, "big"); errno != fs.OK {
+		t.Fatal("Unlink:", errno)
+	}
+	left := 0
+	store.Iterate(chunkPrefix(node.Attr.Ino), func(key []byte, value []byte) error {
+		left++
+		return nil
+	})
+	if left != 0 {
+		t.Fatal("chunks left:", left)
+	}
+}
+
+func TestWriteback(t *testing.T) {
+	cfg.Cfg.Backup.DirtyLimit = 1
+	defer func() { cfg.Cfg.Backup.DirtyLimit = 0 }()
+
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	_, fh, _, _ := root.Create(ctx, "a.txt", 0, 0644, &fuse.EntryOut{})
+	f := fh.(*BoxFile)
+	node := f.inode
+	f.Write(ctx, []byte("content"), 0)
+
+	// nothing is stored before the file is flushed, reads see the new data
+	if chunk, _ := readChunk(store, node.Attr.Ino, 0); len(chunk) != 0 {
+		t.Fatal("written through")
+	}
+	res, _ := f.Read(ctx, make([]byte, 16), 0)
+	if got, _ := res.Bytes(nil); string(got) != "content" {
+		t.Fatal("read of dirty data:", string(got))
+	}
+	if err := root.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	loaded, _ := NewRootBoxInode(store)
+	stored, _ := loaded.GetChildNode("a.txt")
+	if data := fileContent(store, stored); data != "content" {
+		t.Fatal("not stored on close:", data)
+	}
+
+	// past the dirty limit the writer stores the data itself
+	data := bytes.Repeat([]byte("y"), chunkSize)
+	for off := 0; off <= 1<<20; off += chunkSize {
+		f.Write(ctx, data, int64(off))
+	}
+	if root.cache.over() {
+		t.Fatal("dirty limit exceeded:", root.cache.bytes)
+	}
+	if chunk, _ := readChunk(store, node.Attr.Ino, 1); len(chunk) != chunkSize {
+		t.Fatal("not stored past the dirty limit")
+	}
+
+	// a removed file is never written back
+	f.Write(ctx, data, 0)
+	root.Unlink(ctx, "a.txt")
+	f.Release(ctx)
+	if v, _ := store.Get(inodeKey(node.Attr.Ino)); len(v) != 0 {
+		t.Fatal("removed file written back")
+	}
+}
+
+// batchLimit fails the batches of more than limit writes, like a badger
+// transaction that is too big
+type batchLimit struct {
+	*MemStorage
+	limit int
+}
+
+type countedBatch struct {
+	Batch
+	writes int
+}
+
+func (b *countedBatch) Set(key []byte, value []byte) error {
+	b.writes++
+	return b.Batch.Set(key, value)
+}
+
+func (b *countedBatch) Del(key []byte) error {
+	b.writes++
+	return b.Batch.Del(key)
+}
+
+func (s *batchLimit) Batch(fn func(b Batch) error) error {
+	return s.MemStorage.Batch(func(b Batch) error {
+		c := &countedBatch{Batch: b}
+		if err := fn(c); err != nil {
+			return err
+		}
+		if s.limit != 0 && c.writes > s.limit {
+			return errors.New("batch too big")
+		}
+		return nil
+	})
+}
+
+func TestLargeDelete(t *testing.T) {
+	cfg.Cfg.Backup.Versions = 2
+	defer func() { cfg.Cfg.Backup.Versions = 0 }()
+	reclaimBatch = 4
+	defer func() { reclaimBatch = 256 }()
+
+	store := &batchLimit{MemStorage: NewMemStorage()}
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	data := make([]byte, 20*chunkSize)
+	rand.Read(data)
+	_, fh, _, _ := root.Create(ctx, "big", 0, 0644, &fuse.EntryOut{})
+	f := fh.(*BoxFile)
+	node := f.inode
+	f.Write(ctx, data, 0)
+	f.Release(ctx)
+	if versions, _ := root.Versions("/big"); len(versions) != 1 {
+		t.Fatal("versions:", versions)
+	}
+
+	// the whole file takes more writes than a batch holds
+	store.limit = 100
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = chunkSize + 10
+	if errno := node.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != fs.OK {
+		t.Fatal("Setattr:", errno)
+	}
+	chunks := 0
+	store.Iterate(chunkPrefix(node.Attr.Ino), func(key []byte, value []byte) error {
+		chunks++
+		return nil
+	})
+	if chunks != 2 || fileContent(store, node) != string(data[:chunkSize+10]) {
+		t.Fatal("truncate:", chunks)
+	}
+
+	if errno := root.Unlink(ctx, "big"); errno != fs.OK {
+		t.Fatal("Unlink:", errno)
+	}
+	for _, prefix := range []string{"i/", "c/", "v/", "h/", "r/"} {
+		store.Iterate([]byte(prefix), func(key []byte, value []byte) error {
+			if prefix != "i/" || string(key) != string(inodeKey(rootIno)) {
+				t.Fatal("left after unlink: ", string(key))
+			}
+			return nil
+		})
+	}
+}
+
+func TestFlushLarge(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Backup.Backend = BackendBadger
+	db := &BadgerDB{}
+	if err := db.InitDB(); err != nil {
+		t.Fatal("InitDB:", err)
+	}
+	defer db.Close()
+	root, _ := NewRootBoxInode(db.Sealed())
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	// more than a badger transaction holds
+	data := make([]byte, 20<<20)
+	rand.Read(data)
+	_, fh, _, _ := root.Create(ctx, "big", 0, 0644, &fuse.EntryOut{})
+	f := fh.(*BoxFile)
+	for off := 0; off < len(data); off += 4 << 20 {
+		if _, errno := f.Write(ctx, data[off:off+4<<20], int64(off)); errno != fs.OK {
+			t.Fatal("Write:", errno)
+		}
+	}
+	if errno := f.Flush(ctx); errno != fs.OK {
+		t.Fatal("Flush:", errno)
+	}
+	if len(f.inode.dirty) != 0 {
+		t.Fatal("dirty after flush:", len(f.inode.dirty))
+	}
+
+	loaded, _ := NewRootBoxInode(db.Sealed())
+	big, err := loaded.GetChildNode("big")
+	if err != nil || big.Attr.Size != uint64(len(data)) || fileContent(db.Sealed(), big) != string(data) {
+		t.Fatal("stored file:", err)
+	}
+}
@@ -0,0 +1,77 @@
+package securefs
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	cfg "strongbox/configuration"
+)
+
+// the first byte of the stored data of a chunk is the codec of the rest, the
+// data is compressed before the storage seals it
+const (
+	codecRaw byte = iota
+	codecZstd
+	codecSnappy
+)
+
+const (
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+var ErrUnknownCodec = errors.New("unknown chunk codec")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// both only fail on bad options
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// encodeChunk compresses data with the codec of backup.compression, data
+// that does not get smaller is kept raw
+func encodeChunk(data []byte) []byte {
+	var packed []byte
+	codec := codecRaw
+	switch cfg.Cfg.Backup.Compression {
+	case CompressionZstd:
+		enc, _ := zstdCodec()
+		packed = enc.EncodeAll(data, []byte{codecZstd})
+		codec = codecZstd
+	case CompressionSnappy:
+		packed = append([]byte{codecSnappy}, snappy.Encode(nil, data)...)
+		codec = codecSnappy
+	}
+	if codec == codecRaw || len(packed) > len(data) {
+		return append([]byte{codecRaw}, data...)
+	}
+	return packed
+}
+
+func decodeChunk(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, ErrUnknownCodec
+	}
+	switch stored[0] {
+	case codecRaw:
+		return stored[1:], nil
+	case codecZstd:
+		_, dec := zstdCodec()
+		return dec.DecodeAll(stored[1:], nil)
+	case codecSnappy:
+		return snappy.Decode(nil, stored[1:])
+	}
+	return nil, ErrUnknownCodec
+}
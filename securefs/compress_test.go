@@ -0,0 +1,75 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	cfg "strongbox/configuration"
+)
+
+func TestCompression(t *testing.T) {
+	defer func() { cfg.Cfg.Backup.Compression = "" }()
+	text := bytes.Repeat([]byte("key: value\n"), 20000)
+	random := make([]byte, 3*chunkSize)
+	rand.Read(random)
+
+	for _, codec := range []string{"", CompressionZstd, CompressionSnappy} {
+		cfg.Cfg.Backup.Compression = codec
+		store := NewMemStorage()
+		root, _ := NewRootBoxInode(store)
+		fs.NewNodeFS(root, &fs.Options{})
+		ctx := testContext()
+
+		for name, data := range map[string][]byte{"text": text, "random": random} {
+			_, fh, _, _ := root.Create(ctx, name, 0, 0644, &fuse.EntryOut{})
+			fh.(*BoxFile).Write(ctx, data, 0)
+			fh.(*BoxFile).Release(ctx)
+			node, _ := root.GetChildNode(name)
+			if node.Attr.Size != uint64(len(data)) {
+				t.Fatal(codec, " size of ", name, ": ", node.Attr.Size)
+			}
+			if fileContent(store, node) != string(data) {
+				t.Fatal(codec, " content of ", name)
+			}
+		}
+
+		stored := 0
+		store.Iterate([]byte("h/"), func(key []byte, value []byte) error {
+			if value[0] == codecRaw && !bytes.Contains(random, value[1:]) && codec != "" {
+				t.Fatal(codec, ": compressible chunk stored raw")
+			}
+			stored += len(value)
+			return nil
+		})
+		s, _ := ReadStats(store)
+		if s.StoredBytes != uint64(stored) {
+			t.Fatal(codec, " stats: ", s)
+		}
+		// the random chunks are kept raw
+		if codec != "" && stored > len(random)+len(text)/10 {
+			t.Fatal(codec, " not compressed: ", stored)
+		}
+	}
+}
+
+func TestMarkCodecs(t *testing.T) {
+	store := NewMemStorage()
+	store.Set(chunkKey(2, 0), []byte("abcd"))
+	store.Set(dataKey("abcd"), []byte("content"))
+	store.Set(refKey("abcd"), []byte("1 7"))
+	store.Set(layoutKey, []byte("5"))
+
+	if err := upgradeLayout(store, store); err != nil {
+		t.Fatal("upgradeLayout:", err)
+	}
+	if data, err := readChunk(store, 2, 0); err != nil || string(data) != "content" {
+		t.Fatal("chunk after upgrade:", err, string(data))
+	}
+	if ref, _ := readRef(store, "abcd"); ref.count != 1 || ref.size != 7 || ref.stored != 8 {
+		t.Fatal("reference:", ref)
+	}
+}
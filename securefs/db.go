@@ -0,0 +1,84 @@
+package securefs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	cfg "strongbox/configuration"
+)
+
+const (
+	BackendBadger  = "badger"
+	BackendBlobDir = "blobdir"
+)
+
+// DB is the store of the vault selected by backup.backend
+type DB interface {
+	Storage
+	// InitDB unlocks the vault and opens the store
+	InitDB() error
+	// Sealed is the storage of the file system, once InitDB succeeded
+	Sealed() Storage
+	Close()
+}
+
+var dbInstance DB
+
+func GetDBInstance() DB {
+	if dbInstance == nil {
+		if cfg.Cfg.Backup.Backend == BackendBlobDir && !cfg.Cfg.Backup.Memory {
+			dbInstance = &BlobDir{}
+		} else {
+			dbInstance = &BadgerDB{}
+		}
+	}
+	return dbInstance
+}
+
+// writeFileAtomic replaces path with data, readers and file sync tools see
+// either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// created with mode 0600
+	f, err := os.CreateTemp(dir, ".strongbox-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the entries renamed in dir durable, windows does not sync
+// directories and journals renames itself
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,334 @@
+package securefs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The chunk keys of a file hold the keyed hashes of the pieces of the
+// chunk, see cdc.go, the data of a piece is stored once per hash with a
+// count of the references to it:
+//
+//	c/<ino>/<idx>  hash,hash,...
+//	h/<hash>       codec | data, see encodeChunk
+//	r/<hash>       "<count> <size> <stored size>"
+//
+// The hash is an HMAC with a random key kept in the store, so equal hashes
+// only tell that two chunks are equal, not what they contain.
+
+// ErrMissingChunk is returned when a chunk refers to data that is not stored
+var ErrMissingChunk = errors.New("chunk data missing")
+
+var hashKeyKey = []byte("#hashkey")
+
+func dataKey(hash string) []byte {
+	return []byte("h/" + hash)
+}
+
+func refKey(hash string) []byte {
+	return []byte("r/" + hash)
+}
+
+// chunkHashKey reads the hash key of store, a new one is made the first time
+func chunkHashKey(store Storage) ([]byte, error) {
+	key, err := store.Get(hashKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 0 {
+		return key, nil
+	}
+	key = make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, store.Set(hashKeyKey, key)
+}
+
+type chunkRef struct {
+	count  int
+	size   int
+	stored int
+}
+
+// parseRef reads a reference count, those of layout 5 have no stored size
+func parseRef(data []byte) (chunkRef, error) {
+	ref := chunkRef{}
+	n, err := fmt.Sscan(string(data), &ref.count, &ref.size, &ref.stored)
+	if n == 2 {
+		return ref, nil
+	}
+	return ref, err
+}
+
+func readRef(store Storage, hash string) (chunkRef, error) {
+	data, err := store.Get(refKey(hash))
+	if err != nil || len(data) == 0 {
+		return chunkRef{}, err
+	}
+	return parseRef(data)
+}
+
+// pieceHashes returns the hashes of the pieces of a chunk key value, a
+// single hash before the chunks were cut in pieces
+func pieceHashes(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// readChunk returns the data of the chunk idx of the file ino, nil if the
+// chunk is not stored
+func readChunk(store Storage, ino uint64, idx uint64) ([]byte, error) {
+	value, err := store.Get(chunkKey(ino, idx))
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+	data, err := readPieces(store, string(value))
+	if err == ErrMissingChunk {
+		log.Error("chunk ", idx, " of inode ", ino, " refers to missing data")
+	}
+	return data, err
+}
+
+// readPieces returns the data of the pieces of a chunk key value
+func readPieces(store Storage, value string) ([]byte, error) {
+	var data []byte
+	for _, hash := range pieceHashes(value) {
+		piece, err := readHash(store, hash)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, piece...)
+	}
+	return data, nil
+}
+
+// readHash returns the piece data stored under hash
+func readHash(store Storage, hash string) ([]byte, error) {
+	data, err := store.Get(dataKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrMissingChunk
+	}
+	return decodeChunk(data)
+}
+
+// chunkRefs collects the changes of the reference counts in one batch, see
+// contentBatch
+type chunkRefs struct {
+	store Storage
+	key   []byte
+	gear  *gearTable
+	delta map[string]int
+	data  map[string][]byte
+}
+
+func (c *chunkRefs) hash(chunk []byte) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// add counts one more reference to piece and returns its hash
+func (c *chunkRefs) add(piece []byte) string {
+	hash := c.hash(piece)
+	c.delta[hash]++
+	c.data[hash] = piece
+	return hash
+}
+
+// set stores chunk as the chunk idx of the file ino, cut in pieces
+func (c *chunkRefs) set(b Batch, ino uint64, idx uint64, chunk []byte) error {
+	if len(chunk) == 0 {
+		return c.del(b, ino, idx)
+	}
+	old, err := c.store.Get(chunkKey(ino, idx))
+	if err != nil {
+		return err
+	}
+	hashes := []string{}
+	for _, piece := range c.gear.split(chunk) {
+		hashes = append(hashes, c.add(piece))
+	}
+	value := strings.Join(hashes, ",")
+	c.release(string(old))
+	if string(old) == value {
+		return nil
+	}
+	return b.Set(chunkKey(ino, idx), []byte(value))
+}
+
+// keep counts one more reference to the stored pieces of a chunk key value
+func (c *chunkRefs) keep(value string) {
+	for _, hash := range pieceHashes(value) {
+		c.delta[hash]++
+	}
+}
+
+// release counts one reference less to the pieces of a chunk key value
+func (c *chunkRefs) release(value string) {
+	for _, hash := range pieceHashes(value) {
+		c.delta[hash]--
+	}
+}
+
+// link makes the stored pieces of a chunk key value the chunk idx of the
+// file ino
+func (c *chunkRefs) link(b Batch, ino uint64, idx uint64, value string) error {
+	old, err := c.store.Get(chunkKey(ino, idx))
+	if err != nil || string(old) == value {
+		return err
+	}
+	c.keep(value)
+	c.release(string(old))
+	return b.Set(chunkKey(ino, idx), []byte(value))
+}
+
+// del drops the chunk idx of the file ino
+func (c *chunkRefs) del(b Batch, ino uint64, idx uint64) error {
+	old, err := c.store.Get(chunkKey(ino, idx))
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	c.release(string(old))
+	return b.Del(chunkKey(ino, idx))
+}
+
+// commit writes the new counts, the data of a hash is stored with its first
+// reference and deleted with its last one
+func (c *chunkRefs) commit(b Batch) error {
+	for hash, delta := range c.delta {
+		if delta == 0 {
+			continue
+		}
+		ref, err := readRef(c.store, hash)
+		if err != nil {
+			return err
+		}
+		count := ref.count + delta
+		if count <= 0 {
+			if err := b.Del(dataKey(hash)); err != nil {
+				return err
+			}
+			if err := b.Del(refKey(hash)); err != nil {
+				return err
+			}
+			continue
+		}
+		if ref.count <= 0 {
+			// a reference kept to data that is gone
+			if c.data[hash] == nil {
+				return ErrMissingChunk
+			}
+			stored := encodeChunk(c.data[hash])
+			ref.size = len(c.data[hash])
+			ref.stored = len(stored)
+			if err := b.Set(dataKey(hash), stored); err != nil {
+				return err
+			}
+		}
+		if err := b.Set(refKey(hash), []byte(fmt.Sprint(count, " ", ref.size, " ", ref.stored))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentBatch runs fn and the reference count changes it makes in one
+// batch. The counts are read and written under the refMu of the root, the
+// batches of the files sharing a chunk do not race.
+func (n *BoxInode) contentBatch(fn func(b Batch, refs *chunkRefs) error) error {
+	r := n.root
+	r.refMu.Lock()
+	defer r.refMu.Unlock()
+
+	refs := &chunkRefs{
+		store: n.store(),
+		key:   r.hashKey,
+		gear:  r.gear,
+		delta: make(map[string]int),
+		data:  make(map[string][]byte),
+	}
+	return n.store().Batch(func(b Batch) error {
+		if err := fn(b, refs); err != nil {
+			return err
+		}
+		return refs.commit(b)
+	})
+}
+
+// Stats tells how much the deduplication and the compression of the chunks
+// save
+type Stats struct {
+	Files int
+	// chunks of the files and their size
+	Chunks int
+	Bytes  uint64
+	// chunks stored once per hash, their size and their compressed size
+	StoredChunks int
+	UniqueBytes  uint64
+	StoredBytes  uint64
+}
+
+// Saved is the size that is not stored, none when the codec byte of data
+// that does not compress makes the stored size larger
+func (s Stats) Saved() uint64 {
+	if s.StoredBytes > s.Bytes {
+		return 0
+	}
+	return s.Bytes - s.StoredBytes
+}
+
+func (s Stats) String() string {
+	saved := 0.0
+	if s.Bytes != 0 {
+		saved = 100 * float64(s.Saved()) / float64(s.Bytes)
+	}
+	return fmt.Sprintf("files: %d, chunks: %d (%d bytes), stored chunks: %d (%d bytes, %d compressed), saved: %d bytes (%.1f%%)",
+		s.Files, s.Chunks, s.Bytes, s.StoredChunks, s.UniqueBytes, s.StoredBytes, s.Saved(), saved)
+}
+
+// ReadStats counts the chunks of the file system kept in store
+func ReadStats(store Storage) (Stats, error) {
+	s := Stats{}
+	err := store.Iterate([]byte("i/"), func(key []byte, value []byte) error {
+		attr := BoxAttr{}
+		if err := json.Unmarshal(value, &attr); err != nil {
+			return err
+		}
+		if attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			s.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	err = store.Iterate([]byte("r/"), func(key []byte, value []byte) error {
+		ref, err := parseRef(value)
+		if err != nil {
+			log.Warn("stats: bad reference ", string(key))
+			return nil
+		}
+		s.Chunks += ref.count
+		s.Bytes += uint64(ref.count) * uint64(ref.size)
+		s.StoredChunks++
+		s.UniqueBytes += uint64(ref.size)
+		s.StoredBytes += uint64(ref.stored)
+		return nil
+	})
+	return s, err
+}
@@ -0,0 +1,101 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDedup(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	data := bytes.Repeat([]byte("secret"), chunkSize/3)
+	for _, name := range []string{"a", "b"} {
+		_, fh, _, _ := root.Create(ctx, name, 0, 0644, &fuse.EntryOut{})
+		fh.(*BoxFile).Write(ctx, data, 0)
+		if errno := fh.(*BoxFile).Release(ctx); errno != fs.OK {
+			t.Fatal("Release:", errno)
+		}
+	}
+
+	s, err := ReadStats(store)
+	if err != nil {
+		t.Fatal("ReadStats:", err)
+	}
+	if s.Files != 2 || s.Chunks != 2*s.StoredChunks || s.Bytes != 2*uint64(len(data)) || s.UniqueBytes != uint64(len(data)) {
+		t.Fatal("stats:", s)
+	}
+
+	// truncating one copy leaves the other intact
+	a, _ := root.GetChildNode("a")
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 6
+	if errno := a.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != fs.OK {
+		t.Fatal("Setattr:", errno)
+	}
+	b, _ := root.GetChildNode("b")
+	if fileContent(store, b) != string(data) || fileContent(store, a) != "secret" {
+		t.Fatal("content after truncate")
+	}
+
+	// the data goes with its last reference
+	root.Unlink(ctx, "a")
+	root.Unlink(ctx, "b")
+	for _, prefix := range []string{"c/", "h/", "r/"} {
+		store.Iterate([]byte(prefix), func(key []byte, value []byte) error {
+			t.Fatal("left after unlink: ", string(key))
+			return nil
+		})
+	}
+}
+
+func TestDedupShift(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	// the same content after an insertion shares the pieces past it
+	data := make([]byte, chunkSize-100)
+	rand.Read(data)
+	for name, content := range map[string][]byte{"a": data, "b": append([]byte("inserted line\n"), data...)} {
+		_, fh, _, _ := root.Create(ctx, name, 0, 0644, &fuse.EntryOut{})
+		fh.(*BoxFile).Write(ctx, content, 0)
+		fh.(*BoxFile).Release(ctx)
+		node, _ := root.GetChildNode(name)
+		if fileContent(store, node) != string(content) {
+			t.Fatal("content of ", name)
+		}
+	}
+	s, _ := ReadStats(store)
+	if s.StoredChunks >= s.Chunks || s.UniqueBytes > uint64(len(data))+maxPiece {
+		t.Fatal("shifted content not deduplicated:", s)
+	}
+}
+
+func TestStatsIncompressible(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	data := make([]byte, chunkSize)
+	rand.Read(data)
+	_, fh, _, _ := root.Create(ctx, "random", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, data, 0)
+	fh.(*BoxFile).Release(ctx)
+
+	// every piece is stored with its codec byte
+	s, _ := ReadStats(store)
+	if s.StoredBytes <= s.Bytes || s.Saved() != 0 || !strings.Contains(s.String(), "saved: 0 bytes (0.0%)") {
+		t.Fatal("stats of incompressible data:", s)
+	}
+}
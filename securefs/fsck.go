@@ -0,0 +1,716 @@
+package securefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fsck reads every record of a store, the way DebugKeys does, and checks the
+// records against each other:
+//
+//	i/<ino>  reached from the root through the entries, or from the trash
+//	d/...    in an existing directory, to an existing inode, one per inode
+//	c/...    of an existing file, inside its size, to stored data
+//	v/...    of an existing file, to stored data
+//	t/<ino>  of an existing inode that is not in the tree
+//	h/, r/   counts matching the chunks and versions that refer to the data
+//
+// A repair deletes what nothing refers to and what refers to nothing, an
+// inode out of the tree goes to the trash with its content so it can be
+// restored. The store must not be mounted meanwhile.
+
+// kinds of FsckProblem
+const (
+	FsckUnreadable = "unreadable"
+	FsckCorrupt    = "corrupt"
+	FsckOrphan     = "orphan"
+	FsckMissing    = "missing"
+	FsckSize       = "size"
+	FsckDuplicate  = "duplicate"
+	FsckRefCount   = "refcount"
+	FsckLeak       = "leak"
+)
+
+// repairs written in one batch
+const fsckBatch = 256
+
+type FsckProblem struct {
+	Kind string
+	// key of the store, or blob of a blobdir, the problem was found at
+	Key    string
+	Detail string
+	// what the repair did, empty when nothing was repaired
+	Repair string
+}
+
+func (p FsckProblem) String() string {
+	s := fmt.Sprintf("%s %s: %s", p.Kind, p.Key, p.Detail)
+	if p.Repair != "" {
+		s += " (" + p.Repair + ")"
+	}
+	return s
+}
+
+type FsckReport struct {
+	Inodes   int
+	Entries  int
+	Chunks   int
+	Versions int
+	Problems []FsckProblem
+}
+
+// Repaired counts the problems a repair fixed
+func (r *FsckReport) Repaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Repair != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *FsckReport) String() string {
+	b := &strings.Builder{}
+	for _, p := range r.Problems {
+		fmt.Fprintln(b, p)
+	}
+	fmt.Fprintf(b, "inodes: %d, entries: %d, chunks: %d, versions: %d, problems: %d, repaired: %d",
+		r.Inodes, r.Entries, r.Chunks, r.Versions, len(r.Problems), r.Repaired())
+	return b.String()
+}
+
+type fsckInode struct {
+	attr BoxAttr
+	// value of each chunk key that is kept
+	chunks  map[uint64]string
+	trashed bool
+	reached bool
+}
+
+func (i *fsckInode) isDir() bool {
+	return i.attr.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+type fsckEntry struct {
+	parent uint64
+	name   string
+	ino    uint64
+}
+
+func (e fsckEntry) key() []byte {
+	return direntKey(e.parent, e.name)
+}
+
+type fsckData struct {
+	size   int
+	stored int
+}
+
+type fsck struct {
+	repair bool
+	report *FsckReport
+	fixes  []func(b Batch) error
+
+	inodes  map[uint64]*fsckInode
+	entries map[uint64][]fsckEntry
+	chunks  map[uint64]map[uint64]string
+	vers    map[uint64][]Version
+	trash   map[uint64]TrashEntry
+	data    map[string]fsckData
+	refs    map[string]chunkRef
+	counted map[string]int
+	next    uint64
+	maxIno  uint64
+}
+
+// Fsck checks the store of db, opened with InitDB, and repairs it with
+// repair
+func Fsck(db DB, repair bool) (*FsckReport, error) {
+	return checkStore(db, db.Sealed(), repair)
+}
+
+// checkStore checks the records of raw through sealed, the storage of the
+// file system above it
+func checkStore(raw Storage, sealed Storage, repair bool) (*FsckReport, error) {
+	f := &fsck{
+		repair:  repair,
+		report:  &FsckReport{},
+		inodes:  map[uint64]*fsckInode{},
+		entries: map[uint64][]fsckEntry{},
+		chunks:  map[uint64]map[uint64]string{},
+		vers:    map[uint64][]Version{},
+		trash:   map[uint64]TrashEntry{},
+		data:    map[string]fsckData{},
+		refs:    map[string]chunkRef{},
+		counted: map[string]int{},
+	}
+	if err := f.scan(raw, sealed); err != nil {
+		return nil, err
+	}
+	f.checkNextIno()
+	next := f.next
+	f.checkEntries()
+	f.checkChunks()
+	f.checkVersions()
+	f.checkTrash()
+	f.checkTree()
+	f.checkRefs()
+	// the copies of the files took inode numbers
+	if f.next != next {
+		f.fixes = append(f.fixes, func(b Batch) error {
+			return b.Set(nextInoKey, []byte(strconv.FormatUint(f.next, 10)))
+		})
+	}
+
+	leaked := []string{}
+	if b, ok := raw.(*BlobDir); ok {
+		var err error
+		if leaked, err = b.leakedBlobs(); err != nil {
+			return nil, err
+		}
+		for _, blob := range leaked {
+			f.problem(FsckLeak, blob, "blob no object refers to", "removed", nil)
+		}
+	}
+	if !repair {
+		return f.report, nil
+	}
+
+	for len(f.fixes) > 0 {
+		n := len(f.fixes)
+		if n > fsckBatch {
+			n = fsckBatch
+		}
+		err := sealed.Batch(func(b Batch) error {
+			for _, fix := range f.fixes[:n] {
+				if err := fix(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return f.report, err
+		}
+		f.fixes = f.fixes[n:]
+	}
+	for _, blob := range leaked {
+		if err := raw.(*BlobDir).removeBlob(blob); err != nil {
+			return f.report, err
+		}
+	}
+	log.Info("fsck: repaired ", f.report.Repaired(), " of ", len(f.report.Problems), " problems")
+	return f.report, nil
+}
+
+// problem reports a problem found at key, fix repairs it within a batch. A
+// problem with a repair but no fix is repaired by the caller.
+func (f *fsck) problem(kind string, key string, detail string, repair string, fix func(b Batch) error) {
+	p := FsckProblem{Kind: kind, Key: key, Detail: detail}
+	if f.repair && repair != "" {
+		p.Repair = repair
+		if fix != nil {
+			f.fixes = append(f.fixes, fix)
+		}
+	}
+	f.report.Problems = append(f.report.Problems, p)
+}
+
+// drop reports a record that is deleted by the repair
+func (f *fsck) drop(kind string, key []byte, detail string) {
+	key = append([]byte{}, key...)
+	f.problem(kind, string(key), detail, "deleted", func(b Batch) error {
+		return b.Del(key)
+	})
+}
+
+// set reports a record that the repair writes with value
+func (f *fsck) set(kind string, key []byte, detail string, repair string, value []byte) {
+	f.problem(kind, string(key), detail, repair, func(b Batch) error {
+		return b.Set(key, value)
+	})
+}
+
+// scan reads every record, a value that does not open is reported instead
+// of stopping the scan
+func (f *fsck) scan(raw Storage, sealed Storage) error {
+	s, ok := sealed.(*sealedStorage)
+	if !ok {
+		return errors.New("fsck needs a sealed store")
+	}
+	visit := func(key []byte, value []byte, err error) error {
+		if err == nil {
+			value, err = s.sealer.Open(key, value)
+		}
+		if err != nil {
+			f.drop(FsckUnreadable, key, err.Error())
+			return nil
+		}
+		f.load(string(key), value)
+		return nil
+	}
+	if b, ok := raw.(*BlobDir); ok {
+		return b.scan(visit)
+	}
+	return raw.Iterate(nil, func(key []byte, value []byte) error {
+		return visit(key, value, nil)
+	})
+}
+
+// keyInos parses the numbers of key after its prefix, up to count of them,
+// the rest of the key is returned as is
+func keyInos(key string, count int) ([]uint64, string, bool) {
+	parts := strings.SplitN(key[2:], "/", count+1)
+	if len(parts) < count {
+		return nil, "", false
+	}
+	nums := make([]uint64, count)
+	for i := range nums {
+		n, err := strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			return nil, "", false
+		}
+		nums[i] = n
+	}
+	rest := ""
+	if len(parts) > count {
+		rest = parts[count]
+	}
+	return nums, rest, true
+}
+
+func (f *fsck) load(key string, value []byte) {
+	bad := func(detail string) {
+		f.drop(FsckCorrupt, []byte(key), detail)
+	}
+	if strings.HasPrefix(key, "#") {
+		if key == string(nextInoKey) {
+			next, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				bad("next inode number does not parse")
+				return
+			}
+			f.next = next
+		}
+		return
+	}
+	if len(key) < 2 || key[1] != '/' {
+		f.problem(FsckCorrupt, key, "unknown record", "", nil)
+		return
+	}
+
+	switch key[0] {
+	case 'i':
+		nums, rest, ok := keyInos(key, 1)
+		if !ok || rest != "" {
+			bad("inode key does not parse")
+			return
+		}
+		i := &fsckInode{chunks: map[uint64]string{}}
+		if err := json.Unmarshal(value, &i.attr); err != nil {
+			bad("inode record does not parse")
+			return
+		}
+		ino := nums[0]
+		if i.attr.Ino != ino {
+			f.problem(FsckCorrupt, key, fmt.Sprint("inode record holds inode ", i.attr.Ino), "inode number set", nil)
+			i.attr.Ino = ino
+			if f.repair {
+				f.saveAttr(i)
+			}
+		}
+		f.inodes[ino] = i
+		if ino > f.maxIno {
+			f.maxIno = ino
+		}
+		f.report.Inodes++
+
+	case 'd':
+		nums, name, ok := keyInos(key, 1)
+		ino, err := strconv.ParseUint(string(value), 10, 64)
+		if !ok || name == "" || err != nil {
+			bad("entry does not parse")
+			return
+		}
+		f.entries[nums[0]] = append(f.entries[nums[0]], fsckEntry{parent: nums[0], name: name, ino: ino})
+		f.report.Entries++
+
+	case 'c':
+		nums, rest, ok := keyInos(key, 2)
+		if !ok || rest != "" || len(value) == 0 {
+			bad("chunk does not parse")
+			return
+		}
+		if f.chunks[nums[0]] == nil {
+			f.chunks[nums[0]] = map[uint64]string{}
+		}
+		f.chunks[nums[0]][nums[1]] = string(value)
+		f.report.Chunks++
+
+	case 'v':
+		nums, _, ok := keyInos(key, 1)
+		v := Version{}
+		if !ok || json.Unmarshal(value, &v) != nil || key != string(versionKey(nums[0], v.Seq)) {
+			bad("version does not parse")
+			return
+		}
+		f.vers[nums[0]] = append(f.vers[nums[0]], v)
+		f.report.Versions++
+
+	case 't':
+		nums, rest, ok := keyInos(key, 1)
+		e := TrashEntry{}
+		if !ok || rest != "" || json.Unmarshal(value, &e) != nil || e.Ino != nums[0] {
+			bad("trash entry does not parse")
+			return
+		}
+		f.trash[e.Ino] = e
+
+	case 'h':
+		chunk, err := decodeChunk(value)
+		if err != nil {
+			bad("chunk data does not decode: " + err.Error())
+			return
+		}
+		f.data[key[2:]] = fsckData{size: len(chunk), stored: len(value)}
+
+	case 'r':
+		ref, err := parseRef(value)
+		if err != nil {
+			bad("reference count does not parse")
+			return
+		}
+		f.refs[key[2:]] = ref
+
+	default:
+		f.problem(FsckCorrupt, key, "unknown record", "", nil)
+	}
+}
+
+func (f *fsck) saveAttr(i *fsckInode) {
+	attr := i.attr
+	f.fixes = append(f.fixes, func(b Batch) error {
+		data, err := json.Marshal(attr)
+		if err != nil {
+			return err
+		}
+		return b.Set(inodeKey(attr.Ino), data)
+	})
+}
+
+// isDir tells whether ino is a directory, the root always is one
+func (f *fsck) isDir(ino uint64) bool {
+	i, ok := f.inodes[ino]
+	return ino == rootIno || ok && i.isDir()
+}
+
+// checkEntries drops the entries of missing directories and to missing
+// inodes
+func (f *fsck) checkEntries() {
+	for parent, entries := range f.entries {
+		kept := []fsckEntry{}
+		for _, e := range entries {
+			switch {
+			case !f.isDir(parent):
+				f.drop(FsckOrphan, e.key(), fmt.Sprint("entry of inode ", parent, " that is not a directory"))
+			case f.inodes[e.ino] == nil:
+				f.drop(FsckMissing, e.key(), fmt.Sprint("entry to missing inode ", e.ino))
+			default:
+				kept = append(kept, e)
+			}
+		}
+		sort.Slice(kept, func(i, j int) bool { return kept[i].name < kept[j].name })
+		f.entries[parent] = kept
+	}
+}
+
+// checkChunks drops the chunks of missing files, those of missing data and
+// those past the size of their file
+func (f *fsck) checkChunks() {
+	for ino, chunks := range f.chunks {
+		i := f.inodes[ino]
+		for idx, value := range chunks {
+			key := chunkKey(ino, idx)
+			if i == nil || i.isDir() {
+				f.drop(FsckOrphan, key, fmt.Sprint("chunk of inode ", ino, " that is not a file"))
+				continue
+			}
+			if missing := f.missing(value); missing != "" {
+				f.drop(FsckMissing, key, "chunk data "+missing+" is not stored")
+				continue
+			}
+			// left by a truncate that did not get to reclaim it
+			if idx*chunkSize >= i.attr.Size {
+				f.drop(FsckSize, key, fmt.Sprint("chunk past the size ", i.attr.Size, " of the file"))
+				continue
+			}
+			i.chunks[idx] = value
+			f.count(value)
+		}
+	}
+}
+
+// checkVersions drops the versions of missing files and those of missing
+// data
+func (f *fsck) checkVersions() {
+	for ino, versions := range f.vers {
+		i := f.inodes[ino]
+		for _, v := range versions {
+			key := versionKey(ino, v.Seq)
+			if i == nil || i.isDir() {
+				f.drop(FsckOrphan, key, fmt.Sprint("version of inode ", ino, " that is not a file"))
+				continue
+			}
+			missing := ""
+			for _, value := range v.Chunks {
+				if m := f.missing(value); m != "" {
+					missing = m
+				}
+			}
+			if missing != "" {
+				f.drop(FsckMissing, key, "chunk data "+missing+" of the version is not stored")
+				continue
+			}
+			for _, value := range v.Chunks {
+				f.count(value)
+			}
+		}
+	}
+}
+
+// missing returns a hash of the pieces of a chunk key value whose data is
+// not stored
+func (f *fsck) missing(value string) string {
+	for _, hash := range pieceHashes(value) {
+		if _, ok := f.data[hash]; !ok {
+			return hash
+		}
+	}
+	return ""
+}
+
+// count counts a reference to each piece of a chunk key value
+func (f *fsck) count(value string) {
+	for _, hash := range pieceHashes(value) {
+		f.counted[hash]++
+	}
+}
+
+// checkTrash drops the trash entries of missing inodes
+func (f *fsck) checkTrash() {
+	for ino := range f.trash {
+		i := f.inodes[ino]
+		if i == nil {
+			f.drop(FsckOrphan, trashKey(ino), "trash entry of a missing inode")
+			delete(f.trash, ino)
+			continue
+		}
+		i.trashed = true
+	}
+}
+
+// checkTree walks the tree from the root, then from the trash and from the
+// inodes that are out of both. Each inode is reached by one entry, a second
+// entry to a file gets a copy of the file, a second one to a directory is
+// dropped.
+func (f *fsck) checkTree() {
+	if root := f.inodes[rootIno]; root != nil {
+		root.reached = true
+	}
+	f.walk(rootIno)
+
+	inos := make([]uint64, 0, len(f.inodes))
+	for ino := range f.inodes {
+		inos = append(inos, ino)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+
+	for _, ino := range inos {
+		i := f.inodes[ino]
+		if !i.trashed {
+			continue
+		}
+		if i.reached {
+			f.drop(FsckDuplicate, trashKey(ino), "inode in the trash is also in the tree")
+			continue
+		}
+		i.reached = true
+		f.walk(ino)
+	}
+
+	// the entries out of the tree tell which inodes are the top of what
+	// was lost
+	parents := map[uint64]uint64{}
+	for parent, entries := range f.entries {
+		for _, e := range entries {
+			if _, ok := parents[e.ino]; !ok || parent < parents[e.ino] {
+				parents[e.ino] = parent
+			}
+		}
+	}
+	for _, ino := range inos {
+		if f.inodes[ino].reached {
+			continue
+		}
+		top := ino
+		seen := map[uint64]bool{}
+		for {
+			seen[top] = true
+			parent, ok := parents[top]
+			if !ok || seen[parent] || f.inodes[parent] == nil || f.inodes[parent].reached {
+				break
+			}
+			top = parent
+		}
+		f.lost(top)
+	}
+}
+
+// walk reaches the entries below the directory ino
+func (f *fsck) walk(ino uint64) {
+	dirs := []uint64{ino}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		for _, e := range f.entries[dir] {
+			c := f.inodes[e.ino]
+			if !c.reached {
+				c.reached = true
+				if c.isDir() {
+					dirs = append(dirs, e.ino)
+				}
+				continue
+			}
+			if c.isDir() {
+				f.drop(FsckDuplicate, e.key(), fmt.Sprint("second entry to directory ", e.ino))
+				continue
+			}
+			f.copyFile(e, c)
+		}
+	}
+}
+
+// copyFile gives the entry e to the file c, which has another entry, a copy
+// of the file of its own
+func (f *fsck) copyFile(e fsckEntry, c *fsckInode) {
+	detail := fmt.Sprint("second entry to file ", e.ino)
+	if !f.repair {
+		f.problem(FsckDuplicate, string(e.key()), detail, "", nil)
+		return
+	}
+	ino := f.allocIno()
+	attr := c.attr
+	attr.Ino = ino
+	chunks := map[uint64]string{}
+	for idx, value := range c.chunks {
+		chunks[idx] = value
+		f.count(value)
+	}
+	f.problem(FsckDuplicate, string(e.key()), detail, fmt.Sprint("copied to inode ", ino), func(b Batch) error {
+		data, err := json.Marshal(attr)
+		if err != nil {
+			return err
+		}
+		if err := b.Set(inodeKey(ino), data); err != nil {
+			return err
+		}
+		for idx, value := range chunks {
+			if err := b.Set(chunkKey(ino, idx), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return b.Set(e.key(), []byte(strconv.FormatUint(ino, 10)))
+	})
+}
+
+// lost moves the inode ino, which is out of the tree and of the trash, to
+// the trash with what is below it
+func (f *fsck) lost(ino uint64) {
+	i := f.inodes[ino]
+	i.reached = true
+	e := TrashEntry{Ino: ino, Path: fmt.Sprint("/lost-", ino), Time: time.Now(), Size: i.attr.Size,
+		Dir: i.isDir(), Process: "fsck"}
+	f.problem(FsckOrphan, string(inodeKey(ino)), "inode out of the tree", "moved to the trash as "+e.Path, func(b Batch) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Set(trashKey(ino), data)
+	})
+	if i.isDir() {
+		f.walk(ino)
+	}
+}
+
+func (f *fsck) allocIno() uint64 {
+	ino := f.next
+	f.next++
+	return ino
+}
+
+// checkRefs writes the counts of the data that is referred to and drops the
+// rest
+func (f *fsck) checkRefs() {
+	hashes := map[string]bool{}
+	for hash := range f.data {
+		hashes[hash] = true
+	}
+	for hash := range f.refs {
+		hashes[hash] = true
+	}
+	for hash := range hashes {
+		count := f.counted[hash]
+		d, stored := f.data[hash]
+		ref, counted := f.refs[hash]
+		if count == 0 {
+			detail := "chunk data no chunk refers to"
+			if !stored {
+				detail = "reference count of missing chunk data"
+			}
+			if stored {
+				f.drop(FsckOrphan, dataKey(hash), detail)
+			}
+			if counted {
+				f.drop(FsckOrphan, refKey(hash), detail)
+			}
+			continue
+		}
+		if counted && ref.count == count && ref.size == d.size && ref.stored == d.stored {
+			continue
+		}
+		detail := fmt.Sprint("counted ", count, " references, recorded ", ref.count)
+		if !counted {
+			detail = fmt.Sprint("counted ", count, " references, none recorded")
+		}
+		value := []byte(fmt.Sprint(count, " ", d.size, " ", d.stored))
+		f.set(FsckRefCount, refKey(hash), detail, "count rewritten", value)
+	}
+}
+
+// checkNextIno makes sure the next inode number is not in use, or a new file
+// would share it
+func (f *fsck) checkNextIno() {
+	next := f.maxIno + 1
+	if next <= rootIno {
+		next = rootIno + 1
+	}
+	switch {
+	case f.next == 0:
+		// a store without the counter starts after the highest inode
+	case f.next < next:
+		f.set(FsckDuplicate, nextInoKey, fmt.Sprint("next inode number ", f.next, " is in use, inodes go up to ", f.maxIno),
+			fmt.Sprint("set to ", next), []byte(strconv.FormatUint(next, 10)))
+	default:
+		return
+	}
+	f.next = next
+}
@@ -0,0 +1,128 @@
+package securefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFsck(t *testing.T) {
+	raw := NewMemStorage()
+	store := NewSealedStorage(raw, bytes.Repeat([]byte{1}, 32))
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	content := strings.Repeat("lost and found ", 5000)
+	root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{})
+	dir, _ := root.GetChildNode("dir")
+	_, fh, _, _ := dir.Create(ctx, "a", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte(content), 0)
+	fh.(*BoxFile).Release(ctx)
+	_, fh, _, _ = root.Create(ctx, "b", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte("bee"), 0)
+	fh.(*BoxFile).Release(ctx)
+	root.Close()
+
+	if report, err := checkStore(raw, store, false); err != nil || len(report.Problems) != 0 {
+		t.Fatal("clean store:", report, err)
+	}
+
+	b, _ := root.GetChildNode("b")
+	hash, _ := store.Get(chunkKey(b.Attr.Ino, 0))
+	version, _ := json.Marshal(Version{Seq: 1, Chunks: []string{string(hash)}})
+	raw.Del(direntKey(rootIno, "dir"))
+	store.Set(direntKey(rootIno, "copy"), []byte(strconv.FormatUint(b.Attr.Ino, 10)))
+	store.Set(chunkKey(b.Attr.Ino, 1), hash)
+	ref, _ := readRef(store, string(hash))
+	store.Set(refKey(string(hash)), []byte(fmt.Sprint(ref.count+5, " ", ref.size, " ", ref.stored)))
+	store.Set(nextInoKey, []byte("2"))
+	store.Set(versionKey(999, 1), version)
+	store.Set(dataKey("00ff"), encodeChunk([]byte("nothing refers to it")))
+	raw.Set(inodeKey(500), []byte("garbage"))
+
+	report, err := checkStore(raw, store, false)
+	if err != nil {
+		t.Fatal("checkStore:", err)
+	}
+	kinds := map[string]int{}
+	for _, p := range report.Problems {
+		if p.Repair != "" {
+			t.Fatal("repaired without repair: ", p)
+		}
+		kinds[p.Kind]++
+	}
+	for _, kind := range []string{FsckUnreadable, FsckOrphan, FsckSize, FsckDuplicate, FsckRefCount} {
+		if kinds[kind] == 0 {
+			t.Fatal("no ", kind, " problem in ", report)
+		}
+	}
+	if again, _ := checkStore(raw, store, false); len(again.Problems) != len(report.Problems) {
+		t.Fatal("the check changed the store:", again)
+	}
+
+	report, err = checkStore(raw, store, true)
+	if err != nil || report.Repaired() != len(report.Problems) {
+		t.Fatal("repair:", report, err)
+	}
+	if report, _ := checkStore(raw, store, false); len(report.Problems) != 0 {
+		t.Fatal("left after repair:", report)
+	}
+
+	// the copy has content of its own, the lost directory is in the trash
+	root, _ = NewRootBoxInode(store)
+	b, _ = root.GetChildNode("b")
+	cp, err := root.GetChildNode("copy")
+	if err != nil || cp.Attr.Ino == b.Attr.Ino || b.Attr.Size != 3 || fileContent(store, cp) != fileContent(store, b) {
+		t.Fatal("duplicate inode repair:", err)
+	}
+	entries, _ := root.Trash()
+	if len(entries) != 1 || !entries[0].Dir {
+		t.Fatal("lost directory:", entries)
+	}
+	if err := root.RestoreTrash(entries[0].Ino, "dir"); err != nil {
+		t.Fatal("RestoreTrash:", err)
+	}
+	a, err := root.Resolve("/dir/a")
+	if err != nil || fileContent(store, a) != content {
+		t.Fatal("restored lost file:", err)
+	}
+	if s, _ := ReadStats(store); s.Bytes != uint64(len(content))+6 || s.UniqueBytes != uint64(len(content))+3 {
+		t.Fatal("stats after repair:", s)
+	}
+}
+
+func TestFsckBlobDir(t *testing.T) {
+	dir := t.TempDir()
+	master := bytes.Repeat([]byte{1}, 32)
+	b, _ := OpenBlobDir(dir, master)
+	defer b.Close()
+	store := NewSealedStorage(b, master)
+	root, _ := NewRootBoxInode(store)
+	root.Close()
+
+	// written by a batch that did not get to its objects
+	leaked := blobName([]byte("leaked"))
+	writeFileAtomic(b.path("blobs", leaked), []byte("leaked"))
+	// a blob the sync tool did not bring
+	b.Set([]byte("i/9"), []byte("gone"))
+	os.Remove(b.path("blobs", blobName([]byte("gone"))))
+
+	report, err := checkStore(b, store, true)
+	if err != nil || len(report.Problems) != 2 || report.Repaired() != 2 {
+		t.Fatal("repair:", report, err)
+	}
+	if _, err := os.Stat(b.path("blobs", leaked)); err == nil {
+		t.Fatal("leaked blob left")
+	}
+	if report, _ := checkStore(b, store, false); len(report.Problems) != 0 {
+		t.Fatal("left after repair:", report)
+	}
+}
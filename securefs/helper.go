@@ -1,6 +1,7 @@
 package securefs
 
 import (
+	"errors"
 	"os"
 	"syscall"
 
@@ -45,3 +46,12 @@ func (d *DirEntryReader) Next() (fuse.DirEntry, syscall.Errno) {
 }
 func (d *DirEntryReader) Close() {
 }
+
+// storeErrno is what a file operation returns when the store fails, nothing
+// of the operation was applied
+func storeErrno(err error) syscall.Errno {
+	if errors.Is(err, os.ErrNotExist) {
+		return syscall.ENOENT
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,19 @@
+package securefs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// unix nano time of the last allowed access to the vault
+var lastAccess atomic.Int64
+
+// Touch records an access to the vault, called for every allowed operation
+func Touch() {
+	lastAccess.Store(timeNow().UnixNano())
+}
+
+// IdleTime is the time since the last access to the vault
+func IdleTime() time.Duration {
+	return timeNow().Sub(time.Unix(0, lastAccess.Load()))
+}
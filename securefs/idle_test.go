@@ -0,0 +1,22 @@
+package securefs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleTime(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	Touch()
+	now = now.Add(5 * time.Minute)
+	if IdleTime() != 5*time.Minute {
+		t.Fatal("idle time:", IdleTime())
+	}
+	Touch()
+	if IdleTime() != 0 {
+		t.Fatal("idle time after access:", IdleTime())
+	}
+}
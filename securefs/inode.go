@@ -0,0 +1,156 @@
+package securefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inode number of the root directory, the first one go-fuse hands out
+const rootIno = 1
+
+// next inode number to allocate
+var nextInoKey = []byte("#nextino")
+
+// inodeKey is where the attributes of the inode ino are stored
+func inodeKey(ino uint64) []byte {
+	return []byte("i/" + strconv.FormatUint(ino, 10))
+}
+
+// direntPrefix is the start of the entries of the directory ino, each one
+// holds the inode number of the child
+func direntPrefix(ino uint64) []byte {
+	return []byte("d/" + strconv.FormatUint(ino, 10) + "/")
+}
+
+func direntKey(parent uint64, name string) []byte {
+	return append(direntPrefix(parent), name...)
+}
+
+func (n *BoxInode) isDir() bool {
+	return n.Attr.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// allocIno returns a new inode number, the counter is saved before the
+// number is used so it is never handed out twice
+func (n *BoxInode) allocIno() (uint64, error) {
+	r := n.root
+	r.inoMu.Lock()
+	defer r.inoMu.Unlock()
+
+	ino := r.nextIno
+	err := n.store().Set(nextInoKey, []byte(strconv.FormatUint(ino+1, 10)))
+	if err != nil {
+		return 0, err
+	}
+	r.nextIno++
+	return ino, nil
+}
+
+// loadNextIno reads the counter of the root r, or starts after the highest
+// inode record
+func (r *BoxInode) loadNextIno() error {
+	data, err := r.storage.Get(nextInoKey)
+	if err != nil {
+		return err
+	}
+	if len(data) != 0 {
+		r.nextIno, err = strconv.ParseUint(string(data), 10, 64)
+		return err
+	}
+
+	r.nextIno = rootIno + 1
+	return r.storage.Iterate([]byte("i/"), func(key []byte, value []byte) error {
+		ino, err := strconv.ParseUint(string(key[2:]), 10, 64)
+		if err == nil && ino >= r.nextIno {
+			r.nextIno = ino + 1
+		}
+		return nil
+	})
+}
+
+// saveAttr writes the inode record of n
+func (n *BoxInode) saveAttr(b Batch) error {
+	data, err := json.Marshal(n.Attr)
+	if err != nil {
+		return err
+	}
+	return b.Set(inodeKey(n.Attr.Ino), data)
+}
+
+// saveEntry writes the inode record of n and its entry in the parent
+func (n *BoxInode) saveEntry(b Batch) error {
+	if err := n.saveAttr(b); err != nil {
+		return err
+	}
+	return b.Set(direntKey(n.parent.Attr.Ino, n.Name), []byte(strconv.FormatUint(n.Attr.Ino, 10)))
+}
+
+// loadChildren reads the entries of the directory n the first time they are
+// needed
+func (n *BoxInode) loadChildren() error {
+	n.childMu.Lock()
+	defer n.childMu.Unlock()
+	if n.loaded || n.root == nil || n.root.storage == nil {
+		return nil
+	}
+
+	store := n.store()
+	prefix := direntPrefix(n.Attr.Ino)
+	children := map[string]*BoxInode{}
+	err := store.Iterate(prefix, func(key []byte, value []byte) error {
+		name := string(bytes.TrimPrefix(key, prefix))
+		ino, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			log.Error("entry ", name, " of inode ", n.Attr.Ino, " corrupt:", err)
+			return nil
+		}
+		data, err := store.Get(inodeKey(ino))
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			log.Error("entry ", name, " of inode ", n.Attr.Ino, " has no inode ", ino)
+			return nil
+		}
+		c := &BoxInode{Name: name, parent: n, root: n.root}
+		if err := json.Unmarshal(data, &c.Attr); err != nil {
+			return err
+		}
+		children[name] = c
+		return nil
+	})
+	if err != nil {
+		log.Error("load dir ", n.Path(), " error:", err)
+		return err
+	}
+
+	if n.ChildrenNode == nil {
+		n.ChildrenNode = make(map[string]*BoxInode)
+	}
+	for name, c := range children {
+		if _, ok := n.ChildrenNode[name]; !ok {
+			n.ChildrenNode[name] = c
+		}
+	}
+	n.loaded = true
+	return nil
+}
+
+// walk calls fn for n and every node below it that is loaded, the children
+// in name order so every walk of a tree goes the same way
+func (n *BoxInode) walk(fn func(c *BoxInode)) {
+	fn(n)
+	names := make([]string, 0, len(n.ChildrenNode))
+	for name := range n.ChildrenNode {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n.ChildrenNode[name].walk(fn)
+	}
+}
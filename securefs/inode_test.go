@@ -0,0 +1,362 @@
+package securefs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func testContext() context.Context {
+	caller := fuse.Caller{}
+	caller.Pid = uint32(os.Getpid())
+	return fuse.NewContext(context.TODO(), &caller)
+}
+
+func TestInodeRenameDir(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	if _, errno := root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{}); errno != fs.OK {
+		t.Fatal("Mkdir:", errno)
+	}
+	dir, _ := root.GetChildNode("dir")
+	_, fh, _, errno := dir.Create(ctx, "a.txt", 0, 0644, &fuse.EntryOut{})
+	if errno != fs.OK {
+		t.Fatal("Create:", errno)
+	}
+	fh.(*BoxFile).Write(ctx, []byte("content"), 0)
+	fh.(*BoxFile).Release(ctx)
+
+	if errno := root.Rename(ctx, "dir", root, "moved", 0); errno != fs.OK {
+		t.Fatal("Rename:", errno)
+	}
+
+	loaded, err := NewRootBoxInode(store)
+	if err != nil {
+		t.Fatal("reload:", err)
+	}
+	moved, err := loaded.GetChildNode("moved")
+	if err != nil {
+		t.Fatal("renamed dir not found:", err)
+	}
+	file, err := moved.GetChildNode("a.txt")
+	if err != nil {
+		t.Fatal("file of the renamed dir not found:", err)
+	}
+	if loaded.Attr.Ino != rootIno || moved.Attr.Ino == file.Attr.Ino || file.Attr.Ino <= rootIno {
+		t.Fatal("inode numbers:", loaded.Attr.Ino, moved.Attr.Ino, file.Attr.Ino)
+	}
+	if data := fileContent(store, file); data != "content" {
+		t.Fatal("content lost after dir rename:", data)
+	}
+
+	// numbers are never reused after a reload
+	fs.NewNodeFS(loaded, &fs.Options{})
+	loaded.Mkdir(ctx, "other", 0755, &fuse.EntryOut{})
+	other, _ := loaded.GetChildNode("other")
+	if other.Attr.Ino <= file.Attr.Ino {
+		t.Fatal("inode reused:", other.Attr.Ino)
+	}
+}
+
+func TestAssignInodes(t *testing.T) {
+	store := NewMemStorage()
+
+	// a layout 1 tree, content under the path
+	old := &BoxInode{}
+	old.Attr.Mode = 0755 | syscall.S_IFDIR
+	dir := old.AddChildNode("dir")
+	dir.Attr.Mode = 0755 | syscall.S_IFDIR
+	file := dir.AddChildNode("a.txt")
+	file.Attr.Mode = 0644
+	file.Attr.Size = 7
+	tree, _ := json.Marshal(old)
+	store.Set([]byte("-"), tree)
+	store.Set([]byte("/dir/a.txt"), []byte("content"))
+	store.Set(layoutKey, []byte("1"))
+
+	if err := upgradeLayout(store, store); err != nil {
+		t.Fatal("upgradeLayout:", err)
+	}
+
+	root, err := NewRootBoxInode(store)
+	if err != nil {
+		t.Fatal("NewRootBoxInode:", err)
+	}
+	d, _ := root.GetChildNode("dir")
+	file, _ = d.GetChildNode("a.txt")
+	if file == nil || file.Attr.Ino == 0 || file.Attr.Ino == d.Attr.Ino {
+		t.Fatal("inodes not assigned")
+	}
+	if data := fileContent(store, file); data != "content" {
+		t.Fatal("content not moved:", data)
+	}
+	if v, _ := store.Get([]byte("/dir/a.txt")); len(v) != 0 {
+		t.Fatal("path key left")
+	}
+	if root.nextIno <= file.Attr.Ino {
+		t.Fatal("next inode:", root.nextIno)
+	}
+}
+
+// crashAfter fails every write after the first ok ones, like a process that
+// stops in the middle of an upgrade, a negative ok never fails
+type crashAfter struct {
+	*MemStorage
+	ok int
+}
+
+func (s *crashAfter) write() error {
+	if s.ok == 0 {
+		return errors.New("crashed")
+	}
+	s.ok--
+	return nil
+}
+
+func (s *crashAfter) Set(key []byte, value []byte) error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	return s.MemStorage.Set(key, value)
+}
+
+func (s *crashAfter) Del(key []byte) error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	return s.MemStorage.Del(key)
+}
+
+func (s *crashAfter) Batch(fn func(b Batch) error) error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	return s.MemStorage.Batch(fn)
+}
+
+func TestAssignInodesInterrupted(t *testing.T) {
+	layoutBatch = 2
+	defer func() { layoutBatch = 256 }()
+
+	for crash := 0; ; crash++ {
+		store := &crashAfter{MemStorage: NewMemStorage(), ok: -1}
+
+		// a layout 1 tree, content under the path
+		old := &BoxInode{}
+		old.Attr.Mode = 0755 | syscall.S_IFDIR
+		for i := 0; i < 3; i++ {
+			dir := old.AddChildNode(fmt.Sprint("dir", i))
+			dir.Attr.Mode = 0755 | syscall.S_IFDIR
+			for j := 0; j < 3; j++ {
+				name := fmt.Sprint("f", j)
+				file := dir.AddChildNode(name)
+				file.Attr.Mode = 0644
+				file.Attr.Size = uint64(len(file.Path()))
+				store.Set([]byte(file.Path()), []byte(file.Path()))
+			}
+		}
+		tree, _ := json.Marshal(old)
+		store.Set(treeKey, tree)
+		store.Set(layoutKey, []byte("1"))
+
+		store.ok = crash
+		err := upgradeLayout(store, store)
+		store.ok = -1
+		finished := err == nil
+		if err != nil {
+			if err := upgradeLayout(store, store); err != nil {
+				t.Fatal("upgradeLayout after a crash at", crash, ":", err)
+			}
+		}
+
+		root, err := NewRootBoxInode(store)
+		if err != nil {
+			t.Fatal("NewRootBoxInode:", err)
+		}
+		inos := map[uint64]bool{}
+		for i := 0; i < 3; i++ {
+			dir, _ := root.GetChildNode(fmt.Sprint("dir", i))
+			for j := 0; j < 3; j++ {
+				file, _ := dir.GetChildNode(fmt.Sprint("f", j))
+				if file == nil || inos[file.Attr.Ino] {
+					t.Fatal("inodes after a crash at", crash)
+				}
+				inos[file.Attr.Ino] = true
+				if data := fileContent(store, file); data != file.Path() {
+					t.Fatal("content after a crash at", crash, ":", data)
+				}
+			}
+		}
+		if v, _ := store.Get(treeKey); len(v) != 0 {
+			t.Fatal("tree left after a crash at", crash)
+		}
+		if finished {
+			break
+		}
+	}
+}
+
+func TestUpgradeInterrupted(t *testing.T) {
+	layoutBatch = 2
+	defer func() { layoutBatch = 256 }()
+	big := bytes.Repeat([]byte("0123456789"), 3*chunkSize/10+1)
+
+	for crash := 0; ; crash++ {
+		raw := &crashAfter{MemStorage: NewMemStorage(), ok: -1}
+		store := NewSealedStorage(raw, bytes.Repeat([]byte{1}, 32))
+
+		// a layout 0 store, plaintext tree and content under the path
+		contents := map[string][]byte{"/a": []byte("a"), "/dir/b": []byte("b"), "/dir/big": big}
+		old := &BoxInode{}
+		old.Attr.Mode = 0755 | syscall.S_IFDIR
+		dir := old.AddChildNode("dir")
+		dir.Attr.Mode = 0755 | syscall.S_IFDIR
+		for _, path := range []string{"/a", "/dir/b", "/dir/big"} {
+			parent := old
+			if strings.HasPrefix(path, "/dir/") {
+				parent = dir
+			}
+			file := parent.AddChildNode(path[strings.LastIndex(path, "/")+1:])
+			file.Attr.Mode = 0644
+			file.Attr.Size = uint64(len(contents[path]))
+			raw.Set([]byte(path), contents[path])
+		}
+		tree, _ := json.Marshal(old)
+		raw.Set(treeKey, tree)
+
+		raw.ok = crash
+		err := upgradeLayout(raw, store)
+		raw.ok = -1
+		finished := err == nil
+		if err != nil {
+			if err := upgradeLayout(raw, store); err != nil {
+				t.Fatal("upgradeLayout after a crash at", crash, ":", err)
+			}
+		}
+
+		root, err := NewRootBoxInode(store)
+		if err != nil {
+			t.Fatal("NewRootBoxInode after a crash at", crash, ":", err)
+		}
+		for path, data := range contents {
+			n := root
+			for _, name := range strings.Split(path[1:], "/") {
+				n, _ = n.GetChildNode(name)
+				if n == nil {
+					t.Fatal(path, "lost after a crash at", crash)
+				}
+			}
+			if got := fileContent(store, n); got != string(data) {
+				t.Fatal(path, "content after a crash at", crash)
+			}
+		}
+		if report, err := checkStore(raw, store, false); err != nil || len(report.Problems) != 0 {
+			t.Fatal("fsck after a crash at", crash, ":", err, report.Problems)
+		}
+		if finished {
+			break
+		}
+	}
+}
+
+func TestSplitTree(t *testing.T) {
+	store := NewMemStorage()
+
+	// a layout 2 tree
+	old := &BoxInode{}
+	old.Attr.Ino = rootIno
+	old.Attr.Mode = 0755 | syscall.S_IFDIR
+	dir := old.AddChildNode("dir")
+	dir.Attr.Ino = 2
+	dir.Attr.Mode = 0755 | syscall.S_IFDIR
+	file := dir.AddChildNode("a.txt")
+	file.Attr.Ino = 3
+	file.Attr.Mode = 0644
+	file.Attr.Size = 7
+	tree, _ := json.Marshal(old)
+	store.Set(treeKey, tree)
+	store.Set(contentKey(3), []byte("content"))
+	store.Set(nextInoKey, []byte("4"))
+	store.Set(layoutKey, []byte("2"))
+
+	if err := upgradeLayout(store, store); err != nil {
+		t.Fatal("upgradeLayout:", err)
+	}
+	if v, _ := store.Get(treeKey); len(v) != 0 {
+		t.Fatal("tree left")
+	}
+
+	root, err := NewRootBoxInode(store)
+	if err != nil {
+		t.Fatal("NewRootBoxInode:", err)
+	}
+	if len(root.ChildrenNode) != 0 {
+		t.Fatal("directories loaded before lookup")
+	}
+	d, err := root.GetChildNode("dir")
+	if err != nil || d.Attr.Ino != 2 {
+		t.Fatal("dir:", err)
+	}
+	if len(d.ChildrenNode) != 0 {
+		t.Fatal("dir loaded before lookup")
+	}
+	f, err := d.GetChildNode("a.txt")
+	if err != nil || f.Attr.Ino != 3 || f.Attr.Size != 7 {
+		t.Fatal("file:", err)
+	}
+	if root.nextIno != 4 {
+		t.Fatal("next inode:", root.nextIno)
+	}
+	if data := fileContent(store, f); data != "content" {
+		t.Fatal("content:", data)
+	}
+}
+
+func TestRmdirNotEmpty(t *testing.T) {
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{})
+	dir, _ := root.GetChildNode("dir")
+	dir.Mkdir(ctx, "sub", 0755, &fuse.EntryOut{})
+
+	// a fresh root has not loaded dir yet
+	loaded, _ := NewRootBoxInode(store)
+	if errno := loaded.Rmdir(ctx, "dir"); errno != syscall.ENOTEMPTY {
+		t.Fatal("Rmdir of a non-empty dir:", errno)
+	}
+	d, _ := loaded.GetChildNode("dir")
+	if errno := d.Rmdir(ctx, "sub"); errno != fs.OK {
+		t.Fatal("Rmdir sub:", errno)
+	}
+	if errno := loaded.Rmdir(ctx, "dir"); errno != fs.OK {
+		t.Fatal("Rmdir:", errno)
+	}
+
+	left := 0
+	store.Iterate([]byte("d/"), func(key []byte, value []byte) error {
+		left++
+		return nil
+	})
+	store.Iterate([]byte("i/"), func(key []byte, value []byte) error {
+		left++
+		return nil
+	})
+	if left != 1 {
+		t.Fatal("records left:", left)
+	}
+}
@@ -0,0 +1,216 @@
+package securefs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SlotPassword = "password"
+	SlotKeyfile  = "keyfile"
+	SlotRecovery = "recovery"
+)
+
+const recoveryKeyLen = 20
+
+// KeySlot wraps the master key with one credential
+type KeySlot struct {
+	ID         int       `json:"id"`
+	Type       string    `json:"type"`
+	Name       string    `json:"name,omitempty"`
+	Created    time.Time `json:"created"`
+	Kdf        KdfParams `json:"kdf"`
+	WrappedKey []byte    `json:"wrappedKey"`
+}
+
+func (s *KeySlot) String() string {
+	name := s.Name
+	if name == "" {
+		name = "-"
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s", s.ID, s.Type, name, s.Created.Format("2006-01-02 15:04:05"))
+}
+
+// slotSecret turns what the user presents into the input of the kdf
+func slotSecret(slotType string, raw []byte) []byte {
+	switch slotType {
+	case SlotPassword:
+		return raw
+	case SlotKeyfile:
+		if len(raw) == 0 {
+			return nil
+		}
+		sum := sha256.Sum256(raw)
+		return sum[:]
+	case SlotRecovery:
+		return normalizeRecoveryKey(raw)
+	}
+	return nil
+}
+
+func (c Credentials) secretFor(slotType string) []byte {
+	if slotType == SlotKeyfile {
+		return slotSecret(slotType, c.Keyfile)
+	}
+	if len(c.Passwd) == 0 {
+		return nil
+	}
+	return slotSecret(slotType, c.Passwd)
+}
+
+func (s *KeySlot) wrap(master []byte, secret []byte) error {
+	kdf, err := newKdfParams()
+	if err != nil {
+		return err
+	}
+	kek, err := kdf.DeriveKey(secret)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(kek, master)
+	if err != nil {
+		return err
+	}
+	s.Kdf = kdf
+	s.WrappedKey = wrapped
+	return nil
+}
+
+func (s *KeySlot) unwrap(secret []byte) ([]byte, error) {
+	kek, err := s.Kdf.DeriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(kek, s.WrappedKey)
+}
+
+func (h *VaultHeader) slot(id int) *KeySlot {
+	for i := range h.Slots {
+		if h.Slots[i].ID == id {
+			return &h.Slots[i]
+		}
+	}
+	return nil
+}
+
+// AddSlot wraps master with raw, a password, keyfile content or recovery key
+func (h *VaultHeader) AddSlot(master []byte, slotType string, name string, raw []byte) (*KeySlot, error) {
+	secret := slotSecret(slotType, raw)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("invalid %s credential", slotType)
+	}
+	if slotType != SlotPassword {
+		defer cfg.Wipe(secret)
+	}
+
+	slot := KeySlot{Type: slotType, Name: name, Created: time.Now()}
+	for _, s := range h.Slots {
+		if s.ID >= slot.ID {
+			slot.ID = s.ID + 1
+		}
+	}
+	err := slot.wrap(master, secret)
+	if err != nil {
+		return nil, err
+	}
+	h.Slots = append(h.Slots, slot)
+	return &h.Slots[len(h.Slots)-1], nil
+}
+
+func (h *VaultHeader) RevokeSlot(id int) error {
+	for i, s := range h.Slots {
+		if s.ID != id {
+			continue
+		}
+		if len(h.Slots) == 1 {
+			return errors.New("cannot revoke the last key slot")
+		}
+		h.Slots = append(h.Slots[:i], h.Slots[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("key slot %d not found", id)
+}
+
+// NewRecoveryKey generates a printable key like XXXX-XXXX-...-XXXX
+func NewRecoveryKey() (string, error) {
+	raw := make([]byte, recoveryKeyLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	groups := []string{}
+	for i := 0; i < len(enc); i += 4 {
+		groups = append(groups, enc[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryKey accepts the key in any case and with any grouping,
+// returns nil if the input cannot be a recovery key
+func normalizeRecoveryKey(raw []byte) []byte {
+	s := strings.ToUpper(string(raw))
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	data, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil || len(data) != recoveryKeyLen {
+		return nil
+	}
+	return []byte(s)
+}
+
+func ListVaultKeySlots() ([]KeySlot, error) {
+	h, err := LoadVaultHeader()
+	if err != nil {
+		return nil, err
+	}
+	return h.Slots, nil
+}
+
+// AddVaultKeySlot unlocks the vault with c and adds a slot for raw
+func AddVaultKeySlot(c Credentials, slotType string, name string, raw []byte) (*KeySlot, error) {
+	h, master, _, err := openVaultHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	defer cfg.Wipe(master)
+	slot, err := h.AddSlot(master, slotType, name, raw)
+	if err != nil {
+		return nil, err
+	}
+	err = h.Save()
+	if err != nil {
+		return nil, err
+	}
+	log.Info("vault: add ", slotType, " key slot ", slot.ID)
+	cfg.Audit.WithField("vault", vaultName()).Info("add ", slotType, " key slot ", slot.ID)
+	return slot, nil
+}
+
+// RevokeVaultKeySlot unlocks the vault with c and removes slot id
+func RevokeVaultKeySlot(c Credentials, id int) error {
+	h, master, _, err := openVaultHeader(c)
+	if err != nil {
+		return err
+	}
+	cfg.Wipe(master)
+	err = h.RevokeSlot(id)
+	if err != nil {
+		return err
+	}
+	err = h.Save()
+	if err != nil {
+		return err
+	}
+	log.Info("vault: revoke key slot ", id)
+	cfg.Audit.WithField("vault", vaultName()).Info("revoke key slot ", id)
+	return nil
+}
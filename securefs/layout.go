@@ -0,0 +1,469 @@
+package securefs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// layout of the store, upgraded when the vault is opened
+// 0: plaintext values
+// 1: values sealed with a per-file key
+// 2: content keyed by inode number instead of path
+// 3: one record per inode and directory entry instead of the tree in "-"
+// 4: content in chunks instead of one value per file
+// 5: chunks stored once per keyed hash with a reference count
+// 6: chunk data starts with its codec
+const layoutVersion = 6
+
+// the whole tree of layouts before 3
+var treeKey = []byte("-")
+
+var layoutKey = []byte("#layout")
+
+func layout(raw Storage, sealed Storage) (int, error) {
+	data, err := sealed.Get(layoutKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		// no layout key: an empty store is new, anything else predates it
+		root, err := raw.Get(treeKey)
+		if err != nil {
+			return 0, err
+		}
+		if len(root) == 0 {
+			return layoutVersion, nil
+		}
+		return 0, nil
+	}
+	return strconv.Atoi(string(data))
+}
+
+// upgradeLayout brings the store to layoutVersion, raw is the storage below
+// sealed. Every step writes the layout it brings the store to with its last
+// batch, an interrupted upgrade starts again at the step it stopped in.
+func upgradeLayout(raw Storage, sealed Storage) error {
+	version, err := layout(raw, sealed)
+	if err != nil {
+		log.Error("read store layout error:", err)
+		return err
+	}
+
+	if version < 1 {
+		log.Warn("layout: seal plaintext values")
+		err = sealAll(raw, sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 2 {
+		log.Warn("layout: assign inode numbers")
+		err = assignInodes(sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 3 {
+		log.Warn("layout: split the tree into inode records")
+		err = splitTree(sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 4 {
+		log.Warn("layout: split the content into chunks")
+		err = splitContent(sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 5 {
+		log.Warn("layout: deduplicate the chunks")
+		err = hashChunks(sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 6 {
+		log.Warn("layout: mark the codec of the chunks")
+		err = markCodecs(sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sealed.Set(layoutKey, []byte(strconv.Itoa(layoutVersion)))
+}
+
+// sealAll seals the plaintext values of raw. A value that already opens was
+// sealed by a run that did not get to the end, it is not sealed twice.
+func sealAll(raw Storage, sealed Storage) error {
+	s, ok := sealed.(*sealedStorage)
+	if !ok {
+		return errors.New("sealAll needs a sealed store")
+	}
+	keys := [][]byte{}
+	err := raw.Iterate(nil, func(key []byte, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := &layoutWriter{store: sealed, version: 1}
+	for _, key := range keys {
+		value, err := raw.Get(key)
+		if err != nil {
+			return err
+		}
+		if s.sealer.opens(key, value) {
+			continue
+		}
+		if err := w.Set(key, value); err != nil {
+			return err
+		}
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return w.done()
+}
+
+// a layout step writes at most layoutBatch records or layoutBytes bytes in a
+// batch, badger refuses a transaction much larger
+var (
+	layoutBatch = 256
+	layoutBytes = 4 << 20
+)
+
+// layoutWriter collects the writes of a layout step and stores them in
+// batches of whole items, the last one with the layout the step brings the
+// store to
+type layoutWriter struct {
+	store   Storage
+	version int
+	writes  []memWrite
+	size    int
+}
+
+func (w *layoutWriter) Set(key []byte, value []byte) error {
+	w.writes = append(w.writes, memWrite{key: string(key), value: append([]byte{}, value...)})
+	w.size += len(key) + len(value)
+	return nil
+}
+
+func (w *layoutWriter) Del(key []byte) error {
+	w.writes = append(w.writes, memWrite{key: string(key), del: true})
+	w.size += len(key)
+	return nil
+}
+
+// next ends an item, the writes so far are stored once they fill a batch
+func (w *layoutWriter) next() error {
+	if len(w.writes) < layoutBatch && w.size < layoutBytes {
+		return nil
+	}
+	return w.write(false)
+}
+
+// done stores the writes left and the layout
+func (w *layoutWriter) done() error {
+	return w.write(true)
+}
+
+func (w *layoutWriter) write(last bool) error {
+	err := w.store.Batch(func(b Batch) error {
+		for _, m := range w.writes {
+			var err error
+			if m.del {
+				err = b.Del([]byte(m.key))
+			} else {
+				err = b.Set([]byte(m.key), m.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if last {
+			return b.Set(layoutKey, []byte(strconv.Itoa(w.version)))
+		}
+		return nil
+	})
+	w.writes = nil
+	w.size = 0
+	return err
+}
+
+// contentKey is where layouts 2 and 3 store the content of the file ino
+func contentKey(ino uint64) []byte {
+	return []byte("f/" + strconv.FormatUint(ino, 10))
+}
+
+// assignInodes numbers every node of the tree and moves the content of the
+// files from their path to their inode. The nodes are numbered in name order,
+// a run after an interrupted one gives them the numbers it gave and skips the
+// files it moved.
+func assignInodes(sealed Storage) error {
+	root, err := loadTree(sealed)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	root.Attr.Ino = rootIno
+	next := uint64(rootIno + 1)
+	files := []*BoxInode{}
+	root.walk(func(n *BoxInode) {
+		if n == root {
+			return
+		}
+		n.Attr.Ino = next
+		next++
+		if !n.isDir() {
+			files = append(files, n)
+		}
+	})
+	tree, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+
+	w := &layoutWriter{store: sealed, version: 2}
+	for _, n := range files {
+		path := []byte(n.Path())
+		data, err := sealed.Get(path)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			moved, err := sealed.Get(contentKey(n.Attr.Ino))
+			if err != nil {
+				return err
+			}
+			if len(moved) != 0 {
+				continue
+			}
+		}
+		if err := w.Set(contentKey(n.Attr.Ino), data); err != nil {
+			return err
+		}
+		if err := w.Del(path); err != nil {
+			return err
+		}
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if err := w.Set(nextInoKey, []byte(strconv.FormatUint(next, 10))); err != nil {
+		return err
+	}
+	if err := w.Set(treeKey, tree); err != nil {
+		return err
+	}
+	return w.done()
+}
+
+// loadTree reads the whole tree of layouts before 3
+func loadTree(sealed Storage) (*BoxInode, error) {
+	data, err := sealed.Get(treeKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	root := &BoxInode{storage: sealed}
+	err = json.Unmarshal(data, root)
+	if err != nil {
+		return nil, err
+	}
+	setParentNode(root, nil, root)
+	return root, nil
+}
+
+func setParentNode(b *BoxInode, parent *BoxInode, root *BoxInode) {
+	b.root = root
+	b.parent = parent
+	b.loaded = true
+
+	for _, v := range b.ChildrenNode {
+		setParentNode(v, b, root)
+	}
+}
+
+// splitTree writes a record for every node and entry of the tree and drops
+// the tree
+func splitTree(sealed Storage) error {
+	root, err := loadTree(sealed)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	root.Attr.Ino = rootIno
+
+	// the tree goes with the last batch, until then the store reads as
+	// layout 2
+	w := &layoutWriter{store: sealed, version: 3}
+	err = root.saveAttr(w)
+	root.walk(func(n *BoxInode) {
+		if err == nil && n != root {
+			err = n.saveEntry(w)
+			if err == nil {
+				err = w.next()
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Del(treeKey); err != nil {
+		return err
+	}
+	return w.done()
+}
+
+// splitContent moves the content of every file to its chunks
+func splitContent(sealed Storage) error {
+	keys := [][]byte{}
+	err := sealed.Iterate([]byte("f/"), func(key []byte, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := &layoutWriter{store: sealed, version: 4}
+	for _, key := range keys {
+		ino, err := strconv.ParseUint(string(key[2:]), 10, 64)
+		if err != nil {
+			log.Warn("layout: skip ", string(key))
+			continue
+		}
+		data, err := sealed.Get(key)
+		if err != nil {
+			return err
+		}
+		// the content is cut whole, the chunks an interrupted run wrote are
+		// overwritten and not read
+		for idx := uint64(0); idx*chunkSize < uint64(len(data)); idx++ {
+			end := (idx + 1) * chunkSize
+			if end > uint64(len(data)) {
+				end = uint64(len(data))
+			}
+			if err := w.Set(chunkKey(ino, idx), data[idx*chunkSize:end]); err != nil {
+				return err
+			}
+			if err := w.next(); err != nil {
+				return err
+			}
+		}
+		if err := w.Del(key); err != nil {
+			return err
+		}
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return w.done()
+}
+
+// hashChunks moves the data of every chunk under its hash, a chunk already
+// moved by an interrupted upgrade is left as is. A batch reads the reference
+// counts the one before it wrote, so every chunk has a batch of its own.
+func hashChunks(sealed Storage) error {
+	key, err := chunkHashKey(sealed)
+	if err != nil {
+		return err
+	}
+	keys := [][]byte{}
+	err = sealed.Iterate([]byte("c/"), func(key []byte, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		data, err := sealed.Get(k)
+		if err != nil {
+			return err
+		}
+		if len(data) == 2*sha256.Size {
+			if ref, err := readRef(sealed, string(data)); err == nil && ref.count > 0 {
+				continue
+			}
+		}
+		refs := &chunkRefs{store: sealed, key: key, delta: map[string]int{}, data: map[string][]byte{}}
+		err = sealed.Batch(func(b Batch) error {
+			if err := b.Set(k, []byte(refs.add(data))); err != nil {
+				return err
+			}
+			return refs.commit(b)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// the chunks moved are skipped, the layout can follow on its own
+	return sealed.Set(layoutKey, []byte("5"))
+}
+
+// markCodecs marks the data of every chunk as raw, the reference counts that
+// have a stored size are done
+func markCodecs(sealed Storage) error {
+	hashes := []string{}
+	err := sealed.Iterate([]byte("r/"), func(key []byte, value []byte) error {
+		if len(strings.Fields(string(value))) == 2 {
+			hashes = append(hashes, string(key[2:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := &layoutWriter{store: sealed, version: 6}
+	for _, hash := range hashes {
+		ref, err := readRef(sealed, hash)
+		if err != nil {
+			return err
+		}
+		data, err := sealed.Get(dataKey(hash))
+		if err != nil {
+			return err
+		}
+		// the data and its count go in the same batch, a count with a
+		// stored size marks the data done
+		stored := append([]byte{codecRaw}, data...)
+		if err := w.Set(dataKey(hash), stored); err != nil {
+			return err
+		}
+		if err := w.Set(refKey(hash), []byte(fmt.Sprint(ref.count, " ", ref.size, " ", len(stored)))); err != nil {
+			return err
+		}
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return w.done()
+}
@@ -14,7 +14,11 @@ import (
 )
 
 func init() {
-	cfg.Cfg.BackupInMemory = true
+	cfg.Cfg.Backup.Memory = true
+	// cheap kdf, the tests derive many keys
+	cfg.Cfg.Vault.KdfTime = 1
+	cfg.Cfg.Vault.KdfMemory = 1024
+	cfg.Cfg.SetPasswd([]byte("test"))
 	err := GetDBInstance().InitDB()
 	if err != nil {
 		fmt.Println("InitDB:", err)
@@ -22,7 +26,9 @@ func init() {
 }
 
 func TestMkdir(t *testing.T) {
-	n := &BoxInode{}
+	n := &BoxInode{storage: NewMemStorage()}
+	n.root = n
+	fs.NewNodeFS(n, &fs.Options{})
 
 	ctx := context.TODO()
 	caller := fuse.Caller{}
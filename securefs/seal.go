@@ -0,0 +1,188 @@
+package securefs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const sealVersion = 1
+
+var fileKeyInfo = []byte("strongbox file key ")
+
+// ErrTampered is returned when a value of the store fails authentication,
+// it was modified or moved under another key
+var ErrTampered = errors.New("value authentication failed")
+
+// sealer encrypts every value of the store with a key derived for its store
+// key, the store key is also the associated data, so values can be neither
+// modified nor swapped between files.
+type sealer struct {
+	mu     sync.RWMutex
+	master []byte
+}
+
+// newSealer keeps a copy of master, the key of the configuration is unmapped
+// when the vault is locked
+func newSealer(master []byte) *sealer {
+	return &sealer{master: append([]byte{}, master...)}
+}
+
+// wipe zeroes the key, nothing is sealed or opened after it
+func (s *sealer) wipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg.Wipe(s.master)
+	s.master = nil
+}
+
+func (s *sealer) fileKey(id []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.master == nil {
+		return nil, errors.New("sealer closed")
+	}
+	info := append(append([]byte{}, fileKeyInfo...), id...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, s.master, nil, info), key)
+	return key, err
+}
+
+// Seal returns version | nonce | ciphertext
+func (s *sealer) Seal(id []byte, plain []byte) ([]byte, error) {
+	key, err := s.fileKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer cfg.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plain)+aead.Overhead())
+	out[0] = sealVersion
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plain, id), nil
+}
+
+func (s *sealer) Open(id []byte, sealed []byte) ([]byte, error) {
+	plain, err := s.open(id, sealed)
+	if err == ErrTampered {
+		log.Errorf("open %s: value does not authenticate", id)
+	}
+	return plain, err
+}
+
+// opens tells whether sealed is a value sealed for id, without the log of a
+// value that does not open
+func (s *sealer) opens(id []byte, sealed []byte) bool {
+	_, err := s.open(id, sealed)
+	return err == nil
+}
+
+func (s *sealer) open(id []byte, sealed []byte) ([]byte, error) {
+	key, err := s.fileKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer cfg.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < 1+aead.NonceSize()+aead.Overhead() || sealed[0] != sealVersion {
+		return nil, ErrTampered
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], id)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plain, nil
+}
+
+// sealedStorage seals every value before it is written to the storage below
+type sealedStorage struct {
+	raw    Storage
+	sealer *sealer
+}
+
+// NewSealedStorage authenticates and encrypts the values of raw with keys
+// derived from master
+func NewSealedStorage(raw Storage, master []byte) Storage {
+	return &sealedStorage{raw: raw, sealer: newSealer(master)}
+}
+
+// wipeSealed wipes the key of a storage returned by NewSealedStorage, when
+// the storage below it is closed
+func wipeSealed(s Storage) {
+	if s, ok := s.(*sealedStorage); ok {
+		s.sealer.wipe()
+	}
+}
+
+func (s *sealedStorage) Get(key []byte) ([]byte, error) {
+	sealed, err := s.raw.Get(key)
+	if err != nil || len(sealed) == 0 {
+		return sealed, err
+	}
+	return s.sealer.Open(key, sealed)
+}
+
+func (s *sealedStorage) Set(key []byte, value []byte) error {
+	sealed, err := s.sealer.Seal(key, value)
+	if err != nil {
+		return err
+	}
+	return s.raw.Set(key, sealed)
+}
+
+func (s *sealedStorage) Del(key []byte) error {
+	return s.raw.Del(key)
+}
+
+type sealedBatch struct {
+	raw    Batch
+	sealer *sealer
+}
+
+func (b *sealedBatch) Set(key []byte, value []byte) error {
+	sealed, err := b.sealer.Seal(key, value)
+	if err != nil {
+		return err
+	}
+	return b.raw.Set(key, sealed)
+}
+
+func (b *sealedBatch) Del(key []byte) error {
+	return b.raw.Del(key)
+}
+
+func (s *sealedStorage) Batch(fn func(b Batch) error) error {
+	return s.raw.Batch(func(b Batch) error {
+		return fn(&sealedBatch{raw: b, sealer: s.sealer})
+	})
+}
+
+func (s *sealedStorage) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	return s.raw.Iterate(prefix, func(key []byte, sealed []byte) error {
+		value, err := s.sealer.Open(key, sealed)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
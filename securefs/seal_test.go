@@ -0,0 +1,111 @@
+package securefs
+
+import (
+	"bytes"
+	"testing"
+
+	cfg "strongbox/configuration"
+)
+
+func TestSealer(t *testing.T) {
+	s := newSealer(bytes.Repeat([]byte{1}, 32))
+
+	plain := []byte("file content")
+	sealed, err := s.Seal([]byte("/a.txt"), plain)
+	if err != nil {
+		t.Fatal("Seal:", err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Fatal("sealed value contains plaintext")
+	}
+
+	opened, err := s.Open([]byte("/a.txt"), sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatal("Open:", err)
+	}
+
+	// moved under another key
+	if _, err := s.Open([]byte("/b.txt"), sealed); err != ErrTampered {
+		t.Fatal("swapped value not detected:", err)
+	}
+
+	// modified
+	sealed[len(sealed)-1] ^= 1
+	if _, err := s.Open([]byte("/a.txt"), sealed); err != ErrTampered {
+		t.Fatal("modified value not detected:", err)
+	}
+
+	// other vault
+	other := newSealer(bytes.Repeat([]byte{2}, 32))
+	sealed, _ = s.Seal([]byte("/a.txt"), plain)
+	if _, err := other.Open([]byte("/a.txt"), sealed); err != ErrTampered {
+		t.Fatal("value of another vault opened:", err)
+	}
+}
+
+func TestSealedStore(t *testing.T) {
+	raw := NewMemStorage()
+	store := NewSealedStorage(raw, bytes.Repeat([]byte{1}, 32))
+
+	err := store.Set([]byte("/sealed.txt"), []byte("content"))
+	if err != nil {
+		t.Fatal("Set:", err)
+	}
+	sealed, _ := raw.Get([]byte("/sealed.txt"))
+	if bytes.Contains(sealed, []byte("content")) {
+		t.Fatal("stored value not sealed")
+	}
+	data, err := store.Get([]byte("/sealed.txt"))
+	if err != nil || string(data) != "content" {
+		t.Fatal("Get:", err)
+	}
+
+	raw.Set([]byte("/swapped.txt"), sealed)
+	if _, err := store.Get([]byte("/swapped.txt")); err != ErrTampered {
+		t.Fatal("swapped value not detected:", err)
+	}
+}
+
+func TestSealedStoreKeyCopy(t *testing.T) {
+	// the key of the configuration is unmapped on lock while the store
+	// is still closing
+	secret := cfg.NewSecret(bytes.Repeat([]byte{1}, 32))
+	store := NewSealedStorage(NewMemStorage(), secret.Bytes())
+	secret.Wipe()
+
+	if err := store.Set([]byte("/a.txt"), []byte("content")); err != nil {
+		t.Fatal("Set after the secret was wiped:", err)
+	}
+	if data, err := store.Get([]byte("/a.txt")); err != nil || string(data) != "content" {
+		t.Fatal("Get after the secret was wiped:", err)
+	}
+
+	wipeSealed(store)
+	if err := store.Set([]byte("/b.txt"), []byte("content")); err == nil {
+		t.Fatal("sealed with a wiped key")
+	}
+	if _, err := store.Get([]byte("/a.txt")); err == nil {
+		t.Fatal("opened with a wiped key")
+	}
+}
+
+func TestSealAllResume(t *testing.T) {
+	raw := NewMemStorage()
+	store := NewSealedStorage(raw, bytes.Repeat([]byte{1}, 32))
+	raw.Set([]byte("/a.txt"), []byte("first"))
+	raw.Set([]byte("/b.txt"), []byte("second"))
+
+	// a run that stopped after the first value
+	store.Set([]byte("/a.txt"), []byte("first"))
+	if err := sealAll(raw, store); err != nil {
+		t.Fatal("sealAll:", err)
+	}
+	if err := sealAll(raw, store); err != nil {
+		t.Fatal("sealAll again:", err)
+	}
+	for key, want := range map[string]string{"/a.txt": "first", "/b.txt": "second"} {
+		if v, err := store.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatal("sealed twice: ", key, " ", err)
+		}
+	}
+}
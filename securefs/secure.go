@@ -85,7 +85,17 @@ func init() {
 }
 */
 
+// CheckAllowProcess tells whether the caller of action may access the vault,
+// allowed accesses keep the vault from locking, see IdleTime
 func CheckAllowProcess(action string, ctx context.Context) bool {
+	if !checkAllowProcess(action, ctx) {
+		return false
+	}
+	Touch()
+	return true
+}
+
+func checkAllowProcess(action string, ctx context.Context) bool {
 	var err error
 
 	caller, ok := fuse.FromContext(ctx)
@@ -151,3 +161,32 @@ func CheckAllowProcess(action string, ctx context.Context) bool {
 		return false
 	}
 }
+
+// callerExe returns the executable of the process of ctx, empty if it is
+// unknown
+func callerExe(ctx context.Context) string {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Pid == 0 {
+		return ""
+	}
+	if processCache != nil {
+		if ps, ok := processCache.Get(caller.Pid); ok {
+			return ps.exec
+		}
+	}
+	ps, err := process.NewProcess(int32(caller.Pid))
+	if err != nil {
+		return ""
+	}
+	exeFile, _ := ps.Exe()
+	return exeFile
+}
+
+// callerUid returns the uid of the process of ctx
+func callerUid(ctx context.Context) uint32 {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return 0
+	}
+	return caller.Uid
+}
@@ -0,0 +1,123 @@
+package securefs
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// Storage is the key value store the file system is kept in, see BadgerDB
+// and MemStorage. Get returns an empty value if the key does not exist.
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, value []byte) error
+	Del(key []byte) error
+	// Batch applies the writes of fn all at once, or none if fn fails
+	Batch(fn func(b Batch) error) error
+	// Iterate calls fn for every key starting with prefix in key order, key
+	// and value are only valid during the call
+	Iterate(prefix []byte, fn func(key []byte, value []byte) error) error
+}
+
+// Batch collects the writes of Storage.Batch
+type Batch interface {
+	Set(key []byte, value []byte) error
+	Del(key []byte) error
+}
+
+// MemStorage keeps everything in a map, for tests and throwaway vaults
+type MemStorage struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{data: make(map[string][]byte)}
+}
+
+func (m *MemStorage) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.data[string(key)]
+	if !ok {
+		return []byte(""), nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *MemStorage) Set(key []byte, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *MemStorage) Del(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, string(key))
+	return nil
+}
+
+type memWrite struct {
+	key   string
+	value []byte
+	del   bool
+}
+
+type memBatch struct {
+	writes []memWrite
+}
+
+func (b *memBatch) Set(key []byte, value []byte) error {
+	b.writes = append(b.writes, memWrite{key: string(key), value: append([]byte{}, value...)})
+	return nil
+}
+
+func (b *memBatch) Del(key []byte) error {
+	b.writes = append(b.writes, memWrite{key: string(key), del: true})
+	return nil
+}
+
+func (m *MemStorage) Batch(fn func(b Batch) error) error {
+	b := &memBatch{}
+	if err := fn(b); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range b.writes {
+		if w.del {
+			delete(m.data, w.key)
+		} else {
+			m.data[w.key] = w.value
+		}
+	}
+	return nil
+}
+
+func (m *MemStorage) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		m.mu.RLock()
+		v, ok := m.data[k]
+		m.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package securefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func testStorage(t *testing.T, s Storage) {
+	if err := s.Set([]byte("a/1"), []byte("one")); err != nil {
+		t.Fatal("Set:", err)
+	}
+	v, err := s.Get([]byte("a/1"))
+	if err != nil || string(v) != "one" {
+		t.Fatal("Get:", err, string(v))
+	}
+	v, err = s.Get([]byte("missing"))
+	if err != nil || len(v) != 0 {
+		t.Fatal("Get missing:", err, v)
+	}
+
+	err = s.Batch(func(b Batch) error {
+		b.Set([]byte("a/2"), []byte("two"))
+		b.Set([]byte("b/1"), []byte("other"))
+		return b.Del([]byte("a/1"))
+	})
+	if err != nil {
+		t.Fatal("Batch:", err)
+	}
+	failed := errors.New("failed")
+	err = s.Batch(func(b Batch) error {
+		b.Set([]byte("a/3"), []byte("three"))
+		return failed
+	})
+	if err != failed {
+		t.Fatal("failed Batch:", err)
+	}
+
+	keys := []string{}
+	err = s.Iterate([]byte("a/"), func(key []byte, value []byte) error {
+		keys = append(keys, string(key)+"="+string(value))
+		return nil
+	})
+	if err != nil || len(keys) != 1 || keys[0] != "a/2=two" {
+		t.Fatal("Iterate:", err, keys)
+	}
+
+	if err := s.Del([]byte("a/2")); err != nil {
+		t.Fatal("Del:", err)
+	}
+	if v, _ := s.Get([]byte("a/2")); len(v) != 0 {
+		t.Fatal("deleted key still set")
+	}
+	s.Del([]byte("b/1"))
+}
+
+func TestMemStorage(t *testing.T) {
+	testStorage(t, NewMemStorage())
+}
+
+func TestBadgerStorage(t *testing.T) {
+	testStorage(t, GetDBInstance())
+	testStorage(t, GetDBInstance().Sealed())
+}
+
+func TestSealedMemStorage(t *testing.T) {
+	testStorage(t, NewSealedStorage(NewMemStorage(), bytes.Repeat([]byte{1}, 32)))
+}
+
+func TestFileOnStorage(t *testing.T) {
+	store := NewMemStorage()
+	root, err := NewRootBoxInode(store)
+	if err != nil {
+		t.Fatal("NewRootBoxInode:", err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+
+	caller := fuse.Caller{}
+	caller.Pid = uint32(os.Getpid())
+	ctx := fuse.NewContext(context.TODO(), &caller)
+
+	_, fh, _, errno := root.Create(ctx, "a.txt", 0, 0644, &fuse.EntryOut{})
+	if errno != fs.OK {
+		t.Fatal("Create:", errno)
+	}
+	if _, errno := fh.(*BoxFile).Write(ctx, []byte("content"), 0); errno != fs.OK {
+		t.Fatal("Write:", errno)
+	}
+	if errno := fh.(*BoxFile).Flush(ctx); errno != fs.OK {
+		t.Fatal("Flush:", errno)
+	}
+	if errno := root.Rename(ctx, "a.txt", root, "b.txt", 0); errno != fs.OK {
+		t.Fatal("Rename:", errno)
+	}
+
+	// a new root sees the same tree
+	loaded, err := NewRootBoxInode(store)
+	if err != nil {
+		t.Fatal("reload:", err)
+	}
+	node, err := loaded.GetChildNode("b.txt")
+	if err != nil || node.Attr.Size != 7 {
+		t.Fatal("renamed file not loaded:", err)
+	}
+	if data := fileContent(store, node); data != "content" {
+		t.Fatal("content:", data)
+	}
+
+	if errno := root.Unlink(ctx, "b.txt"); errno != fs.OK {
+		t.Fatal("Unlink:", errno)
+	}
+	if v, _ := readChunk(store, node.Attr.Ino, 0); len(v) != 0 {
+		t.Fatal("content left after unlink")
+	}
+}
+
+// failStorage refuses every batch once fail is set
+type failStorage struct {
+	*MemStorage
+	fail bool
+}
+
+func (s *failStorage) Set(key []byte, value []byte) error {
+	return s.Batch(func(b Batch) error { return b.Set(key, value) })
+}
+
+func (s *failStorage) Del(key []byte) error {
+	return s.Batch(func(b Batch) error { return b.Del(key) })
+}
+
+func (s *failStorage) Batch(fn func(b Batch) error) error {
+	if s.fail {
+		return errors.New("commit failed")
+	}
+	return s.MemStorage.Batch(fn)
+}
+
+func TestFailedCommit(t *testing.T) {
+	store := &failStorage{MemStorage: NewMemStorage()}
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	_, fh, _, _ := root.Create(ctx, "a.txt", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte("content"), 0)
+	fh.(*BoxFile).Flush(ctx)
+	before, _ := store.Get(inodeKey(fh.(*BoxFile).inode.Attr.Ino))
+
+	store.fail = true
+	if _, _, _, errno := root.Create(ctx, "b.txt", 0, 0644, &fuse.EntryOut{}); errno != syscall.EIO {
+		t.Fatal("Create:", errno)
+	}
+	if errno := root.Rename(ctx, "a.txt", root, "c.txt", 0); errno != syscall.EIO {
+		t.Fatal("Rename:", errno)
+	}
+	if errno := root.Unlink(ctx, "a.txt"); errno != syscall.EIO {
+		t.Fatal("Unlink:", errno)
+	}
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	if errno := fh.(*BoxFile).inode.Setattr(ctx, fh, in, &fuse.AttrOut{}); errno != syscall.EIO {
+		t.Fatal("Setattr:", errno)
+	}
+	fh.(*BoxFile).Write(ctx, []byte("more"), 7)
+	if errno := fh.(*BoxFile).Flush(ctx); errno != syscall.EIO {
+		t.Fatal("Flush:", errno)
+	}
+
+	// neither the store nor the tree changed
+	store.fail = false
+	if _, err := root.GetChildNode("b.txt"); err != os.ErrNotExist {
+		t.Fatal("failed create kept")
+	}
+	if _, err := root.GetChildNode("c.txt"); err != os.ErrNotExist {
+		t.Fatal("failed rename applied")
+	}
+	node, err := root.GetChildNode("a.txt")
+	if err != nil || node.Attr.Size != 11 {
+		t.Fatal("file after failed operations:", err)
+	}
+	if after, _ := store.Get(inodeKey(node.Attr.Ino)); !bytes.Equal(before, after) {
+		t.Fatal("inode record changed")
+	}
+
+	// the data kept in memory is stored once the store works again
+	if errno := fh.(*BoxFile).Flush(ctx); errno != fs.OK {
+		t.Fatal("Flush:", errno)
+	}
+	if data := fileContent(store, node); data != "contentmore" {
+		t.Fatal("content:", data)
+	}
+}
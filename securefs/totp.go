@@ -0,0 +1,192 @@
+package securefs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RFC 6238 defaults, the ones every authenticator app supports
+const (
+	totpDigits    = 6
+	totpPeriod    = 30
+	totpSecretLen = 20
+	// codes of the previous and next period are accepted for clock skew
+	totpSkew = 1
+)
+
+var totpKeyLabel = []byte("strongbox totp key")
+
+var totpSecretAD = []byte("strongbox totp secret")
+
+// TotpParams is the second factor of the vault, its secret is wrapped with a
+// key derived from the master key so the header alone does not reveal it
+type TotpParams struct {
+	WrappedSecret []byte `json:"wrappedSecret"`
+	Digits        int    `json:"digits"`
+	Period        int    `json:"period"`
+	// last period a code was accepted for, codes can not be replayed
+	LastCounter uint64 `json:"lastCounter,omitempty"`
+}
+
+// NewTOTPSecret returns a random secret to enroll with EnableVaultTOTP
+func NewTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// TOTPURI is the otpauth URI of secret, shown as text or QR code to the
+// authenticator app
+func TOTPURI(secret []byte, account string) string {
+	label := url.PathEscape("strongbox:" + account)
+	v := url.Values{}
+	v.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	v.Set("issuer", "strongbox")
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCode is the HOTP value of RFC 4226 for counter
+func totpCode(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func totpCounter(t time.Time, period int) uint64 {
+	return uint64(t.Unix()) / uint64(period)
+}
+
+// verifyTOTP returns the counter code was issued for, codes of a counter not
+// after last are refused
+func verifyTOTP(secret []byte, code string, now time.Time, digits int, period int, last uint64) (uint64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != digits {
+		return 0, false
+	}
+	current := totpCounter(now, period)
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		counter := current + uint64(skew)
+		if counter <= last {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, counter, digits)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpKey wraps the secret of the codes. It comes from the master key, which
+// the password alone unwraps: the code is checked when the vault is
+// unlocked, it does not protect a stolen header and store from someone who
+// knows the password.
+func totpKey(master []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(totpKeyLabel)
+	return mac.Sum(nil)
+}
+
+func (p *TotpParams) secret(master []byte) ([]byte, error) {
+	return openWith(totpKey(master), p.WrappedSecret, totpSecretAD)
+}
+
+// check verifies the one-time code against the secret wrapped with master
+// and remembers its counter
+func (p *TotpParams) check(master []byte, code string) error {
+	secret, err := p.secret(master)
+	if err != nil {
+		return err
+	}
+	defer cfg.Wipe(secret)
+	counter, ok := verifyTOTP(secret, code, timeNow(), p.Digits, p.Period, p.LastCounter)
+	if !ok {
+		return ErrWrongPassword
+	}
+	p.LastCounter = counter
+	return nil
+}
+
+// TOTPEnabled reports whether the vault asks for a one-time code
+func TOTPEnabled() bool {
+	h, err := LoadVaultHeader()
+	return err == nil && h.TOTP != nil
+}
+
+// EnableVaultTOTP unlocks the vault with c and enrolls secret, code must be
+// a valid code of secret so the authenticator is known to work
+func EnableVaultTOTP(c Credentials, secret []byte, code string) error {
+	h, master, _, err := openVaultHeader(c)
+	if err != nil {
+		return err
+	}
+	defer cfg.Wipe(master)
+	if h.TOTP != nil {
+		return errors.New("one-time codes are already enabled")
+	}
+	counter, ok := verifyTOTP(secret, code, timeNow(), totpDigits, totpPeriod, 0)
+	if !ok {
+		return errors.New("wrong one-time code, check the clock of the authenticator")
+	}
+
+	wrapped, err := sealWith(totpKey(master), secret, totpSecretAD)
+	if err != nil {
+		return err
+	}
+	h.TOTP = &TotpParams{WrappedSecret: wrapped, Digits: totpDigits, Period: totpPeriod, LastCounter: counter}
+	h.Version = vaultHeaderVersion
+	err = h.Save()
+	if err != nil {
+		return err
+	}
+	log.Info("vault: one-time codes enabled")
+	cfg.Audit.WithField("vault", vaultName()).Info("totp enabled")
+	return nil
+}
+
+// DisableVaultTOTP unlocks the vault with both factors and removes the second
+func DisableVaultTOTP(c Credentials) error {
+	h, master, _, err := openVaultHeader(c)
+	if err != nil {
+		return err
+	}
+	cfg.Wipe(master)
+	if h.TOTP == nil {
+		return errors.New("one-time codes are not enabled")
+	}
+	h.TOTP = nil
+	err = h.Save()
+	if err != nil {
+		return err
+	}
+	log.Info("vault: one-time codes disabled")
+	cfg.Audit.WithField("vault", vaultName()).Warn("totp disabled")
+	return nil
+}
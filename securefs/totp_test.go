@@ -0,0 +1,93 @@
+package securefs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, sha1
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:         "94287082",
+		1111111109: "07081804",
+		1234567890: "89005924",
+		2000000000: "69279037",
+	} {
+		if got := totpCode(secret, totpCounter(time.Unix(unix, 0), 30), 8); got != want {
+			t.Fatal(unix, " code ", got, " want ", want)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	code := totpCode(secret, totpCounter(now, 30), 6)
+	if _, ok := verifyTOTP(secret, code, now.Add(30*time.Second), 6, 30, 0); !ok {
+		t.Fatal("code of the previous period refused")
+	}
+	if _, ok := verifyTOTP(secret, code, now.Add(90*time.Second), 6, 30, 0); ok {
+		t.Fatal("expired code accepted")
+	}
+	if _, ok := verifyTOTP(secret, code, now, 6, 30, totpCounter(now, 30)); ok {
+		t.Fatal("code replayed")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI([]byte("12345678901234567890"), "me@host")
+	if !strings.HasPrefix(uri, "otpauth://totp/strongbox:me@host?") ||
+		!strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") ||
+		!strings.Contains(uri, "issuer=strongbox") {
+		t.Fatal("uri:", uri)
+	}
+}
+
+func TestVaultTOTP(t *testing.T) {
+	useTempVault(t)
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	c := Credentials{Passwd: []byte("passwd")}
+	if err := Unlock(c); err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	secret, _ := NewTOTPSecret()
+	code := func() string { return totpCode(secret, totpCounter(now, totpPeriod), totpDigits) }
+	wrong := []byte(code())
+	wrong[0] = '0' + (wrong[0]-'0'+1)%10
+	if err := EnableVaultTOTP(c, secret, string(wrong)); err == nil {
+		t.Fatal("enrolled with a wrong code")
+	}
+	if err := EnableVaultTOTP(c, secret, code()); err != nil {
+		t.Fatal("EnableVaultTOTP:", err)
+	}
+	if !TOTPEnabled() {
+		t.Fatal("totp not enabled")
+	}
+
+	// the enrollment code is used, and the password alone is not enough
+	if err := Unlock(Credentials{Passwd: c.Passwd, OTP: code()}); err != ErrWrongPassword {
+		t.Fatal("code replayed:", err)
+	}
+	now = now.Add(time.Hour)
+	if err := Unlock(c); err != ErrWrongPassword {
+		t.Fatal("unlocked without code:", err)
+	}
+
+	now = now.Add(time.Hour)
+	if err := Unlock(Credentials{Passwd: c.Passwd, OTP: code()}); err != nil {
+		t.Fatal("Unlock with code:", err)
+	}
+	if err := Unlock(Credentials{Passwd: []byte("bad"), OTP: code()}); err != ErrWrongPassword {
+		t.Fatal("unlocked with a wrong password:", err)
+	}
+
+	now = now.Add(time.Hour)
+	if err := DisableVaultTOTP(Credentials{Passwd: c.Passwd, OTP: code()}); err != nil {
+		t.Fatal("DisableVaultTOTP:", err)
+	}
+	if err := Unlock(c); err != nil {
+		t.Fatal("Unlock after disable:", err)
+	}
+}
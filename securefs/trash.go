@@ -0,0 +1,216 @@
+package securefs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A deleted file or directory keeps its inode record, its chunks and its
+// versions, only its entry moves out of the tree into the trash:
+//
+//	t/<ino>  TrashEntry
+//
+// The trash is not part of the mounted tree, no process reaches it through
+// the file system, it is listed, restored and purged through the control
+// socket of the user running strongbox.
+
+// ErrNotInTrash is returned for an inode the trash does not hold
+var ErrNotInTrash = errors.New("not in the trash")
+
+type TrashEntry struct {
+	Ino uint64 `json:"ino"`
+	// path of the entry when it was deleted
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	Size uint64    `json:"size"`
+	Dir  bool      `json:"dir,omitempty"`
+	// executable that deleted the entry
+	Process string `json:"process,omitempty"`
+	Uid     uint32 `json:"uid"`
+}
+
+func trashKey(ino uint64) []byte {
+	return []byte("t/" + strconv.FormatUint(ino, 10))
+}
+
+// trashEnabled tells whether deleted entries go to the trash
+func trashEnabled() bool {
+	return cfg.Cfg.Backup.TrashDays > 0
+}
+
+// trash moves the entry of the child c of n out of the tree into the trash
+func (n *BoxInode) trash(c *BoxInode, process string, uid uint32) error {
+	// the written data goes with the inode
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return n.store().Batch(func(b Batch) error {
+		return n.trashIn(b, c, process, uid)
+	})
+}
+
+// trashIn is trash in the batch b, the written data of c must be stored
+func (n *BoxInode) trashIn(b Batch, c *BoxInode, process string, uid uint32) error {
+	e := TrashEntry{Ino: c.Attr.Ino, Path: c.Path(), Time: time.Now(), Size: c.Attr.Size,
+		Dir: c.isDir(), Process: process, Uid: uid}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := b.Del(direntKey(n.Attr.Ino, c.Name)); err != nil {
+		return err
+	}
+	return b.Set(trashKey(e.Ino), data)
+}
+
+// Trash returns the entries of the trash, oldest first
+func (r *BoxInode) Trash() ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	err := r.store().Iterate([]byte("t/"), func(key []byte, value []byte) error {
+		e := TrashEntry{}
+		if err := json.Unmarshal(value, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, err
+}
+
+func (r *BoxInode) trashEntry(ino uint64) (TrashEntry, error) {
+	data, err := r.store().Get(trashKey(ino))
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	if len(data) == 0 {
+		return TrashEntry{}, ErrNotInTrash
+	}
+	e := TrashEntry{}
+	return e, json.Unmarshal(data, &e)
+}
+
+// trashedNode loads the inode ino of the trash, it is not part of the tree
+func (r *BoxInode) trashedNode(ino uint64) (*BoxInode, error) {
+	data, err := r.store().Get(inodeKey(ino))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, os.ErrNotExist
+	}
+	c := &BoxInode{root: r, loaded: true}
+	return c, json.Unmarshal(data, &c.Attr)
+}
+
+// RestoreTrash puts the inode ino of the trash back at to, or where it was
+// deleted when to is empty. The parent directory must exist.
+func (r *BoxInode) RestoreTrash(ino uint64, to string) error {
+	e, err := r.trashEntry(ino)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		to = e.Path
+	}
+	to = path.Clean("/" + to)
+	dir, name := path.Split(to)
+	if name == "" {
+		return os.ErrInvalid
+	}
+	parent, err := r.Resolve(dir)
+	if err != nil {
+		return err
+	}
+	if !parent.isDir() {
+		return os.ErrInvalid
+	}
+	if _, err := parent.GetChildNode(name); err == nil {
+		return os.ErrExist
+	} else if err != os.ErrNotExist {
+		return err
+	}
+	c, err := r.trashedNode(ino)
+	if err != nil {
+		return err
+	}
+	c.Name = name
+	c.parent = parent
+
+	err = r.store().Batch(func(b Batch) error {
+		if err := b.Set(direntKey(parent.Attr.Ino, name), []byte(strconv.FormatUint(ino, 10))); err != nil {
+			return err
+		}
+		return b.Del(trashKey(ino))
+	})
+	if err != nil {
+		return err
+	}
+	// a directory goes to the trash empty, its entries are not loaded
+	c.loaded = !c.isDir()
+	parent.AddExistChildNode(name, c)
+	log.Info("Trash: restored ", e.Path, " as ", to)
+	parent.invalidateEntry(name)
+	return nil
+}
+
+// PurgeTrash deletes the inode ino of the trash with its content and its
+// versions
+func (r *BoxInode) PurgeTrash(ino uint64) error {
+	if _, err := r.trashEntry(ino); err != nil {
+		return err
+	}
+	c, err := r.trashedNode(ino)
+	if err == os.ErrNotExist {
+		return r.store().Del(trashKey(ino))
+	}
+	if err != nil {
+		return err
+	}
+	return c.remove(func(b Batch, refs *chunkRefs) error {
+		return b.Del(trashKey(ino))
+	})
+}
+
+// EmptyTrash purges the entries deleted before the time before, all of them
+// for the zero time, and returns how many were purged
+func (r *BoxInode) EmptyTrash(before time.Time) (int, error) {
+	entries, err := r.Trash()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, e := range entries {
+		if !before.IsZero() && !e.Time.Before(before) {
+			continue
+		}
+		if err := r.PurgeTrash(e.Ino); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// expireTrash purges the entries older than backup.trashDays
+func (r *BoxInode) expireTrash() {
+	if !trashEnabled() {
+		return
+	}
+	purged, err := r.EmptyTrash(time.Now().AddDate(0, 0, -cfg.Cfg.Backup.TrashDays))
+	if err != nil {
+		log.Error("trash expiry error:", err)
+	}
+	if purged != 0 {
+		log.Info("trash expiry: purged ", purged, " entries")
+	}
+}
@@ -0,0 +1,127 @@
+package securefs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestTrash(t *testing.T) {
+	cfg.Cfg.Backup.TrashDays = 7
+	defer func() { cfg.Cfg.Backup.TrashDays = 0 }()
+
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	root.Mkdir(ctx, "dir", 0755, &fuse.EntryOut{})
+	dir, _ := root.GetChildNode("dir")
+	_, fh, _, _ := dir.Create(ctx, "a", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte("deleted by mistake"), 0)
+
+	// the written data goes to the trash with the file
+	if errno := dir.Unlink(ctx, "a"); errno != fs.OK {
+		t.Fatal("Unlink:", errno)
+	}
+	if _, err := dir.GetChildNode("a"); err == nil {
+		t.Fatal("unlinked file still in the tree")
+	}
+	if errno := root.Rmdir(ctx, "dir"); errno != fs.OK {
+		t.Fatal("Rmdir:", errno)
+	}
+	entries, err := root.Trash()
+	if err != nil || len(entries) != 2 || entries[0].Path != "/dir/a" || entries[0].Size != 18 || !entries[1].Dir {
+		t.Fatal("trash:", entries, err)
+	}
+
+	// the file needs its directory back first
+	if err := root.RestoreTrash(entries[0].Ino, ""); err == nil {
+		t.Fatal("restored without its directory")
+	}
+	if err := root.RestoreTrash(entries[1].Ino, ""); err != nil {
+		t.Fatal("RestoreTrash dir:", err)
+	}
+	if err := root.RestoreTrash(entries[0].Ino, ""); err != nil {
+		t.Fatal("RestoreTrash:", err)
+	}
+	a, err := root.Resolve("/dir/a")
+	if err != nil || fileContent(store, a) != "deleted by mistake" {
+		t.Fatal("restored file:", err)
+	}
+
+	// a new root finds the restored entries in the store
+	root2, _ := NewRootBoxInode(store)
+	if a2, err := root2.Resolve("/dir/a"); err != nil || a2.Attr.Size != 18 {
+		t.Fatal("restored file after reload:", err)
+	}
+
+	// purging drops the content, expiry purges the old entries only
+	dir, _ = root.GetChildNode("dir")
+	dir.Unlink(ctx, "a")
+	root.Rmdir(ctx, "dir")
+	entries, _ = root.Trash()
+	if err := root.PurgeTrash(entries[0].Ino); err != nil {
+		t.Fatal("PurgeTrash:", err)
+	}
+	for _, prefix := range []string{"c/", "h/", "r/"} {
+		store.Iterate([]byte(prefix), func(key []byte, value []byte) error {
+			t.Fatal("left after purge: ", string(key))
+			return nil
+		})
+	}
+	if n, _ := root.EmptyTrash(time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatal("expired a recent entry")
+	}
+	if n, _ := root.EmptyTrash(time.Time{}); n != 1 {
+		t.Fatal("EmptyTrash:", n)
+	}
+	if entries, _ := root.Trash(); len(entries) != 0 {
+		t.Fatal("trash not empty:", entries)
+	}
+}
+
+func TestTrashRename(t *testing.T) {
+	cfg.Cfg.Backup.TrashDays = 7
+	defer func() { cfg.Cfg.Backup.TrashDays = 0 }()
+
+	raw := NewMemStorage()
+	store := NewSealedStorage(raw, bytes.Repeat([]byte{1}, 32))
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	_, fh, _, _ := root.Create(ctx, "a", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte("replaced by mistake"), 0)
+	_, fh, _, _ = root.Create(ctx, "b", 0, 0644, &fuse.EntryOut{})
+	fh.(*BoxFile).Write(ctx, []byte("new"), 0)
+	fh.(*BoxFile).Release(ctx)
+
+	// the written data of the replaced file goes to the trash with it
+	if errno := root.Rename(ctx, "b", root, "a", 0); errno != fs.OK {
+		t.Fatal("Rename:", errno)
+	}
+	a, err := root.Resolve("/a")
+	if err != nil || fileContent(store, a) != "new" {
+		t.Fatal("renamed file:", err)
+	}
+	entries, err := root.Trash()
+	if err != nil || len(entries) != 1 || entries[0].Path != "/a" || entries[0].Size != 19 {
+		t.Fatal("trash:", entries, err)
+	}
+	if err := root.RestoreTrash(entries[0].Ino, "/a.old"); err != nil {
+		t.Fatal("RestoreTrash:", err)
+	}
+	old, err := root.Resolve("/a.old")
+	if err != nil || fileContent(store, old) != "replaced by mistake" {
+		t.Fatal("restored file:", err)
+	}
+	if report, err := checkStore(raw, store, false); err != nil || len(report.Problems) != 0 {
+		t.Fatal("store after rename:", report, err)
+	}
+}
@@ -0,0 +1,655 @@
+package securefs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version 1: the derived key is the badger key
+// version 2: the derived key wraps a random master key
+// version 3: the master key is wrapped by several key slots
+// version 4: verifier of the master key
+// version 5: optional totp second factor
+const vaultHeaderVersion = 5
+
+const (
+	KdfArgon2id = "argon2id"
+	// KdfLegacySha1 is the derivation used before the vault header existed,
+	// kept only so that those vaults can still be opened.
+	KdfLegacySha1 = "sha1"
+)
+
+const (
+	CipherAES128 = "aes-128"
+	CipherAES192 = "aes-192"
+	CipherAES256 = "aes-256"
+)
+
+const defaultCipher = CipherAES256
+
+const (
+	defaultKdfTime    = 3
+	defaultKdfMemory  = 64 * 1024
+	defaultKdfThreads = 4
+
+	vaultSaltLen = 16
+	vaultKekLen  = 32
+)
+
+var masterKeyAD = []byte("strongbox master key")
+
+var verifierLabel = []byte("strongbox vault verifier")
+
+// ErrWrongPassword is returned when no key slot accepts the credentials
+var ErrWrongPassword = errors.New("wrong password")
+
+// ErrNoCredentials is returned by Unlock once the credentials were wiped,
+// see Configuration.WipeSecrets
+var ErrNoCredentials = errors.New("no password or keyfile given")
+
+// ErrVaultDestroyed is returned once the key slots were destroyed after too
+// many failed unlocks, see VaultConfig.DestroyAfter
+var ErrVaultDestroyed = errors.New("vault key slots destroyed after too many failed attempts")
+
+// ThrottledError is returned while the vault waits after failed unlocks
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry in %s", e.Wait.Round(time.Second))
+}
+
+const (
+	throttleBase = time.Second
+	throttleMax  = 15 * time.Minute
+)
+
+var timeNow = time.Now
+
+type KdfParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt,omitempty"`
+	Time      uint32 `json:"time,omitempty"`
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	KeyLen    uint32 `json:"keyLen"`
+}
+
+// VaultHeader is stored next to the badger directory. The badger key is a
+// random master key, kept in the header encrypted by each key slot, so
+// credentials can change without touching the database.
+type VaultHeader struct {
+	Version int `json:"version"`
+	// badger encryption, aes-128 if empty
+	Cipher string    `json:"cipher,omitempty"`
+	Slots  []KeySlot `json:"slots,omitempty"`
+	// hmac of a known label with the master key
+	Verifier []byte `json:"verifier,omitempty"`
+	// second factor asked after the key slot, nil if disabled
+	TOTP *TotpParams `json:"totp,omitempty"`
+
+	// failed unlocks in a row
+	FailedAttempts int       `json:"failedAttempts,omitempty"`
+	LastFailure    time.Time `json:"lastFailure,omitempty"`
+	Destroyed      bool      `json:"destroyed,omitempty"`
+
+	// single password of version 1 and 2 headers
+	Kdf        *KdfParams `json:"kdf,omitempty"`
+	WrappedKey []byte     `json:"wrappedKey,omitempty"`
+}
+
+// Credentials are what the user presents to unlock one of the key slots
+type Credentials struct {
+	// password or recovery key
+	Passwd []byte
+	// content of the keyfile
+	Keyfile []byte
+	// one-time code, if the vault has a second factor
+	OTP string
+}
+
+func CurrentCredentials() Credentials {
+	return Credentials{Passwd: cfg.Cfg.GetPasswd(), Keyfile: cfg.Cfg.GetKeyfile(), OTP: cfg.Cfg.GetOTP()}
+}
+
+// in-memory vaults have no directory, keep their header for the process lifetime
+var memoryHeader *VaultHeader
+
+func VaultHeaderPath() string {
+	if cfg.Cfg.Backup.Backend == BackendBlobDir {
+		// inside the directory, synced with it
+		return filepath.Join(cfg.Cfg.Backup.Path, "vault.header")
+	}
+	return filepath.Clean(cfg.Cfg.Backup.Path) + ".header"
+}
+
+func newKdfParams() (KdfParams, error) {
+	kdf := KdfParams{
+		Algorithm: KdfArgon2id,
+		Time:      cfg.Cfg.Vault.KdfTime,
+		Memory:    cfg.Cfg.Vault.KdfMemory,
+		Threads:   cfg.Cfg.Vault.KdfThreads,
+		KeyLen:    vaultKekLen,
+	}
+	if kdf.Time == 0 {
+		kdf.Time = defaultKdfTime
+	}
+	if kdf.Memory == 0 {
+		kdf.Memory = defaultKdfMemory
+	}
+	if kdf.Threads == 0 {
+		kdf.Threads = defaultKdfThreads
+	}
+
+	kdf.Salt = make([]byte, vaultSaltLen)
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return kdf, err
+	}
+	return kdf, nil
+}
+
+// CipherKeyLen returns the master key length of a vault cipher
+func CipherKeyLen(name string) (int, error) {
+	switch name {
+	case CipherAES128, "":
+		return 16, nil
+	case CipherAES192:
+		return 24, nil
+	case CipherAES256:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unknown cipher %q, must be one of aes-128, aes-192, aes-256", name)
+}
+
+// NewVaultHeader creates the header of a new vault with a random master key
+// for the configured cipher, the first slot is the password, or the keyfile
+// if no password is given.
+func NewVaultHeader(c Credentials) (*VaultHeader, []byte, error) {
+	cipherName := cfg.Cfg.Vault.Cipher
+	if cipherName == "" {
+		cipherName = defaultCipher
+	}
+	keyLen, err := CipherKeyLen(cipherName)
+	if err != nil {
+		return nil, nil, err
+	}
+	master := make([]byte, keyLen)
+	if _, err := rand.Read(master); err != nil {
+		return nil, nil, err
+	}
+
+	h := &VaultHeader{Version: vaultHeaderVersion, Cipher: cipherName}
+	h.Verifier = masterVerifier(master)
+	if len(c.Passwd) == 0 && len(c.Keyfile) != 0 {
+		_, err = h.AddSlot(master, SlotKeyfile, "", c.Keyfile)
+	} else {
+		_, err = h.AddSlot(master, SlotPassword, "", c.Passwd)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, master, nil
+}
+
+// LoadVaultHeader returns os.ErrNotExist if the vault has no header yet
+func LoadVaultHeader() (*VaultHeader, error) {
+	if cfg.Cfg.Backup.Memory {
+		if memoryHeader == nil {
+			return nil, os.ErrNotExist
+		}
+		return memoryHeader, nil
+	}
+
+	data, err := os.ReadFile(VaultHeaderPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		log.Error("read vault header error:", err)
+		return nil, err
+	}
+
+	h := &VaultHeader{}
+	err = json.Unmarshal(data, h)
+	if err != nil {
+		log.Error("decode vault header error:", err)
+		return nil, err
+	}
+	if h.Version > vaultHeaderVersion {
+		return nil, fmt.Errorf("vault header version %d not supported", h.Version)
+	}
+
+	// the version 2 password becomes the first slot, the wrapped key
+	// already tells a wrong password so no need to wait for the database
+	if len(h.WrappedKey) != 0 && h.Kdf != nil {
+		h.Slots = []KeySlot{{Type: SlotPassword, Kdf: *h.Kdf, WrappedKey: h.WrappedKey}}
+		h.Kdf = nil
+		h.WrappedKey = nil
+		h.Version = vaultHeaderVersion
+	}
+	return h, nil
+}
+
+func (h *VaultHeader) Save() error {
+	if cfg.Cfg.Backup.Memory {
+		memoryHeader = h
+		return nil
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(VaultHeaderPath(), data)
+	if err != nil {
+		log.Error("write vault header error:", err)
+	}
+	return err
+}
+
+func (kdf *KdfParams) DeriveKey(passwd []byte) ([]byte, error) {
+	switch kdf.Algorithm {
+	case KdfArgon2id:
+		if kdf.Time == 0 || kdf.Threads == 0 || len(kdf.Salt) == 0 {
+			return nil, errors.New("vault header: invalid argon2id parameters")
+		}
+		return argon2.IDKey(passwd, kdf.Salt, kdf.Time, kdf.Memory, kdf.Threads, kdf.KeyLen), nil
+	case KdfLegacySha1:
+		// Sum appends to its argument: copy so that wiping the key
+		// leaves the caller's password intact
+		s := sha1.New().Sum(append([]byte{}, passwd...))
+		return s[0:16], nil
+	}
+	return nil, fmt.Errorf("vault header: unknown kdf %q", kdf.Algorithm)
+}
+
+func masterVerifier(master []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(verifierLabel)
+	return mac.Sum(nil)
+}
+
+func wrapKey(kek []byte, key []byte) ([]byte, error) {
+	return sealWith(kek, key, masterKeyAD)
+}
+
+func unwrapKey(kek []byte, wrapped []byte) ([]byte, error) {
+	return openWith(kek, wrapped, masterKeyAD)
+}
+
+// sealWith encrypts data with aes-gcm, kek is wiped once used
+func sealWith(kek []byte, data []byte, ad []byte) ([]byte, error) {
+	defer cfg.Wipe(kek)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, ad), nil
+}
+
+func openWith(kek []byte, sealed []byte, ad []byte) ([]byte, error) {
+	defer cfg.Wipe(kek)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("vault header: wrapped key too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], ad)
+}
+
+// Unlock tries every key slot and returns the master key with the id of the
+// slot that opened it. Headers written before key wrapping use the derived
+// key as master key, see Upgrade.
+func (h *VaultHeader) Unlock(c Credentials) ([]byte, int, error) {
+	if len(h.Slots) == 0 && h.Kdf != nil {
+		key, err := h.Kdf.DeriveKey(c.Passwd)
+		return key, -1, err
+	}
+
+	for _, slot := range h.Slots {
+		secret := c.secretFor(slot.Type)
+		if secret == nil {
+			continue
+		}
+		master, err := slot.unwrap(secret)
+		if slot.Type != SlotPassword {
+			// derived from the credentials, the password itself is the caller's
+			cfg.Wipe(secret)
+		}
+		if err != nil {
+			continue
+		}
+		if h.Verifier != nil && !hmac.Equal(h.Verifier, masterVerifier(master)) {
+			log.Error("vault: slot ", slot.ID, " does not match the vault verifier")
+			continue
+		}
+		if keyLen, err := CipherKeyLen(h.Cipher); err != nil || keyLen != len(master) {
+			log.Error("vault: slot ", slot.ID, " key does not match cipher ", h.Cipher)
+			continue
+		}
+		if h.TOTP != nil {
+			if err := h.TOTP.check(master, c.OTP); err != nil {
+				// same error as a wrong password, not to confirm the first factor
+				log.Error("vault: slot ", slot.ID, " opened, wrong one-time code")
+				cfg.Wipe(master)
+				return nil, -1, ErrWrongPassword
+			}
+		}
+		log.Debug("vault: unlocked by slot ", slot.ID)
+		return master, slot.ID, nil
+	}
+
+	log.Error("vault: no key slot accepts the credentials")
+	return nil, -1, ErrWrongPassword
+}
+
+// unlockDelay is the time left before the next attempt is allowed, it
+// doubles with every failed attempt
+func (h *VaultHeader) unlockDelay() time.Duration {
+	if h.FailedAttempts == 0 {
+		return 0
+	}
+	delay := throttleMax
+	if h.FailedAttempts < 20 {
+		delay = throttleBase << (h.FailedAttempts - 1)
+	}
+	if delay > throttleMax {
+		delay = throttleMax
+	}
+	wait := h.LastFailure.Add(delay).Sub(timeNow())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// attempt is Unlock with the failed attempt counter kept in the saved header
+func (h *VaultHeader) attempt(c Credentials) ([]byte, int, error) {
+	// nothing was tried, the caller asks for the credentials
+	if len(c.Passwd) == 0 && len(c.Keyfile) == 0 {
+		return nil, -1, ErrNoCredentials
+	}
+	audit := cfg.Audit.WithFields(log.Fields{"vault": vaultName(), "pid": os.Getpid(), "uid": os.Getuid()})
+	if h.Destroyed {
+		audit.Warn("unlock refused: vault destroyed")
+		return nil, -1, ErrVaultDestroyed
+	}
+	if wait := h.unlockDelay(); wait > 0 {
+		audit.Warn("unlock throttled: ", h.FailedAttempts, " failed attempts")
+		return nil, -1, &ThrottledError{Wait: wait}
+	}
+
+	master, id, err := h.Unlock(c)
+	if err == ErrWrongPassword {
+		h.FailedAttempts++
+		h.LastFailure = timeNow()
+		audit.Warn("unlock failed: attempt ", h.FailedAttempts)
+
+		limit := cfg.Cfg.Vault.DestroyAfter
+		if limit > 0 && h.FailedAttempts >= limit {
+			audit.Error("unlock failed ", h.FailedAttempts, " times, destroy key slots")
+			if err := h.destroy(); err != nil {
+				return nil, -1, err
+			}
+			return nil, -1, ErrVaultDestroyed
+		}
+		if err := h.Save(); err != nil {
+			return nil, -1, err
+		}
+		return nil, -1, ErrWrongPassword
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+
+	audit.Info("unlock success: slot ", id)
+	// the accepted one-time code is kept so it can not be used again
+	if h.FailedAttempts != 0 || h.TOTP != nil {
+		h.FailedAttempts = 0
+		h.LastFailure = time.Time{}
+		if err := h.Save(); err != nil {
+			return nil, -1, err
+		}
+	}
+	return master, id, nil
+}
+
+// destroy drops the wrapped master keys, the vault can not be unlocked anymore
+func (h *VaultHeader) destroy() error {
+	for i := range h.Slots {
+		if _, err := rand.Read(h.Slots[i].WrappedKey); err != nil {
+			log.Error("vault: wipe key slot error:", err)
+		}
+	}
+	h.Slots = nil
+	h.Destroyed = true
+
+	// overwrite the old header in place before it is replaced, the destroyed
+	// header is saved even if the old one is left on the disk
+	if !cfg.Cfg.Backup.Memory {
+		if err := overwriteFile(VaultHeaderPath()); err != nil {
+			cfg.Audit.WithFields(log.Fields{"vault": vaultName()}).Error("destroy: old header not overwritten, its key slots may be left on the disk: ", err)
+		}
+	}
+	return h.Save()
+}
+
+// overwriteFile writes random data over the content of the file at path
+func overwriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	junk := make([]byte, st.Size())
+	if _, err := rand.Read(junk); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(junk, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Upgrade wraps the key of an old header and adds the verifier. Those headers
+// cannot tell a wrong password, so it must only be called once the database
+// accepted the key.
+func (h *VaultHeader) Upgrade(master []byte, c Credentials) error {
+	if len(h.Slots) != 0 && h.Verifier != nil {
+		return nil
+	}
+
+	log.Warn("vault: upgrade header to version ", vaultHeaderVersion)
+	if len(h.Slots) == 0 {
+		_, err := h.AddSlot(master, SlotPassword, "", c.Passwd)
+		if err != nil {
+			return err
+		}
+	}
+	h.Version = vaultHeaderVersion
+	h.Kdf = nil
+	h.Verifier = masterVerifier(master)
+	return h.Save()
+}
+
+func legacyVaultHeader() *VaultHeader {
+	h := &VaultHeader{Version: 1}
+	h.Kdf = &KdfParams{Algorithm: KdfLegacySha1, KeyLen: 16}
+	return h
+}
+
+// legacyVaultExists reports a badger directory created before vault headers
+func legacyVaultExists() bool {
+	if cfg.Cfg.Backup.Memory {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(cfg.Cfg.Backup.Path, "MANIFEST"))
+	return err == nil
+}
+
+// VaultExists tells unlocking an existing vault from creating a new one
+func VaultExists() bool {
+	_, err := LoadVaultHeader()
+	if err != os.ErrNotExist {
+		return true
+	}
+	return legacyVaultExists()
+}
+
+// UnlockVault returns the header and the master key of the vault, creating
+// the vault header on first use.
+func UnlockVault(c Credentials) (*VaultHeader, []byte, error) {
+	h, err := LoadVaultHeader()
+	if err == nil {
+		master, _, err := h.attempt(c)
+		return h, master, err
+	}
+	if err != os.ErrNotExist {
+		return nil, nil, err
+	}
+
+	if legacyVaultExists() {
+		log.Warn("vault: no header found, using legacy key derivation")
+		h = legacyVaultHeader()
+		master, _, err := h.Unlock(c)
+		return h, master, err
+	}
+
+	h, master, err := NewVaultHeader(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = h.Save()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("vault: new vault header created")
+	return h, master, nil
+}
+
+// openVaultHeader loads the header and checks the credentials against it
+func openVaultHeader(c Credentials) (*VaultHeader, []byte, int, error) {
+	h, err := LoadVaultHeader()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	if len(h.Slots) == 0 && !h.Destroyed {
+		return nil, nil, -1, errors.New("vault header is outdated, mount the vault once to upgrade it")
+	}
+	master, id, err := h.attempt(c)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	return h, master, id, nil
+}
+
+// ChangeVaultPasswd rewraps the password slot that oldPasswd opens, the vault
+// data is not touched. The one-time code, if needed, is the one of the
+// configuration.
+func ChangeVaultPasswd(oldPasswd []byte, newPasswd []byte) error {
+	h, master, id, err := openVaultHeader(Credentials{Passwd: oldPasswd, OTP: cfg.Cfg.GetOTP()})
+	if err != nil {
+		return err
+	}
+	defer cfg.Wipe(master)
+	slot := h.slot(id)
+	if slot.Type != SlotPassword {
+		return fmt.Errorf("slot %d is a %s slot, not a password", id, slot.Type)
+	}
+	err = slot.wrap(master, newPasswd)
+	if err != nil {
+		return err
+	}
+	err = h.Save()
+	if err != nil {
+		return err
+	}
+	log.Info("vault: password of slot ", id, " changed")
+	return nil
+}
+
+// name of the vault the key in the configuration belongs to
+var unlockedVault string
+
+func vaultName() string {
+	if cfg.Cfg.Backup.Memory {
+		return ":memory:"
+	}
+	return VaultHeaderPath()
+}
+
+// Unlock checks the credentials before the database is opened and keeps the
+// master key, a new vault is created if none exists yet.
+func Unlock(c Credentials) error {
+	if len(c.Passwd) == 0 && len(c.Keyfile) == 0 {
+		return ErrNoCredentials
+	}
+	_, master, err := UnlockVault(c)
+	if err != nil {
+		return err
+	}
+	cfg.Cfg.SetCryptKey(master)
+	cfg.Wipe(master)
+	unlockedVault = vaultName()
+	return nil
+}
+
+// unlockedKey returns the key kept by Unlock, unlocking again with the
+// current credentials if the vault path has changed since
+func unlockedKey() ([]byte, error) {
+	if cfg.Cfg.GetCryptKey() == nil || unlockedVault != vaultName() {
+		err := Unlock(CurrentCredentials())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg.Cfg.GetCryptKey(), nil
+}
+
+// upgradeVaultHeader upgrades an old header once the database opened with master
+func upgradeVaultHeader(master []byte, c Credentials) error {
+	h, err := LoadVaultHeader()
+	if err == os.ErrNotExist && legacyVaultExists() {
+		h = legacyVaultHeader()
+	} else if err != nil {
+		return err
+	}
+	return h.Upgrade(master, c)
+}
@@ -0,0 +1,266 @@
+package securefs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "strongbox/configuration"
+)
+
+func useTempVault(t *testing.T) {
+	backup := cfg.Cfg.Backup
+	t.Cleanup(func() { cfg.Cfg.Backup = backup })
+	cfg.Cfg.Backup.Memory = false
+	cfg.Cfg.Backup.Path = filepath.Join(t.TempDir(), "i.db")
+}
+
+func TestVaultHeaderUnlock(t *testing.T) {
+	h, master, err := NewVaultHeader(Credentials{Passwd: []byte("passwd")})
+	if err != nil {
+		t.Fatal("NewVaultHeader:", err)
+	}
+	if len(master) != 32 || h.Cipher != CipherAES256 {
+		t.Fatal("master key length:", len(master))
+	}
+
+	k, _, err := h.Unlock(Credentials{Passwd: []byte("passwd")})
+	if err != nil || !bytes.Equal(k, master) {
+		t.Fatal("Unlock:", err)
+	}
+	_, _, err = h.Unlock(Credentials{Passwd: []byte("passwd2")})
+	if err != ErrWrongPassword {
+		t.Fatal("Unlock with wrong password:", err)
+	}
+
+	h2, master2, _ := NewVaultHeader(Credentials{Passwd: []byte("passwd")})
+	if bytes.Equal(h.Slots[0].Kdf.Salt, h2.Slots[0].Kdf.Salt) || bytes.Equal(master, master2) {
+		t.Fatal("salt or master key reused")
+	}
+}
+
+func TestVaultChangePasswd(t *testing.T) {
+	useTempVault(t)
+
+	_, master, err := UnlockVault(Credentials{Passwd: []byte("passwd")})
+	if err != nil {
+		t.Fatal("UnlockVault:", err)
+	}
+	err = ChangeVaultPasswd([]byte("passwd"), []byte("new passwd"))
+	if err != nil {
+		t.Fatal("ChangeVaultPasswd:", err)
+	}
+
+	_, k, err := UnlockVault(Credentials{Passwd: []byte("new passwd")})
+	if err != nil || !bytes.Equal(k, master) {
+		t.Fatal("UnlockVault after change:", err)
+	}
+	_, _, err = UnlockVault(Credentials{Passwd: []byte("passwd")})
+	if err == nil {
+		t.Fatal("old password still unlocks")
+	}
+}
+
+func TestVaultHeaderUpgrade(t *testing.T) {
+	useTempVault(t)
+
+	c := Credentials{Passwd: []byte("passwd")}
+	h := legacyVaultHeader()
+	legacy, _, err := h.Unlock(c)
+	if err != nil {
+		t.Fatal("Unlock legacy:", err)
+	}
+	err = h.Upgrade(legacy, c)
+	if err != nil {
+		t.Fatal("Upgrade:", err)
+	}
+
+	_, k, err := UnlockVault(c)
+	if err != nil || !bytes.Equal(k, legacy) {
+		t.Fatal("UnlockVault after upgrade:", err)
+	}
+	h, _ = LoadVaultHeader()
+	if h.Verifier == nil {
+		t.Fatal("upgraded header has no verifier")
+	}
+}
+
+func TestVaultExists(t *testing.T) {
+	useTempVault(t)
+
+	if VaultExists() {
+		t.Fatal("new vault exists")
+	}
+	err := Unlock(Credentials{Passwd: []byte("passwd")})
+	if err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	if !VaultExists() {
+		t.Fatal("vault not created")
+	}
+	err = Unlock(Credentials{Passwd: []byte("passwd2")})
+	if err != ErrWrongPassword {
+		t.Fatal("Unlock with wrong password:", err)
+	}
+}
+
+func TestVaultKeySlots(t *testing.T) {
+	useTempVault(t)
+
+	owner := Credentials{Passwd: []byte("passwd")}
+	_, master, err := UnlockVault(owner)
+	if err != nil {
+		t.Fatal("UnlockVault:", err)
+	}
+
+	keyfile := []byte("keyfile content")
+	kslot, err := AddVaultKeySlot(owner, SlotKeyfile, "laptop", keyfile)
+	if err != nil {
+		t.Fatal("add keyfile slot:", err)
+	}
+	recovery, err := NewRecoveryKey()
+	if err != nil {
+		t.Fatal("NewRecoveryKey:", err)
+	}
+	_, err = AddVaultKeySlot(owner, SlotRecovery, "", []byte(recovery))
+	if err != nil {
+		t.Fatal("add recovery slot:", err)
+	}
+
+	for _, c := range []Credentials{
+		{Keyfile: keyfile},
+		{Passwd: []byte(recovery)},
+		{Passwd: []byte(strings.ToLower(strings.ReplaceAll(recovery, "-", "")))},
+	} {
+		_, k, err := UnlockVault(c)
+		if err != nil || !bytes.Equal(k, master) {
+			t.Fatal("UnlockVault with slot:", err)
+		}
+	}
+
+	err = RevokeVaultKeySlot(owner, kslot.ID)
+	if err != nil {
+		t.Fatal("RevokeVaultKeySlot:", err)
+	}
+	_, _, err = UnlockVault(Credentials{Keyfile: keyfile})
+	if err == nil {
+		t.Fatal("revoked keyfile still unlocks")
+	}
+
+	slots, _ := ListVaultKeySlots()
+	if len(slots) != 2 {
+		t.Fatal("slot count:", len(slots))
+	}
+}
+
+func TestVaultThrottle(t *testing.T) {
+	useTempVault(t)
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	good := Credentials{Passwd: []byte("passwd")}
+	bad := Credentials{Passwd: []byte("bad")}
+	if err := Unlock(good); err != nil {
+		t.Fatal("Unlock:", err)
+	}
+
+	if err := Unlock(bad); err != ErrWrongPassword {
+		t.Fatal("first failure:", err)
+	}
+	var throttled *ThrottledError
+	if err := Unlock(good); !errors.As(err, &throttled) || throttled.Wait != throttleBase {
+		t.Fatal("not throttled:", err)
+	}
+
+	now = now.Add(throttleBase)
+	if err := Unlock(bad); err != ErrWrongPassword {
+		t.Fatal("second failure:", err)
+	}
+	now = now.Add(throttleBase)
+	if err := Unlock(good); !errors.As(err, &throttled) || throttled.Wait != throttleBase {
+		t.Fatal("backoff not doubled:", err)
+	}
+
+	now = now.Add(throttleBase)
+	if err := Unlock(good); err != nil {
+		t.Fatal("Unlock after backoff:", err)
+	}
+	h, _ := LoadVaultHeader()
+	if h.FailedAttempts != 0 {
+		t.Fatal("failed attempts not reset")
+	}
+}
+
+func TestVaultDestroyAfter(t *testing.T) {
+	useTempVault(t)
+	cfg.Cfg.Vault.DestroyAfter = 2
+	defer func() { cfg.Cfg.Vault.DestroyAfter = 0 }()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	if err := Unlock(Credentials{Passwd: []byte("passwd")}); err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	if err := Unlock(Credentials{Passwd: []byte("bad")}); err != ErrWrongPassword {
+		t.Fatal("first failure:", err)
+	}
+	// a header change after a lock has no credentials, it is not an attempt
+	for i := 0; i < 3; i++ {
+		if _, err := AddVaultKeySlot(Credentials{}, SlotPassword, "", []byte("other")); err != ErrNoCredentials {
+			t.Fatal("change without credentials:", err)
+		}
+	}
+	if h, _ := LoadVaultHeader(); h.FailedAttempts != 1 || h.Destroyed {
+		t.Fatal("empty credentials counted:", h.FailedAttempts)
+	}
+	now = now.Add(time.Hour)
+	if err := Unlock(Credentials{Passwd: []byte("bad")}); err != ErrVaultDestroyed {
+		t.Fatal("not destroyed:", err)
+	}
+	if err := Unlock(Credentials{Passwd: []byte("passwd")}); err != ErrVaultDestroyed {
+		t.Fatal("destroyed vault unlocked:", err)
+	}
+}
+
+func TestOverwriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "header")
+	old := bytes.Repeat([]byte("slot"), 100)
+	os.WriteFile(path, old, 0600)
+	if err := overwriteFile(path); err != nil {
+		t.Fatal("overwriteFile:", err)
+	}
+	data, _ := os.ReadFile(path)
+	if len(data) != len(old) || bytes.Contains(data, []byte("slot")) {
+		t.Fatal("not overwritten:", len(data))
+	}
+	if err := overwriteFile(path + ".missing"); err == nil {
+		t.Fatal("missing file overwritten")
+	}
+}
+
+func TestVaultCipher(t *testing.T) {
+	defer func() { cfg.Cfg.Vault.Cipher = "" }()
+
+	for cipher, keyLen := range map[string]int{CipherAES128: 16, CipherAES192: 24, CipherAES256: 32} {
+		cfg.Cfg.Vault.Cipher = cipher
+		h, master, err := NewVaultHeader(Credentials{Passwd: []byte("passwd")})
+		if err != nil {
+			t.Fatal("NewVaultHeader:", err)
+		}
+		if len(master) != keyLen || h.Cipher != cipher {
+			t.Fatal(cipher, " master key length:", len(master))
+		}
+	}
+
+	cfg.Cfg.Vault.Cipher = "des"
+	_, _, err := NewVaultHeader(Credentials{Passwd: []byte("passwd")})
+	if err == nil {
+		t.Fatal("unknown cipher accepted")
+	}
+}
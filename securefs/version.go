@@ -0,0 +1,452 @@
+package securefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "strongbox/configuration"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A version of a file is the list of its chunk hashes when a handle that
+// wrote it was released, it shares the chunk data with the file and the
+// other versions through the reference counts of dedup.go:
+//
+//	v/<ino>/<seq>  Version
+//
+// The sequence is zero padded so the versions of a file iterate in order.
+
+// ErrNoVersion is returned for a version a file does not have
+var ErrNoVersion = errors.New("no such version")
+
+type Version struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Size uint64    `json:"size"`
+	// executable that wrote the version, empty for the content found before
+	// the first recorded write
+	Process string `json:"process,omitempty"`
+	Uid     uint32 `json:"uid"`
+	// the value of each chunk key, the hashes of its pieces, empty for a
+	// chunk that reads as zeros
+	Chunks []string `json:"chunks"`
+}
+
+func versionPrefix(ino uint64) []byte {
+	return []byte("v/" + strconv.FormatUint(ino, 10) + "/")
+}
+
+func versionKey(ino uint64, seq uint64) []byte {
+	return append(versionPrefix(ino), fmt.Sprintf("%020d", seq)...)
+}
+
+// versionsEnabled tells whether closing a written file records a version
+func versionsEnabled() bool {
+	return cfg.Cfg.Backup.Versions > 0 || cfg.Cfg.Backup.VersionDays > 0
+}
+
+// readVersions returns the versions of the file ino, oldest first
+func readVersions(store Storage, ino uint64) ([]Version, error) {
+	versions := []Version{}
+	err := store.Iterate(versionPrefix(ino), func(key []byte, value []byte) error {
+		v := Version{}
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+		versions = append(versions, v)
+		return nil
+	})
+	return versions, err
+}
+
+// storedChunks returns the chunk key values of the file ino of size bytes
+func storedChunks(store Storage, ino uint64, size uint64) ([]string, error) {
+	chunks := []string{}
+	for idx := uint64(0); idx*chunkSize < size; idx++ {
+		hash, err := store.Get(chunkKey(ino, idx))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, string(hash))
+	}
+	return chunks, nil
+}
+
+func sameContent(v Version, size uint64, chunks []string) bool {
+	if v.Size != size || len(v.Chunks) != len(chunks) {
+		return false
+	}
+	for i := range chunks {
+		if v.Chunks[i] != chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// saveVersion writes v as the version of the file ino and counts the
+// references of its chunks
+func saveVersion(b Batch, refs *chunkRefs, ino uint64, v Version) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	for _, value := range v.Chunks {
+		refs.keep(value)
+	}
+	return b.Set(versionKey(ino, v.Seq), data)
+}
+
+// dropVersion deletes the version v of the file ino and its references
+func dropVersion(b Batch, refs *chunkRefs, ino uint64, v Version) error {
+	for _, value := range v.Chunks {
+		refs.release(value)
+	}
+	return b.Del(versionKey(ino, v.Seq))
+}
+
+// pruneVersions drops the versions past the count or the age the
+// configuration keeps, versions is oldest first
+func pruneVersions(b Batch, refs *chunkRefs, ino uint64, versions []Version, now time.Time) error {
+	keep, days := cfg.Cfg.Backup.Versions, cfg.Cfg.Backup.VersionDays
+	for i, v := range versions {
+		tooMany := keep > 0 && i < len(versions)-keep
+		tooOld := days > 0 && v.Time.Before(now.AddDate(0, 0, -days))
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := dropVersion(b, refs, ino, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordVersion adds the stored content of n as its newest version, unless
+// it is the same as the newest one. With first only a file without versions
+// gets one, so the content written before versions were recorded is kept.
+func (n *BoxInode) recordVersion(process string, uid uint32, first bool) error {
+	if !versionsEnabled() {
+		return nil
+	}
+	n.cacheMu.Lock()
+	defer n.cacheMu.Unlock()
+	if n.removed {
+		return nil
+	}
+
+	ino, size := n.Attr.Ino, n.Attr.Size
+	return n.contentBatch(func(b Batch, refs *chunkRefs) error {
+		versions, err := readVersions(n.store(), ino)
+		if err != nil {
+			return err
+		}
+		if first && (len(versions) != 0 || size == 0) {
+			return nil
+		}
+		chunks, err := storedChunks(n.store(), ino, size)
+		if err != nil {
+			return err
+		}
+		v := Version{Seq: 1, Time: time.Now(), Size: size, Process: process, Uid: uid, Chunks: chunks}
+		if first {
+			v.Time = n.Attr.Mtime
+		}
+		if len(versions) != 0 {
+			last := versions[len(versions)-1]
+			if sameContent(last, size, chunks) {
+				return nil
+			}
+			v.Seq = last.Seq + 1
+		}
+		if err := saveVersion(b, refs, ino, v); err != nil {
+			return err
+		}
+		return pruneVersions(b, refs, ino, append(versions, v), time.Now())
+	})
+}
+
+// reclaimVersions drops the versions of the removed inode n with
+// reclaimBatch chunks per batch, the chunks are released from the end of a
+// version written back without them
+func (n *BoxInode) reclaimVersions() error {
+	versions, err := readVersions(n.store(), n.Attr.Ino)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		for done := false; !done; {
+			err := n.contentBatch(func(b Batch, refs *chunkRefs) error {
+				if uint64(len(v.Chunks)) <= reclaimBatch {
+					done = true
+					return dropVersion(b, refs, n.Attr.Ino, v)
+				}
+				keep := uint64(len(v.Chunks)) - reclaimBatch
+				for _, value := range v.Chunks[keep:] {
+					refs.release(value)
+				}
+				v.Chunks = v.Chunks[:keep]
+				data, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				return b.Set(versionKey(n.Attr.Ino, v.Seq), data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adoptVersions gives n the versions of the file it replaces and the
+// content of that file as the newest of them, an editor that saves through a
+// new file and a rename keeps the history. The versions of from are dropped
+// when it is removed, or stay with it in the trash.
+func (n *BoxInode) adoptVersions(b Batch, refs *chunkRefs, from *BoxInode) error {
+	if !versionsEnabled() {
+		return nil
+	}
+	old, err := readVersions(n.store(), from.Attr.Ino)
+	if err != nil {
+		return err
+	}
+	chunks, err := storedChunks(n.store(), from.Attr.Ino, from.Attr.Size)
+	if err != nil {
+		return err
+	}
+	if len(old) == 0 || !sameContent(old[len(old)-1], from.Attr.Size, chunks) {
+		old = append(old, Version{Time: from.Attr.Mtime, Size: from.Attr.Size, Uid: from.Attr.Uid, Chunks: chunks})
+	}
+	mine, err := readVersions(n.store(), n.Attr.Ino)
+	if err != nil {
+		return err
+	}
+
+	// the versions of n are renumbered after the adopted ones, their
+	// references do not change
+	for _, v := range mine {
+		if err := b.Del(versionKey(n.Attr.Ino, v.Seq)); err != nil {
+			return err
+		}
+		for _, value := range v.Chunks {
+			refs.release(value)
+		}
+	}
+	all := append(old, mine...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	for i := range all {
+		all[i].Seq = uint64(i + 1)
+		if err := saveVersion(b, refs, n.Attr.Ino, all[i]); err != nil {
+			return err
+		}
+	}
+	return pruneVersions(b, refs, n.Attr.Ino, all, time.Now())
+}
+
+// Resolve returns the node of path, relative to the root r
+func (r *BoxInode) Resolve(path string) (*BoxInode, error) {
+	n := r
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		c, err := n.GetChildNode(name)
+		if err != nil {
+			return nil, err
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// resolveFile is Resolve for a regular file
+func (r *BoxInode) resolveFile(path string) (*BoxInode, error) {
+	n, err := r.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if n.isDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return n, nil
+}
+
+// Versions returns the versions of the file at path, oldest first
+func (r *BoxInode) Versions(path string) ([]Version, error) {
+	n, err := r.resolveFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return readVersions(n.store(), n.Attr.Ino)
+}
+
+func (n *BoxInode) version(seq uint64) (Version, error) {
+	data, err := n.store().Get(versionKey(n.Attr.Ino, seq))
+	if err != nil {
+		return Version{}, err
+	}
+	if len(data) == 0 {
+		return Version{}, ErrNoVersion
+	}
+	v := Version{}
+	return v, json.Unmarshal(data, &v)
+}
+
+// ReadVersion returns the content of the version seq of the file at path,
+// the current content for seq 0
+func (r *BoxInode) ReadVersion(path string, seq uint64) ([]byte, error) {
+	n, err := r.resolveFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		n.cacheMu.Lock()
+		defer n.cacheMu.Unlock()
+		data := make([]byte, n.Attr.Size)
+		return data, readChunks(n.store(), n.dirty, n.Attr.Ino, 0, data)
+	}
+
+	v, err := n.version(seq)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, v.Size)
+	for idx, value := range v.Chunks {
+		chunk, err := readPieces(n.store(), value)
+		if err != nil {
+			return nil, err
+		}
+		copy(data[uint64(idx)*chunkSize:], chunk)
+	}
+	return data, nil
+}
+
+// setChunks makes v the content of the file ino of size bytes
+func setChunks(b Batch, refs *chunkRefs, ino uint64, size uint64, v Version) error {
+	for idx := uint64(0); idx*chunkSize < size || idx < uint64(len(v.Chunks)); idx++ {
+		if idx < uint64(len(v.Chunks)) && v.Chunks[idx] != "" {
+			if err := refs.link(b, ino, idx, v.Chunks[idx]); err != nil {
+				return err
+			}
+		} else if err := refs.del(b, ino, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreVersion brings back the version seq of the file at path. With an
+// empty name the file gets the content of the version, the replaced content
+// is recorded as a version first. Otherwise a copy with the content of the
+// version is created next to the file.
+func (r *BoxInode) RestoreVersion(path string, seq uint64, name string) error {
+	n, err := r.resolveFile(path)
+	if err != nil {
+		return err
+	}
+	v, err := n.version(seq)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		return n.restoreCopy(v, name)
+	}
+
+	if err := n.flush(); err != nil {
+		return err
+	}
+	if err := n.recordVersion("restore", 0, false); err != nil {
+		return err
+	}
+
+	n.cacheMu.Lock()
+	prev := n.Attr
+	n.Attr.Size = v.Size
+	n.Attr.Mtime = time.Now()
+	n.Attr.Ctime = n.Attr.Mtime
+	err = n.contentBatch(func(b Batch, refs *chunkRefs) error {
+		if err := setChunks(b, refs, n.Attr.Ino, prev.Size, v); err != nil {
+			return err
+		}
+		return n.saveAttr(b)
+	})
+	if err != nil {
+		n.Attr = prev
+	} else {
+		n.dropDirty()
+	}
+	n.cacheMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Restore: ", n.Path(), " version ", seq)
+	n.invalidate()
+	return nil
+}
+
+// restoreCopy creates the file name next to n with the content of v
+func (n *BoxInode) restoreCopy(v Version, name string) error {
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return os.ErrInvalid
+	}
+	parent := n.parent
+	if _, err := parent.GetChildNode(name); err == nil {
+		return os.ErrExist
+	} else if err != os.ErrNotExist {
+		return err
+	}
+	ino, err := n.allocIno()
+	if err != nil {
+		return err
+	}
+
+	c := parent.AddChildNode(name)
+	now := time.Now()
+	c.Attr = BoxAttr{Ino: ino, Size: v.Size, Atime: now, Mtime: now, Ctime: now,
+		Mode: n.Attr.Mode, Uid: n.Attr.Uid, Gid: n.Attr.Gid}
+	err = c.contentBatch(func(b Batch, refs *chunkRefs) error {
+		if err := setChunks(b, refs, ino, 0, v); err != nil {
+			return err
+		}
+		return c.saveEntry(b)
+	})
+	if err != nil {
+		parent.DelChildNode(name)
+		return err
+	}
+
+	log.Info("Restore: ", n.Path(), " version ", v.Seq, " as ", c.Path())
+	parent.invalidateEntry(name)
+	return nil
+}
+
+// invalidate drops the content of n the kernel caches, the nodes the kernel
+// never looked up have nothing cached
+func (n *BoxInode) invalidate() {
+	if n.root.notify && n.StableAttr().Ino != 0 {
+		n.NotifyContent(0, 0)
+	}
+}
+
+// invalidateEntry drops the entry name of n the kernel caches
+func (n *BoxInode) invalidateEntry(name string) {
+	if n.root.notify && n.StableAttr().Ino != 0 {
+		n.NotifyEntry(name)
+	}
+}
+
+// EnableNotify lets the changes made outside of the file operations, such as
+// restoring a version, invalidate the kernel caches, r must be mounted
+func (r *BoxInode) EnableNotify() {
+	r.notify = true
+}
@@ -0,0 +1,99 @@
+package securefs
+
+import (
+	"testing"
+
+	cfg "strongbox/configuration"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestVersions(t *testing.T) {
+	cfg.Cfg.Backup.Versions = 3
+	defer func() { cfg.Cfg.Backup.Versions = 0 }()
+
+	store := NewMemStorage()
+	root, _ := NewRootBoxInode(store)
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := testContext()
+
+	write := func(name string, data string) {
+		n, err := root.GetChildNode(name)
+		var fh fs.FileHandle
+		if err != nil {
+			_, fh, _, _ = root.Create(ctx, name, 0, 0644, &fuse.EntryOut{})
+		} else {
+			fh, _, _ = n.Open(ctx, 0)
+			in := &fuse.SetAttrIn{}
+			in.Valid = fuse.FATTR_SIZE
+			n.Setattr(ctx, fh, in, &fuse.AttrOut{})
+		}
+		fh.(*BoxFile).Write(ctx, []byte(data), 0)
+		if errno := fh.(*BoxFile).Release(ctx); errno != fs.OK {
+			t.Fatal("Release:", errno)
+		}
+	}
+	write("a", "first")
+	write("a", "second")
+	write("a", "second")
+	versions, err := root.Versions("/a")
+	if err != nil || len(versions) != 2 || versions[1].Seq != 2 || versions[1].Size != 6 {
+		t.Fatal("versions:", versions, err)
+	}
+	if data, err := root.ReadVersion("/a", 1); err != nil || string(data) != "first" {
+		t.Fatal("ReadVersion:", string(data), err)
+	}
+
+	// restoring in place keeps the replaced content as a version
+	if err := root.RestoreVersion("/a", 1, ""); err != nil {
+		t.Fatal("RestoreVersion:", err)
+	}
+	a, _ := root.GetChildNode("a")
+	if fileContent(store, a) != "first" || a.Attr.Size != 5 {
+		t.Fatal("restored content:", fileContent(store, a))
+	}
+	if err := root.RestoreVersion("/a", 2, "a.old"); err != nil {
+		t.Fatal("RestoreVersion copy:", err)
+	}
+	if err := root.RestoreVersion("/a", 2, "a.old"); err == nil {
+		t.Fatal("restore over an existing file")
+	}
+	old, _ := root.GetChildNode("a.old")
+	if fileContent(store, old) != "second" {
+		t.Fatal("restored copy:", fileContent(store, old))
+	}
+
+	// only the newest versions are kept
+	write("a", "third")
+	write("a", "fourth")
+	versions, _ = root.Versions("/a")
+	if len(versions) != 3 || versions[0].Seq != 2 {
+		t.Fatal("pruned versions:", versions)
+	}
+	if _, err := root.ReadVersion("/a", 1); err != ErrNoVersion {
+		t.Fatal("pruned version read:", err)
+	}
+
+	// a file saved through a rename keeps the history of the one it replaces
+	write("a.tmp", "fifth")
+	if errno := root.Rename(ctx, "a.tmp", root, "a", 0); errno != fs.OK {
+		t.Fatal("Rename:", errno)
+	}
+	versions, _ = root.Versions("/a")
+	if len(versions) != 3 || versions[1].Size != 6 || versions[2].Size != 5 {
+		t.Fatal("versions after rename:", versions)
+	}
+	if data, _ := root.ReadVersion("/a", versions[1].Seq); string(data) != "fourth" {
+		t.Fatal("adopted version:", string(data))
+	}
+
+	root.Unlink(ctx, "a")
+	root.Unlink(ctx, "a.old")
+	for _, prefix := range []string{"c/", "h/", "r/", "v/"} {
+		store.Iterate([]byte(prefix), func(key []byte, value []byte) error {
+			t.Fatal("left after unlink: ", string(key))
+			return nil
+		})
+	}
+}
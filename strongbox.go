@@ -1,34 +1,112 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/term"
 
 	config "strongbox/configuration"
 	"strongbox/control"
+	"strongbox/securefs"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func credentials() (string, error) {
-	fmt.Print("Enter Password: ")
+// readPassword returns the trimmed input, the caller wipes it once used
+func readPassword(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	password := string(bytePassword)
-	return strings.TrimSpace(password), nil
+	password := append([]byte{}, bytes.TrimSpace(bytePassword)...)
+	config.Wipe(bytePassword)
+	return password, nil
 }
 
+// unlockCredentials loads the credentials from the current source, see
+// -credential
+func unlockCredentials() (securefs.Credentials, error) {
+	src, err := currentCredentialSource()
+	if err != nil {
+		return securefs.Credentials{}, err
+	}
+	err = src.load()
+	if err != nil {
+		return securefs.Credentials{}, err
+	}
+	return securefs.CurrentCredentials(), nil
+}
+
+// unlock asks for the credentials until the vault accepts them, or for a new
+// password if there is no vault yet
+func unlock() error {
+	src, err := currentCredentialSource()
+	if err != nil {
+		return err
+	}
+	if !securefs.VaultExists() {
+		fmt.Println("No vault found, creating a new one.")
+		if src.interactive() {
+			passwd, err := src.readNewPassword()
+			if err != nil {
+				return err
+			}
+			config.Cfg.SetPasswd(passwd)
+			config.Wipe(passwd)
+		} else if err := src.load(); err != nil {
+			return err
+		}
+		return securefs.Unlock(securefs.CurrentCredentials())
+	}
+
+	retries := config.Cfg.Vault.UnlockRetries
+	if retries <= 0 {
+		retries = 3
+	}
+	for i := 1; ; i++ {
+		err = src.load()
+		if err != nil {
+			return err
+		}
+		err = unlockThrottled(securefs.CurrentCredentials())
+		if err != securefs.ErrWrongPassword || !src.interactive() || i >= retries {
+			return err
+		}
+		src.failure = "Wrong password, try again."
+		if securefs.TOTPEnabled() {
+			src.failure = "Wrong password or one-time code, try again."
+		}
+	}
+}
+
+// unlockThrottled waits out the backoff after failed attempts
+func unlockThrottled(c securefs.Credentials) error {
+	for {
+		err := securefs.Unlock(c)
+		var throttled *securefs.ThrottledError
+		if !errors.As(err, &throttled) {
+			return err
+		}
+		fmt.Println(err)
+		time.Sleep(throttled.Wait)
+	}
+}
+
+var keyfile = flag.String("keyfile", "", "unlock with a keyfile instead of a password.")
+
 func main() {
 	runAsUI := flag.Bool("ui", true, "run with ui.")
 	configFile := flag.String("c", "config.yml", "config file.")
+	flag.Usage = usage
 	flag.Parse()
 
 	err := config.Cfg.Load(*configFile)
@@ -36,6 +114,16 @@ func main() {
 		log.Fatal("read config file error:", err)
 	}
 
+	if flag.NArg() > 0 {
+		err = runCommand(flag.Args())
+		config.Cfg.WipeSecrets()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "strongbox:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	c := make(chan os.Signal)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -48,16 +136,27 @@ func main() {
 		return
 	}
 
-	passwd, err := credentials()
-	if passwd == "" || err != nil {
-		log.Fatal("must set password")
-	}
-	config.Cfg.SetPasswd(passwd)
+	for {
+		err = unlock()
+		if err != nil {
+			log.Fatal("unlock failed: ", err)
+		}
 
-	err = control.GetControl().Mount()
-	if err != nil {
-		log.Fatal("Mount failed:", err)
-	}
+		err = control.GetControl().Mount()
+		if err != nil {
+			log.Fatal("Mount failed:", err)
+		}
 
-	control.GetControl().Wait()
+		control.GetControl().Wait()
+		if !control.GetControl().Locked() {
+			return
+		}
+		// the credentials were wiped, only a prompt can give them again
+		src, err := currentCredentialSource()
+		if err != nil || !src.interactive() {
+			fmt.Println("Vault locked.")
+			return
+		}
+		fmt.Println("Vault locked, enter the password to mount it again.")
+	}
 }